@@ -1,8 +1,8 @@
 package checkup
 
 import (
+	"context"
 	"errors"
-	"net"
 	"sync"
 	"time"
 )
@@ -36,12 +36,20 @@ func NewUDPCheckup(hosts []string) Checkup {
 // "udp6" (IPv6-only), "ip", "ip4" (IPv4-only), "ip6" (IPv6-only), "unix",
 // "unixgram" and "unixpacket".
 func NewCheckup(hosts []string, netProto string) Checkup {
+	return NewProberCheckup(hosts, NewDialProber(netProto))
+}
+
+// NewProberCheckup creates a new Checkup that uses prober to check the
+// liveness of the given hosts.
+func NewProberCheckup(hosts []string, prober Prober) Checkup {
 	var checkup checkupInternal
 	checkup.timeout = DefaultTimeout
 	checkup.interval = DefaultInterval
 	checkup.deadAlive = make(map[string]bool)
-	checkup.netProtocol = netProto
+	checkup.prober = prober
 	checkup.stateChangeCallback = defaultCallback
+	checkup.probes = make(map[string]chan bool)
+	checkup.changed = make(chan struct{})
 
 	for _, host := range hosts {
 		checkup.deadAlive[host] = false
@@ -59,7 +67,27 @@ type Checkup interface {
 	SetPingInterval(duration time.Duration)
 	Start() error
 	Stop() error
+	// SetStateChangeHandler replaces the single callback that's called for
+	// each change, use Subscribe to have more than one listener
 	SetStateChangeHandler(callback UpdownCallback)
+
+	// Subscribe returns a Subscription that's sent an Event for every
+	// change, buffering up to buffer of them
+	Subscribe(buffer int) *Subscription
+	Unsubscribe(subscription *Subscription)
+
+	// GetRTT returns the round trip times of successful probes to host, ok
+	// is false if it's never answered
+	GetRTT(host string) (stats RTTStats, ok bool)
+
+	// AddHost starts checking a new host, it's assumed dead until it answers
+	AddHost(host string)
+	// RemoveHost stops checking a host and forgets about it
+	RemoveHost(host string)
+
+	// WaitReady blocks until at least minAlive hosts are alive or ctx is
+	// done, in which case it returns the context's error.
+	WaitReady(ctx context.Context, minAlive int) error
 }
 
 type checkupInternal struct {
@@ -68,8 +96,21 @@ type checkupInternal struct {
 	deadAlive           map[string]bool
 	stateChangeCallback UpdownCallback
 	mutex               sync.RWMutex
-	netProtocol         string
+	prober              Prober
 	closeChannel        chan bool
+	probes              map[string]chan bool
+	// changed is closed and replaced whenever a host changes state
+	changed       chan struct{}
+	subscriptions Subscriptions
+	rtts          RTTTracker
+
+	// phiConfig is nil unless the phi accrual detector is in use
+	phiConfig *PhiConfig
+	detectors map[string]*phiDetector
+
+	// damping is nil unless SetDamping was called
+	damping *DampingConfig
+	flaps   map[string]*flapState
 }
 
 func (c *checkupInternal) GetAliveHosts() []string {
@@ -92,7 +133,7 @@ func (c *checkupInternal) GetDeadHosts() []string {
 	var dead []string
 
 	for host, isAlive := range c.deadAlive {
-		if !isAlive {
+		if !isAlive && !c.isSuppressed(host) {
 			dead = append(dead, host)
 		}
 	}
@@ -127,68 +168,160 @@ func (c *checkupInternal) SetPingInterval(interval time.Duration) {
 }
 
 func (c *checkupInternal) Start() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
 	if c.closeChannel != nil {
 		return AlreadyRunningError
 	}
 
 	c.closeChannel = make(chan bool)
+	if c.phiConfig != nil {
+		c.detectors = make(map[string]*phiDetector)
+	}
 
 	for host, _ := range c.deadAlive {
-		go c.hostCheck(host)
+		c.startProbe(host)
 	}
 
 	return nil
 }
 
-func (c *checkupInternal) hostCheck(host string) {
+// startProbe starts checking a single host, the caller holds the lock
+func (c *checkupInternal) startProbe(host string) {
+	removed := make(chan bool)
+	c.probes[host] = removed
+	go c.hostCheck(host, c.closeChannel, removed)
+}
+
+func (c *checkupInternal) AddHost(host string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, found := c.deadAlive[host]; found {
+		return
+	}
+
+	c.deadAlive[host] = false
+	if c.closeChannel != nil {
+		c.startProbe(host)
+	}
+}
+
+func (c *checkupInternal) RemoveHost(host string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.deadAlive, host)
+	delete(c.detectors, host)
+	delete(c.flaps, host)
+	c.rtts.Remove(host)
+	if removed, found := c.probes[host]; found {
+		close(removed)
+		delete(c.probes, host)
+	}
+}
+
+// hostCheck probes host straight away and then every interval
+func (c *checkupInternal) hostCheck(host string, closeChannel, removed chan bool) {
+	var wait time.Duration
 
 	for {
 
 		currentTimeout := c.GetTimeout()
-		currentInterval := c.GetPingInterval()
 
 		select {
-		case <-time.After(currentInterval):
-			conn, err := net.DialTimeout(c.netProtocol, host, currentTimeout)
+		case <-time.After(wait):
+			wait = c.GetPingInterval()
+
+			start := time.Now()
+			err := c.prober.Probe(host, currentTimeout)
+			rtt := time.Since(start)
+
+			// recording under the lock stops a host removed while it was
+			// being probed from getting a round trip time again
 			c.mutex.RLock()
+			probing := c.probes[host] == removed
+			if probing && err == nil {
+				c.rtts.Record(host, rtt)
+			}
 			wasAlive := c.deadAlive[host]
 			c.mutex.RUnlock()
 
-			isNowAlive := err == nil
-			if err == nil {
-				conn.Close()
+			if !probing {
+				return
 			}
 
+			now := time.Now()
+			isNowAlive := c.probeResult(host, wasAlive, err == nil, now)
+			isNowAlive = c.damp(host, wasAlive, isNowAlive, now)
+
 			c.updateState(host, wasAlive, isNowAlive)
 
-		case <-c.closeChannel:
+		case <-closeChannel:
+			return
+		case <-removed:
 			return
 		}
 	}
 }
 
-// this is a utility function used in hostCheck, it swaps states and calls the
-// callback
+// this is a utility function used in hostCheck, it swaps states, notifies
+// subscribers and calls the callback without holding the lock
 func (c *checkupInternal) updateState(host string, lastState bool, newState bool) {
 	if lastState != newState {
 		c.mutex.Lock()
+		if _, found := c.deadAlive[host]; !found {
+			// the host was removed while it was being checked
+			c.mutex.Unlock()
+			return
+		}
 		c.deadAlive[host] = newState
+		close(c.changed)
+		c.changed = make(chan struct{})
+		callback := c.stateChangeCallback
 		c.mutex.Unlock()
 
+		c.subscriptions.Publish(Event{Host: host, Alive: newState, WasAlive: lastState, Time: time.Now()})
+		callback(host, newState)
+	}
+}
+
+func (c *checkupInternal) WaitReady(ctx context.Context, minAlive int) error {
+	for {
 		c.mutex.RLock()
-		c.stateChangeCallback(host, newState)
+		alive := 0
+		for _, isAlive := range c.deadAlive {
+			if isAlive {
+				alive++
+			}
+		}
+		changed := c.changed
 		c.mutex.RUnlock()
+
+		if alive >= minAlive {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
 func (c *checkupInternal) Stop() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.closeChannel == nil {
 		return AlreadyStoppedError
 	}
 
 	close(c.closeChannel)
 	c.closeChannel = nil
+	c.probes = make(map[string]chan bool)
 
 	return nil
 }
@@ -198,3 +331,15 @@ func (c *checkupInternal) SetStateChangeHandler(callback UpdownCallback) {
 	defer c.mutex.Unlock()
 	c.stateChangeCallback = callback
 }
+
+func (c *checkupInternal) Subscribe(buffer int) *Subscription {
+	return c.subscriptions.Subscribe(buffer)
+}
+
+func (c *checkupInternal) Unsubscribe(subscription *Subscription) {
+	c.subscriptions.Unsubscribe(subscription)
+}
+
+func (c *checkupInternal) GetRTT(host string) (stats RTTStats, ok bool) {
+	return c.rtts.Stats(host)
+}
@@ -1,6 +1,7 @@
 package checkup
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -132,3 +133,57 @@ func TestCallback(t *testing.T) {
 		t.Fatal("Callback never called")
 	}
 }
+
+func TestAddRemoveHost(t *testing.T) {
+	ckup := NewTCPCheckup([]string{"a"}).(*checkupInternal)
+	ckup.Start()
+	defer ckup.Stop()
+
+	ckup.AddHost("b")
+	ckup.AddHost("b")
+
+	if len(ckup.GetDeadHosts()) != 2 || len(ckup.probes) != 2 {
+		t.Fatalf("expected two hosts being checked, got %v", ckup.GetDeadHosts())
+	}
+
+	ckup.updateState("b", false, true)
+	ckup.RemoveHost("b")
+
+	if len(ckup.GetAliveHosts()) != 0 || len(ckup.probes) != 1 {
+		t.Errorf("the removed host was still being checked: %v", ckup.GetAliveHosts())
+	}
+
+	// a check that finishes after the host was removed mustn't bring it back
+	ckup.updateState("b", false, true)
+	if len(ckup.GetAliveHosts()) != 0 {
+		t.Error("a removed host came back")
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	up := ProberFunc(func(host string, timeout time.Duration) error { return nil })
+
+	// the interval is long so only the first probe can find the hosts
+	ckup := NewProberCheckup([]string{"a", "b", "c"}, up)
+	ckup.SetPingInterval(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ckup.WaitReady(ctx, 2); err != context.DeadlineExceeded {
+		t.Errorf("expected to time out before starting, got %v", err)
+	}
+
+	ckup.Start()
+	defer ckup.Stop()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := ckup.WaitReady(ctx, 3); err != nil {
+		t.Fatalf("the hosts weren't probed straight away: %s", err)
+	}
+
+	ckup.AddHost("d")
+	if err := ckup.WaitReady(ctx, 4); err != nil {
+		t.Errorf("an added host wasn't probed straight away: %s", err)
+	}
+}
@@ -0,0 +1,147 @@
+package checkup
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// DampingConfig stops flaky hosts from flipping between alive and dead on
+// every probe. A host has to pass Rise probes in a row to come up and fail
+// Fall in a row to go down, except for its first probe which decides its
+// state straight away. Each time it changes state it picks up Penalty,
+// which halves every HalfLife. Once the penalty reaches SuppressLimit the host is
+// suppressed, it's reported as neither alive nor dead and its changes don't
+// trigger callbacks, until the penalty decays below ReuseLimit.
+type DampingConfig struct {
+	Rise int
+	Fall int
+
+	Penalty       float64
+	SuppressLimit float64
+	ReuseLimit    float64
+	// MaxPenalty caps the penalty so a host isn't suppressed forever, zero
+	// means no cap
+	MaxPenalty float64
+	HalfLife   time.Duration
+}
+
+var DefaultDampingConfig = DampingConfig{
+	Rise:          2,
+	Fall:          2,
+	Penalty:       1000,
+	SuppressLimit: 3000,
+	ReuseLimit:    1000,
+	MaxPenalty:    6000,
+	HalfLife:      time.Minute,
+}
+
+// DampedCheckup is a Checkup that can damp flapping hosts, the Checkups
+// returned by this package implement it.
+type DampedCheckup interface {
+	Checkup
+
+	// SetDamping turns on rise and fall thresholds and flap damping
+	SetDamping(config DampingConfig)
+	// GetSuppressedHosts returns the hosts that are flapping too often to
+	// be trusted, they're in neither GetAliveHosts nor GetDeadHosts
+	GetSuppressedHosts() []string
+}
+
+// flapState tracks the probe history of a single host
+type flapState struct {
+	alive      bool
+	successes  int
+	failures   int
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+func (c *checkupInternal) SetDamping(config DampingConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.damping = &config
+	c.flaps = make(map[string]*flapState)
+}
+
+func (c *checkupInternal) GetSuppressedHosts() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var suppressed []string
+
+	for host, flap := range c.flaps {
+		if flap.suppressed {
+			suppressed = append(suppressed, host)
+		}
+	}
+
+	return suppressed
+}
+
+// isSuppressed reports if host is suppressed, the caller holds the lock
+func (c *checkupInternal) isSuppressed(host string) bool {
+	flap, found := c.flaps[host]
+	return found && flap.suppressed
+}
+
+// damp takes the result of a probe and returns whether the host should be
+// reported as alive. Without damping it's the result itself.
+func (c *checkupInternal) damp(host string, wasAlive, isAlive bool, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, found := c.deadAlive[host]; !found || c.damping == nil {
+		return isAlive
+	}
+	config := c.damping
+
+	// nothing is known about a host until its first probe so that decides
+	// its state straight away
+	flap, found := c.flaps[host]
+	if !found {
+		c.flaps[host] = &flapState{alive: isAlive, updated: now}
+		return isAlive
+	}
+
+	if config.HalfLife > 0 {
+		halfLives := float64(now.Sub(flap.updated)) / float64(config.HalfLife)
+		flap.penalty *= math.Pow(0.5, halfLives)
+	}
+	flap.updated = now
+
+	if isAlive {
+		flap.successes++
+		flap.failures = 0
+	} else {
+		flap.failures++
+		flap.successes = 0
+	}
+
+	rise, fall := config.Rise, config.Fall
+	if rise < 1 {
+		rise = 1
+	}
+	if fall < 1 {
+		fall = 1
+	}
+
+	if !flap.alive && flap.successes >= rise || flap.alive && flap.failures >= fall {
+		flap.alive = !flap.alive
+		flap.penalty += config.Penalty
+		if config.MaxPenalty > 0 {
+			flap.penalty = math.Min(flap.penalty, config.MaxPenalty)
+		}
+	}
+
+	if !flap.suppressed && config.SuppressLimit > 0 && flap.penalty >= config.SuppressLimit {
+		log.Printf("Checkup: %s is flapping, suppressing it\n", host)
+		flap.suppressed = true
+	} else if flap.suppressed && flap.penalty < config.ReuseLimit {
+		log.Printf("Checkup: %s has settled down, no longer suppressing it\n", host)
+		flap.suppressed = false
+	}
+
+	return flap.alive && !flap.suppressed
+}
@@ -0,0 +1,104 @@
+package checkup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRiseAndFall(t *testing.T) {
+	ckup := NewTCPCheckup([]string{"a"}).(*checkupInternal)
+	ckup.SetDamping(DampingConfig{Rise: 2, Fall: 3})
+	now := time.Unix(0, 0)
+
+	var data = []struct {
+		result   bool
+		expected bool
+	}{
+		{false, false},
+		{true, false},
+		{false, false},
+		{true, false},
+		{true, true},
+		{false, true},
+		{false, true},
+		{true, true},
+		{false, true},
+		{false, true},
+		{false, false},
+	}
+
+	alive := false
+	for i, tc := range data {
+		alive = ckup.damp("a", alive, tc.result, now.Add(time.Duration(i)*time.Second))
+		if alive != tc.expected {
+			t.Errorf("probe %d: expected %t got %t", i, tc.expected, alive)
+		}
+	}
+}
+
+func TestFlapSuppression(t *testing.T) {
+	config := DampingConfig{
+		Rise:          1,
+		Fall:          1,
+		Penalty:       1000,
+		SuppressLimit: 2500,
+		ReuseLimit:    800,
+		MaxPenalty:    3000,
+		HalfLife:      time.Minute,
+	}
+
+	ckup := NewTCPCheckup([]string{"a", "b"}).(*checkupInternal)
+	ckup.SetDamping(config)
+	now := time.Unix(0, 0)
+
+	alive := false
+	for i, result := range []bool{true, false, true, false, true} {
+		alive = ckup.damp("a", alive, result, now.Add(time.Duration(i)*time.Second))
+	}
+
+	if alive {
+		t.Error("a flapping host was reported alive")
+	}
+
+	if suppressed := ckup.GetSuppressedHosts(); len(suppressed) != 1 || suppressed[0] != "a" {
+		t.Fatalf("expected a to be suppressed, got %v", suppressed)
+	}
+
+	if dead := ckup.GetDeadHosts(); len(dead) != 1 || dead[0] != "b" {
+		t.Errorf("a suppressed host was reported dead: %v", dead)
+	}
+
+	// staying up for a while isn't enough until the penalty decays
+	alive = ckup.damp("a", alive, true, now.Add(time.Minute))
+	if alive {
+		t.Error("the host was reused before its penalty decayed")
+	}
+
+	// 3000 halves to 750 after two half lives
+	alive = ckup.damp("a", alive, true, now.Add(2*time.Minute+3*time.Second))
+	if !alive || len(ckup.GetSuppressedHosts()) != 0 {
+		t.Error("the host was never reused")
+	}
+}
+
+func TestSuppressionCallbacks(t *testing.T) {
+	ckup := NewTCPCheckup([]string{"a"}).(*checkupInternal)
+	ckup.SetDamping(DampingConfig{Penalty: 1, SuppressLimit: 2, ReuseLimit: 1})
+
+	changes := 0
+	ckup.SetStateChangeHandler(func(host string, isAlive bool) {
+		changes++
+	})
+
+	now := time.Unix(0, 0)
+	for i := 0; i < 20; i++ {
+		wasAlive := ckup.GetAliveHosts() != nil
+		isNowAlive := ckup.damp("a", wasAlive, i%2 == 0, now.Add(time.Duration(i)*time.Second))
+		ckup.updateState("a", wasAlive, isNowAlive)
+	}
+
+	// once for coming up and once for going down, then it's suppressed
+	if changes != 2 {
+		t.Errorf("expected two callbacks, got %d", changes)
+	}
+}
@@ -11,5 +11,12 @@ func main() {
 	})
 	c.Start()
 
+	events := c.Subscribe(0)
+	go func() {
+		for event := range events.Events() {
+			fmt.Printf("%s: %s went from up? %t to up? %t\n", event.Time, event.Host, event.WasAlive, event.Alive)
+		}
+	}()
+
 	select {}
 }
@@ -0,0 +1,182 @@
+package checkup
+
+import (
+	"math"
+	"time"
+)
+
+// PhiConfig configures the phi accrual failure detector. Instead of declaring
+// a host dead on the first failed probe it looks at how long it's been since
+// the last successful one compared to the usual gap between them and derives a
+// suspicion level, phi. A phi of 1 means there's roughly a 10% chance the
+// host is still alive, 2 means 1%, 3 means 0.1% and so on.
+type PhiConfig struct {
+	// Threshold is the phi at which a host is declared dead
+	Threshold float64
+	// WindowSize is how many gaps between successful probes are remembered
+	WindowSize int
+	// MinStdDev keeps very regular hosts from being declared dead the
+	// moment they're slightly late
+	MinStdDev time.Duration
+	// AcceptablePause is added to the mean gap so hosts can miss a few probes
+	AcceptablePause time.Duration
+}
+
+var DefaultPhiConfig = PhiConfig{
+	Threshold:       8,
+	WindowSize:      100,
+	MinStdDev:       500 * time.Millisecond,
+	AcceptablePause: 2 * DefaultInterval,
+}
+
+// PhiCheckup is a Checkup that uses the phi accrual failure detector
+type PhiCheckup interface {
+	Checkup
+
+	// Phi returns the current suspicion level of the host, it's +Inf for
+	// hosts that have never answered.
+	Phi(host string) float64
+	GetThreshold() float64
+	SetThreshold(threshold float64)
+}
+
+func NewTCPPhiCheckup(hosts []string, config PhiConfig) PhiCheckup {
+	return NewPhiCheckup(hosts, "tcp", config)
+}
+
+// NewPhiCheckup creates a Checkup that probes hosts like NewCheckup but only
+// declares them dead once their phi reaches config.Threshold.
+func NewPhiCheckup(hosts []string, netProto string, config PhiConfig) PhiCheckup {
+	return NewPhiProberCheckup(hosts, NewDialProber(netProto), config)
+}
+
+// NewPhiProberCheckup is NewPhiCheckup using prober to check the hosts
+func NewPhiProberCheckup(hosts []string, prober Prober, config PhiConfig) PhiCheckup {
+	checkup := NewProberCheckup(hosts, prober).(*checkupInternal)
+	checkup.phiConfig = &config
+	checkup.detectors = make(map[string]*phiDetector)
+	return checkup
+}
+
+// phiDetector keeps the recent gaps between successful probes of a host
+type phiDetector struct {
+	intervals []float64
+	last      time.Time
+}
+
+// heartbeat records a successful probe at now. The first one seeds the
+// history with the expected interval so there's something to compare to.
+func (this *phiDetector) heartbeat(now time.Time, expected time.Duration, windowSize int) {
+	if this.last.IsZero() {
+		mean := expected.Seconds()
+		this.intervals = []float64{mean - mean/4, mean + mean/4}
+	} else {
+		this.intervals = append(this.intervals, now.Sub(this.last).Seconds())
+	}
+
+	if windowSize > 0 && len(this.intervals) > windowSize {
+		this.intervals = this.intervals[len(this.intervals)-windowSize:]
+	}
+
+	this.last = now
+}
+
+// phi returns the suspicion level at now
+func (this *phiDetector) phi(now time.Time, config *PhiConfig) float64 {
+	if this.last.IsZero() || len(this.intervals) == 0 {
+		return math.Inf(1)
+	}
+
+	var sum float64
+	for _, interval := range this.intervals {
+		sum += interval
+	}
+	mean := sum / float64(len(this.intervals))
+
+	var variance float64
+	for _, interval := range this.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(this.intervals))), config.MinStdDev.Seconds())
+
+	return phi(now.Sub(this.last).Seconds(), mean+config.AcceptablePause.Seconds(), stdDev)
+}
+
+// phi is -log10 of the chance a gap longer than elapsed happens, assuming gaps
+// are normally distributed. It uses a logistic approximation of the normal
+// CDF which is accurate enough and doesn't underflow as quickly.
+func phi(elapsed, mean, stdDev float64) float64 {
+	if stdDev <= 0 {
+		stdDev = math.SmallestNonzeroFloat64
+	}
+
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+func (c *checkupInternal) Phi(host string) float64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	detector, found := c.detectors[host]
+	if !found || c.phiConfig == nil {
+		return math.Inf(1)
+	}
+
+	return detector.phi(time.Now(), c.phiConfig)
+}
+
+func (c *checkupInternal) GetThreshold() float64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.phiConfig == nil {
+		return 0
+	}
+	return c.phiConfig.Threshold
+}
+
+func (c *checkupInternal) SetThreshold(threshold float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.phiConfig != nil {
+		c.phiConfig.Threshold = threshold
+	}
+}
+
+// probeResult decides if a host is alive after a probe. Without a phi config
+// it's whatever the probe said, with one a failed probe only kills a host
+// whose phi has reached the threshold. A dead host's history is thrown away
+// so the time it spent down doesn't skew the gaps.
+func (c *checkupInternal) probeResult(host string, wasAlive, succeeded bool, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, found := c.deadAlive[host]; !found || c.phiConfig == nil {
+		return succeeded
+	}
+
+	detector, found := c.detectors[host]
+	if !found {
+		detector = &phiDetector{}
+		c.detectors[host] = detector
+	}
+
+	if succeeded {
+		detector.heartbeat(now, c.interval, c.phiConfig.WindowSize)
+		return true
+	}
+
+	if wasAlive && detector.phi(now, c.phiConfig) < c.phiConfig.Threshold {
+		return true
+	}
+
+	delete(c.detectors, host)
+	return false
+}
@@ -0,0 +1,145 @@
+package checkup
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPhi(t *testing.T) {
+	var data = []struct {
+		name     string
+		elapsed  float64
+		min, max float64
+	}{
+		{"right on time", 1, 0.2, 0.4},
+		{"early", 0.5, 0, 0.01},
+		{"one deviation late", 1.1, 0.7, 0.9},
+		{"two deviations late", 1.2, 1.5, 1.8},
+		{"very late", 3, 100, math.Inf(1)},
+	}
+
+	for _, tc := range data {
+		result := phi(tc.elapsed, 1, 0.1)
+		if result < tc.min || result > tc.max {
+			t.Errorf("%s: expected phi between %f and %f got %f", tc.name, tc.min, tc.max, result)
+		}
+	}
+}
+
+func TestPhiDetector(t *testing.T) {
+	config := PhiConfig{Threshold: 8, WindowSize: 3, MinStdDev: 10 * time.Millisecond}
+	var detector phiDetector
+	now := time.Unix(0, 0)
+
+	if !math.IsInf(detector.phi(now, &config), 1) {
+		t.Error("a host that never answered should have an infinite phi")
+	}
+
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		detector.heartbeat(now, time.Second, config.WindowSize)
+	}
+
+	if len(detector.intervals) != config.WindowSize {
+		t.Errorf("expected the window to hold %d gaps, got %d", config.WindowSize, len(detector.intervals))
+	}
+
+	if p := detector.phi(now.Add(time.Second), &config); p >= 1 {
+		t.Errorf("an on time host had a phi of %f", p)
+	}
+
+	if p := detector.phi(now.Add(3*time.Second), &config); p < config.Threshold {
+		t.Errorf("a host three gaps late had a phi of %f", p)
+	}
+
+	config.AcceptablePause = 5 * time.Second
+	if p := detector.phi(now.Add(3*time.Second), &config); p >= 1 {
+		t.Errorf("a pause that was acceptable gave a phi of %f", p)
+	}
+}
+
+func TestProbeResult(t *testing.T) {
+	ckup := NewTCPPhiCheckup([]string{"a"}, PhiConfig{Threshold: 3, WindowSize: 10, MinStdDev: 100 * time.Millisecond})
+	internal := ckup.(*checkupInternal)
+	internal.SetPingInterval(time.Second)
+	now := time.Unix(0, 0)
+
+	var data = []struct {
+		name      string
+		offset    time.Duration
+		wasAlive  bool
+		succeeded bool
+		expected  bool
+	}{
+		{"a host that never answered stays dead", 0, false, false, false},
+		{"first answer", time.Second, false, true, true},
+		{"second answer", 2 * time.Second, true, true, true},
+		{"a single missed probe is forgiven", 3 * time.Second, true, false, true},
+		{"but not a long silence", 6 * time.Second, true, false, false},
+		{"dead hosts need to answer", 7 * time.Second, false, false, false},
+		{"and come back when they do", 8 * time.Second, false, true, true},
+	}
+
+	for _, tc := range data {
+		result := internal.probeResult("a", tc.wasAlive, tc.succeeded, now.Add(tc.offset))
+		if result != tc.expected {
+			t.Errorf("%s: expected %t got %t", tc.name, tc.expected, result)
+		}
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	ckup := NewTCPPhiCheckup([]string{}, DefaultPhiConfig)
+	ckup.SetThreshold(3)
+
+	if ckup.GetThreshold() != 3 {
+		t.Error("could not set the threshold")
+	}
+
+	if DefaultPhiConfig.Threshold == 3 {
+		t.Error("setting the threshold changed the defaults")
+	}
+
+	if !math.IsInf(ckup.Phi("missing"), 1) {
+		t.Error("an unknown host should have an infinite phi")
+	}
+}
+
+func TestPhiCheckupFindsHost(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("couldn't listen: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	host := listener.Addr().String()
+	ckup := NewTCPPhiCheckup([]string{host}, DefaultPhiConfig)
+	ckup.SetPingInterval(10 * time.Millisecond)
+	ckup.Start()
+	defer ckup.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ckup.GetAliveHosts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(ckup.GetAliveHosts()) != 1 {
+		t.Fatal("the host never came up")
+	}
+
+	if p := ckup.Phi(host); p > DefaultPhiConfig.Threshold {
+		t.Errorf("an alive host had a phi of %f", p)
+	}
+}
@@ -0,0 +1,98 @@
+package checkup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	BadBannerError = errors.New("The host answered with an unexpected banner")
+)
+
+// Prober checks whether a single host is healthy, returning nil if it is.
+// Probes must give up once timeout has passed.
+type Prober interface {
+	Probe(host string, timeout time.Duration) error
+}
+
+// ProberFunc lets an ordinary function act as a Prober
+type ProberFunc func(host string, timeout time.Duration) error
+
+func (f ProberFunc) Probe(host string, timeout time.Duration) error {
+	return f(host, timeout)
+}
+
+// NewDialProber creates a Prober that only checks a connection can be made
+// with the given protocol, it's what NewCheckup uses.
+func NewDialProber(netProto string) Prober {
+	return ProberFunc(func(host string, timeout time.Duration) error {
+		conn, err := net.DialTimeout(netProto, host, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// NewBannerProber creates a Prober that connects and checks the host sends
+// banner before anything else, so a listener that accepts connections but
+// never answers isn't considered healthy.
+func NewBannerProber(netProto string, banner []byte) Prober {
+	return ProberFunc(func(host string, timeout time.Duration) error {
+		deadline := time.Now().Add(timeout)
+		conn, err := net.DialTimeout(netProto, host, timeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(deadline)
+		received := make([]byte, len(banner))
+		if _, err := io.ReadFull(conn, received); err != nil {
+			return err
+		}
+
+		if !bytes.Equal(received, banner) {
+			return BadBannerError
+		}
+		return nil
+	})
+}
+
+// NewHTTPProber creates a Prober that GETs scheme://host/path and expects a
+// 2xx response. client may be nil to use a default client, pass one to use
+// TLS certificates.
+func NewHTTPProber(scheme, path string, client *http.Client) Prober {
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return ProberFunc(func(host string, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		request, err := http.NewRequest("GET", scheme+"://"+host+path, nil)
+		if err != nil {
+			return err
+		}
+
+		response, err := client.Do(request.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		io.Copy(ioutil.Discard, response.Body)
+
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return fmt.Errorf("health check of %s returned %s", host, response.Status)
+		}
+		return nil
+	})
+}
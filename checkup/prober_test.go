@@ -0,0 +1,140 @@
+package checkup
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen accepts connections and hands them to serve until the test ends
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("couldn't listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestBannerProber(t *testing.T) {
+	banner := listen(t, func(conn net.Conn) {
+		conn.Write([]byte("historia\n"))
+		conn.Close()
+	})
+	wrong := listen(t, func(conn net.Conn) {
+		conn.Write([]byte("something"))
+		conn.Close()
+	})
+	silent := listen(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+		conn.Close()
+	})
+
+	prober := NewBannerProber("tcp", []byte("historia\n"))
+
+	var data = []struct {
+		name    string
+		host    string
+		healthy bool
+	}{
+		{"banner", banner, true},
+		{"wrong banner", wrong, false},
+		{"silent", silent, false},
+	}
+
+	for _, tc := range data {
+		err := prober.Probe(tc.host, 50*time.Millisecond)
+		if (err == nil) != tc.healthy {
+			t.Errorf("%s: expected healthy to be %t, got %v", tc.name, tc.healthy, err)
+		}
+	}
+
+	if prober.Probe(wrong, time.Second) != BadBannerError {
+		t.Error("expected a BadBannerError")
+	}
+}
+
+func TestHTTPProber(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.WriteHeader(http.StatusOK)
+		case "/slow":
+			time.Sleep(time.Second)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var data = []struct {
+		path    string
+		healthy bool
+	}{
+		{"/health", true},
+		{"/broken", false},
+		{"/slow", false},
+	}
+
+	for _, tc := range data {
+		err := NewHTTPProber("http", tc.path, nil).Probe(host, 50*time.Millisecond)
+		if (err == nil) != tc.healthy {
+			t.Errorf("%s: expected healthy to be %t, got %v", tc.path, tc.healthy, err)
+		}
+	}
+}
+
+func TestDialProber(t *testing.T) {
+	host := listen(t, func(conn net.Conn) { conn.Close() })
+
+	if err := NewDialProber("tcp").Probe(host, time.Second); err != nil {
+		t.Errorf("couldn't dial a listening host: %s", err)
+	}
+}
+
+func TestProberCheckup(t *testing.T) {
+	healthy := make(chan bool)
+	prober := ProberFunc(func(host string, timeout time.Duration) error {
+		select {
+		case <-healthy:
+			return nil
+		default:
+			return errors.New("unhealthy")
+		}
+	})
+
+	ckup := NewProberCheckup([]string{"a"}, prober)
+	ckup.SetPingInterval(5 * time.Millisecond)
+	ckup.Start()
+	defer ckup.Stop()
+
+	// closing keeps every later probe healthy, a single send only lets one
+	// through and the next probe can mark the host down before we look
+	close(healthy)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ckup.GetAliveHosts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if len(ckup.GetAliveHosts()) != 1 {
+		t.Error("the custom prober was never used")
+	}
+}
@@ -0,0 +1,118 @@
+package checkup
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// RTTWindow is how many round trip times are kept per host for the
+	// percentiles
+	RTTWindow = 128
+	// RTTSmoothing is the weight given to each new sample in the EWMA
+	RTTSmoothing = 0.2
+)
+
+// RTTStats summarizes the round trip times of successful probes to a host
+type RTTStats struct {
+	// Samples is how many probes have been measured in total
+	Samples int
+	Last    time.Duration
+	// EWMA is the exponentially weighted moving average
+	EWMA time.Duration
+	// the rest are over the last RTTWindow samples
+	Min time.Duration
+	Max time.Duration
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// RTTTracker records round trip times per host, the zero value is ready to
+// use.
+type RTTTracker struct {
+	lock  sync.Mutex
+	hosts map[string]*rttHistory
+}
+
+type rttHistory struct {
+	samples []time.Duration
+	next    int
+	count   int
+	ewma    float64
+	last    time.Duration
+}
+
+// Record adds a round trip time for host
+func (this *RTTTracker) Record(host string, rtt time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.hosts == nil {
+		this.hosts = make(map[string]*rttHistory)
+	}
+
+	history, found := this.hosts[host]
+	if !found {
+		history = &rttHistory{ewma: float64(rtt)}
+		this.hosts[host] = history
+	}
+
+	if len(history.samples) < RTTWindow {
+		history.samples = append(history.samples, rtt)
+	} else {
+		history.samples[history.next] = rtt
+	}
+	history.next = (history.next + 1) % RTTWindow
+
+	history.count++
+	history.last = rtt
+	history.ewma += RTTSmoothing * (float64(rtt) - history.ewma)
+}
+
+// Remove forgets everything recorded for host
+func (this *RTTTracker) Remove(host string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.hosts, host)
+}
+
+// Stats returns the statistics for host, ok is false if nothing has been
+// recorded for it.
+func (this *RTTTracker) Stats(host string) (stats RTTStats, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	history, found := this.hosts[host]
+	if !found {
+		return RTTStats{}, false
+	}
+
+	sorted := append([]time.Duration{}, history.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return RTTStats{
+		Samples: history.count,
+		Last:    history.last,
+		EWMA:    time.Duration(history.ewma),
+		Min:     sorted[0],
+		Max:     sorted[len(sorted)-1],
+		P50:     percentile(sorted, 0.5),
+		P90:     percentile(sorted, 0.9),
+		P99:     percentile(sorted, 0.99),
+	}, true
+}
+
+// percentile returns the nearest rank percentile p of sorted
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,122 @@
+package checkup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTStats(t *testing.T) {
+	var tracker RTTTracker
+
+	if _, ok := tracker.Stats("a"); ok {
+		t.Error("a host with no samples had stats")
+	}
+
+	for i := 1; i <= 100; i++ {
+		tracker.Record("a", time.Duration(i)*time.Millisecond)
+	}
+
+	stats, ok := tracker.Stats("a")
+	if !ok {
+		t.Fatal("no stats were recorded")
+	}
+
+	var data = []struct {
+		name     string
+		value    time.Duration
+		expected time.Duration
+	}{
+		{"last", stats.Last, 100 * time.Millisecond},
+		{"min", stats.Min, 1 * time.Millisecond},
+		{"max", stats.Max, 100 * time.Millisecond},
+		{"p50", stats.P50, 50 * time.Millisecond},
+		{"p90", stats.P90, 90 * time.Millisecond},
+		{"p99", stats.P99, 99 * time.Millisecond},
+	}
+
+	for _, tc := range data {
+		if tc.value != tc.expected {
+			t.Errorf("%s: expected %s got %s", tc.name, tc.expected, tc.value)
+		}
+	}
+
+	if stats.Samples != 100 {
+		t.Errorf("expected 100 samples got %d", stats.Samples)
+	}
+
+	// the average leans towards the recent samples
+	if stats.EWMA < 90*time.Millisecond || stats.EWMA > 100*time.Millisecond {
+		t.Errorf("expected the EWMA to be in the 90s, got %s", stats.EWMA)
+	}
+}
+
+func TestRTTWindow(t *testing.T) {
+	var tracker RTTTracker
+
+	for i := 0; i < RTTWindow; i++ {
+		tracker.Record("a", time.Second)
+	}
+	for i := 0; i < RTTWindow; i++ {
+		tracker.Record("a", time.Millisecond)
+	}
+
+	stats, _ := tracker.Stats("a")
+	if stats.Max != time.Millisecond || stats.Samples != 2*RTTWindow {
+		t.Errorf("old samples weren't dropped: %+v", stats)
+	}
+
+	tracker.Remove("a")
+	if _, ok := tracker.Stats("a"); ok {
+		t.Error("the host wasn't removed")
+	}
+}
+
+func TestCheckupRecordsRTT(t *testing.T) {
+	slow := ProberFunc(func(host string, timeout time.Duration) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+
+	ckup := NewProberCheckup([]string{"a"}, slow)
+	ckup.SetPingInterval(time.Hour)
+	ckup.Start()
+	defer ckup.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats, ok := ckup.GetRTT("a"); ok {
+			if stats.Last < 5*time.Millisecond {
+				t.Errorf("expected the probe to take at least 5ms, got %s", stats.Last)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Error("the probe's round trip time wasn't recorded")
+}
+
+func TestRemovedHostRTTNotRecorded(t *testing.T) {
+	probing := make(chan bool)
+	release := make(chan bool)
+	blocked := ProberFunc(func(host string, timeout time.Duration) error {
+		probing <- true
+		<-release
+		return nil
+	})
+
+	ckup := NewProberCheckup([]string{"a"}, blocked)
+	ckup.SetPingInterval(time.Hour)
+	ckup.Start()
+	defer ckup.Stop()
+
+	<-probing
+	ckup.RemoveHost("a")
+	close(release)
+
+	// give the probe time to finish
+	time.Sleep(20 * time.Millisecond)
+	if stats, ok := ckup.GetRTT("a"); ok {
+		t.Errorf("a removed host got a round trip time: %v", stats)
+	}
+}
@@ -0,0 +1,88 @@
+package checkup
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSubscriptionBuffer is how many events a subscriber can fall behind
+// by before events are dropped
+const DefaultSubscriptionBuffer = 64
+
+// Event is a host changing state
+type Event struct {
+	Host     string
+	Alive    bool
+	WasAlive bool
+	Time     time.Time
+}
+
+// Subscription receives events until it's unsubscribed, at which point its
+// channel is closed. Events are never waited on, if the buffer is full
+// they're dropped and counted.
+type Subscription struct {
+	events  chan Event
+	dropped uint64
+}
+
+// Events returns the channel events are delivered on
+func (this *Subscription) Events() <-chan Event {
+	return this.events
+}
+
+// Dropped returns how many events didn't fit in the buffer
+func (this *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&this.dropped)
+}
+
+// Subscriptions keeps track of the subscribers of a Checkup, the zero value
+// is ready to use.
+type Subscriptions struct {
+	lock        sync.Mutex
+	subscribers map[*Subscription]bool
+}
+
+// Subscribe returns a Subscription whose channel holds up to buffer events, a
+// buffer less than one uses DefaultSubscriptionBuffer.
+func (this *Subscriptions) Subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = DefaultSubscriptionBuffer
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.subscribers == nil {
+		this.subscribers = make(map[*Subscription]bool)
+	}
+
+	subscription := &Subscription{events: make(chan Event, buffer)}
+	this.subscribers[subscription] = true
+	return subscription
+}
+
+// Unsubscribe stops delivering events to subscription and closes its channel
+func (this *Subscriptions) Unsubscribe(subscription *Subscription) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.subscribers[subscription] {
+		delete(this.subscribers, subscription)
+		close(subscription.events)
+	}
+}
+
+// Publish delivers event to every subscriber without blocking
+func (this *Subscriptions) Publish(event Event) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for subscription := range this.subscribers {
+		select {
+		case subscription.events <- event:
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package checkup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	ckup := NewTCPCheckup([]string{"a"}).(*checkupInternal)
+	first := ckup.Subscribe(4)
+	second := ckup.Subscribe(4)
+
+	before := time.Now()
+	ckup.updateState("a", false, true)
+	ckup.updateState("a", true, false)
+
+	for _, subscription := range []*Subscription{first, second} {
+		var data = []struct {
+			alive    bool
+			wasAlive bool
+		}{
+			{true, false},
+			{false, true},
+		}
+
+		for _, tc := range data {
+			event := <-subscription.Events()
+			if event.Host != "a" || event.Alive != tc.alive || event.WasAlive != tc.wasAlive {
+				t.Errorf("expected a to go from %t to %t, got %+v", tc.wasAlive, tc.alive, event)
+			}
+
+			if event.Time.Before(before) {
+				t.Errorf("the event's time %s was before the change", event.Time)
+			}
+		}
+	}
+
+	ckup.Unsubscribe(first)
+	ckup.Unsubscribe(first)
+	ckup.updateState("a", false, true)
+
+	if _, open := <-first.Events(); open {
+		t.Error("an unsubscribed channel got an event")
+	}
+
+	if event := <-second.Events(); !event.Alive {
+		t.Errorf("the remaining subscriber got %+v", event)
+	}
+}
+
+func TestSubscribeDoesntBlock(t *testing.T) {
+	ckup := NewTCPCheckup([]string{"a"}).(*checkupInternal)
+	subscription := ckup.Subscribe(1)
+
+	for i := 0; i < 5; i++ {
+		ckup.updateState("a", false, true)
+		ckup.updateState("a", true, false)
+	}
+
+	if subscription.Dropped() != 9 {
+		t.Errorf("expected 9 dropped events, got %d", subscription.Dropped())
+	}
+
+	if event := <-subscription.Events(); !event.Alive {
+		t.Errorf("expected the oldest event to be kept, got %+v", event)
+	}
+}
+
+func TestSlowCallbackDoesntBlockReads(t *testing.T) {
+	ckup := NewTCPCheckup([]string{"a"}).(*checkupInternal)
+	release := make(chan bool)
+	ckup.SetStateChangeHandler(func(host string, isAlive bool) {
+		<-release
+	})
+
+	go ckup.updateState("a", false, true)
+	defer close(release)
+
+	done := make(chan bool)
+	go func() {
+		for len(ckup.GetAliveHosts()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		ckup.SetTimeout(time.Second)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("a slow callback blocked the checkup")
+	}
+}
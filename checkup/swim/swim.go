@@ -0,0 +1,688 @@
+// Package swim is a gossip based failure detector following the SWIM paper
+// (Das, Gupta and Motivala 2002). Each member probes one other member per
+// interval, asks a few others to probe indirectly if there's no answer, and
+// only declares a member dead after it has been suspected for a while without
+// refuting it. Changes are piggybacked on the probes, so every member does a
+// constant amount of work however large the cluster is and they all converge
+// on the same view.
+//
+// A swim Checkup implements checkup.Checkup and cohort.LivenessChecker.
+package swim
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/josephlewis42/historia/checkup"
+)
+
+// State is what a member believes about another member
+type State int
+
+const (
+	StateAlive State = iota
+	// StateSuspect members didn't answer a probe, they're still counted as
+	// alive until SuspicionTimeout passes without them refuting it
+	StateSuspect
+	StateDead
+)
+
+var stateNames = map[State]string{
+	StateAlive:   "alive",
+	StateSuspect: "suspect",
+	StateDead:    "dead",
+}
+
+func (s State) String() string {
+	name, found := stateNames[s]
+	if !found {
+		return "state(" + strconv.Itoa(int(s)) + ")"
+	}
+	return name
+}
+
+// Config controls the protocol, DefaultConfig has sensible values
+type Config struct {
+	// Self is the address this member is known by, Hosts are the other
+	// members to start with. Self is ignored if it's in Hosts.
+	Self  string
+	Hosts []string
+
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+
+	// IndirectProbes is how many members are asked to probe a member that
+	// didn't answer directly
+	IndirectProbes int
+
+	SuspicionTimeout time.Duration
+
+	// each change is piggybacked RetransmitMultiplier * log(n) times, at
+	// most MaxPiggyback changes per packet
+	RetransmitMultiplier int
+	MaxPiggyback         int
+}
+
+func DefaultConfig(self string, hosts []string) Config {
+	return Config{
+		Self:                 self,
+		Hosts:                hosts,
+		ProbeInterval:        time.Second,
+		ProbeTimeout:         time.Millisecond * 200,
+		IndirectProbes:       3,
+		SuspicionTimeout:     time.Second * 5,
+		RetransmitMultiplier: 4,
+		MaxPiggyback:         8,
+	}
+}
+
+const (
+	messagePing    = "ping"
+	messageAck     = "ack"
+	messagePingReq = "pingreq"
+)
+
+// update is a piece of gossip about a single member
+type update struct {
+	Host        string
+	State       State
+	Incarnation uint64
+}
+
+type message struct {
+	Type string
+	Seq  uint64
+	From string
+	// Incarnation is the sender's own, receiving a message is proof the
+	// sender is alive at that incarnation
+	Incarnation uint64
+	// Target is the member a pingreq asks to be probed
+	Target  string
+	Updates []update
+}
+
+type member struct {
+	state       State
+	incarnation uint64
+	changed     time.Time
+}
+
+type broadcast struct {
+	update    update
+	transmits int
+}
+
+type swimInternal struct {
+	transport Transport
+
+	lock         sync.Mutex
+	config       Config
+	members      map[string]*member
+	incarnation  uint64
+	broadcasts   []*broadcast
+	acks         map[uint64]chan bool
+	seq          uint64
+	order        []string
+	callback     checkup.UpdownCallback
+	closeChannel chan bool
+	rand         *rand.Rand
+	// changed is closed and replaced whenever a member changes state
+	changed       chan struct{}
+	subscriptions checkup.Subscriptions
+	rtts          checkup.RTTTracker
+}
+
+// New creates a Checkup that gossips over transport. Members start out dead
+// until they're heard from. Stop doesn't close the transport.
+func New(config Config, transport Transport) checkup.Checkup {
+	this := &swimInternal{
+		transport: transport,
+		config:    config,
+		members:   make(map[string]*member),
+		acks:      make(map[uint64]chan bool),
+		callback:  func(host string, isAlive bool) {},
+		changed:   make(chan struct{}),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		// starting from the clock means a restarted member is newer than
+		// anything the others remember about it
+		incarnation: uint64(time.Now().UnixNano()),
+	}
+
+	for _, host := range config.Hosts {
+		this.AddHost(host)
+	}
+
+	return this
+}
+
+// NewUDP creates a Checkup that gossips over UDP on config.Self
+func NewUDP(config Config) (checkup.Checkup, error) {
+	transport, err := NewUDPTransport(config.Self)
+	if err != nil {
+		return nil, err
+	}
+	return New(config, transport), nil
+}
+
+func (this *swimInternal) GetAliveHosts() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	alive := []string{this.config.Self}
+	for host, m := range this.members {
+		if m.state != StateDead {
+			alive = append(alive, host)
+		}
+	}
+	return alive
+}
+
+func (this *swimInternal) GetDeadHosts() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var dead []string
+	for host, m := range this.members {
+		if m.state == StateDead {
+			dead = append(dead, host)
+		}
+	}
+	return dead
+}
+
+func (this *swimInternal) GetTimeout() time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.config.ProbeTimeout
+}
+
+func (this *swimInternal) GetPingInterval() time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.config.ProbeInterval
+}
+
+func (this *swimInternal) SetTimeout(duration time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.config.ProbeTimeout = duration
+}
+
+func (this *swimInternal) SetPingInterval(duration time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.config.ProbeInterval = duration
+}
+
+func (this *swimInternal) SetStateChangeHandler(callback checkup.UpdownCallback) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.callback = callback
+}
+
+func (this *swimInternal) AddHost(host string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, found := this.members[host]; found || host == this.config.Self {
+		return
+	}
+	this.members[host] = &member{state: StateDead, changed: time.Now()}
+}
+
+func (this *swimInternal) RemoveHost(host string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.members, host)
+	this.rtts.Remove(host)
+	for i, b := range this.broadcasts {
+		if b.update.Host == host {
+			this.broadcasts = append(this.broadcasts[:i], this.broadcasts[i+1:]...)
+			break
+		}
+	}
+}
+
+func (this *swimInternal) Start() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closeChannel != nil {
+		return checkup.AlreadyRunningError
+	}
+
+	this.closeChannel = make(chan bool)
+	go this.receiveLoop(this.closeChannel)
+	go this.probeLoop(this.closeChannel)
+	return nil
+}
+
+func (this *swimInternal) Stop() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closeChannel == nil {
+		return checkup.AlreadyStoppedError
+	}
+
+	close(this.closeChannel)
+	this.closeChannel = nil
+	return nil
+}
+
+func (this *swimInternal) Subscribe(buffer int) *checkup.Subscription {
+	return this.subscriptions.Subscribe(buffer)
+}
+
+func (this *swimInternal) Unsubscribe(subscription *checkup.Subscription) {
+	this.subscriptions.Unsubscribe(subscription)
+}
+
+func (this *swimInternal) GetRTT(host string) (stats checkup.RTTStats, ok bool) {
+	return this.rtts.Stats(host)
+}
+
+func (this *swimInternal) WaitReady(ctx context.Context, minAlive int) error {
+	for {
+		alive := len(this.GetAliveHosts())
+
+		this.lock.Lock()
+		changed := this.changed
+		this.lock.Unlock()
+
+		if alive >= minAlive {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify tells subscribers and the state change handler about each change,
+// it must be called without the lock held.
+func (this *swimInternal) notify(changes []checkup.Event) {
+	if len(changes) == 0 {
+		return
+	}
+
+	this.lock.Lock()
+	callback := this.callback
+	close(this.changed)
+	this.changed = make(chan struct{})
+	this.lock.Unlock()
+
+	for _, event := range changes {
+		this.subscriptions.Publish(event)
+		callback(event.Host, event.Alive)
+	}
+}
+
+// apply merges a piece of gossip into the member list, the caller holds the
+// lock. Newer incarnations always win, at the same incarnation suspect beats
+// alive and dead beats both.
+func (this *swimInternal) apply(u update) []checkup.Event {
+	if u.Host == this.config.Self {
+		// refute anything saying we're not alive
+		if u.State != StateAlive && u.Incarnation >= this.incarnation {
+			this.incarnation = u.Incarnation + 1
+			this.queue(update{Host: this.config.Self, State: StateAlive, Incarnation: this.incarnation})
+		}
+		return nil
+	}
+
+	m, found := this.members[u.Host]
+	if !found {
+		return nil
+	}
+
+	switch u.State {
+	case StateAlive:
+		if u.Incarnation <= m.incarnation {
+			return nil
+		}
+	case StateSuspect:
+		if u.Incarnation < m.incarnation || (u.Incarnation == m.incarnation && m.state != StateAlive) {
+			return nil
+		}
+	case StateDead:
+		if u.Incarnation < m.incarnation || m.state == StateDead {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	wasAlive := m.state != StateDead
+	m.state = u.State
+	m.incarnation = u.Incarnation
+	m.changed = time.Now()
+	this.queue(u)
+
+	if u.State != StateAlive {
+		log.Printf("swim: %s is %s\n", u.Host, u.State)
+	}
+
+	isAlive := m.state != StateDead
+	if wasAlive != isAlive {
+		return []checkup.Event{{Host: u.Host, Alive: isAlive, WasAlive: wasAlive, Time: m.changed}}
+	}
+	return nil
+}
+
+// queue schedules gossip to be piggybacked, replacing older gossip about the
+// same member. The caller holds the lock.
+func (this *swimInternal) queue(u update) {
+	transmits := this.config.RetransmitMultiplier * int(math.Ceil(math.Log2(float64(len(this.members)+2))))
+
+	for _, b := range this.broadcasts {
+		if b.update.Host == u.Host {
+			b.update = u
+			b.transmits = transmits
+			return
+		}
+	}
+
+	this.broadcasts = append(this.broadcasts, &broadcast{update: u, transmits: transmits})
+}
+
+// piggyback takes the gossip to send with the next packet, the least sent
+// first. The caller holds the lock.
+func (this *swimInternal) piggyback() []update {
+	sort.SliceStable(this.broadcasts, func(i, j int) bool {
+		return this.broadcasts[i].transmits > this.broadcasts[j].transmits
+	})
+
+	updates := []update{}
+	for _, b := range this.broadcasts {
+		if len(updates) == this.config.MaxPiggyback {
+			break
+		}
+		updates = append(updates, b.update)
+		b.transmits--
+	}
+
+	remaining := this.broadcasts[:0]
+	for _, b := range this.broadcasts {
+		if b.transmits > 0 {
+			remaining = append(remaining, b)
+		}
+	}
+	this.broadcasts = remaining
+
+	return updates
+}
+
+func (this *swimInternal) send(to string, msg message) {
+	this.lock.Lock()
+	msg.From = this.config.Self
+	msg.Incarnation = this.incarnation
+	msg.Updates = this.piggyback()
+	this.lock.Unlock()
+
+	packet, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	if err := this.transport.Send(to, packet); err != nil {
+		log.Printf("swim: couldn't send %s to %s: %s\n", msg.Type, to, err)
+	}
+}
+
+func (this *swimInternal) receiveLoop(closeChannel chan bool) {
+	packets := this.transport.Packets()
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				return
+			}
+			this.handle(packet)
+		case <-closeChannel:
+			return
+		}
+	}
+}
+
+func (this *swimInternal) handle(packet []byte) {
+	var msg message
+	if err := json.Unmarshal(packet, &msg); err != nil {
+		log.Printf("swim: dropping bad packet: %s\n", err)
+		return
+	}
+
+	this.lock.Lock()
+	changes := this.apply(update{Host: msg.From, State: StateAlive, Incarnation: msg.Incarnation})
+
+	// if we still think the sender is down, tell it so it can refute
+	if m, found := this.members[msg.From]; found && m.state != StateAlive {
+		this.queue(update{Host: msg.From, State: m.state, Incarnation: m.incarnation})
+	}
+
+	for _, u := range msg.Updates {
+		changes = append(changes, this.apply(u)...)
+	}
+
+	var ack chan bool
+	if msg.Type == messageAck {
+		ack = this.acks[msg.Seq]
+	}
+	this.lock.Unlock()
+
+	this.notify(changes)
+
+	switch msg.Type {
+	case messagePing:
+		this.send(msg.From, message{Type: messageAck, Seq: msg.Seq})
+	case messageAck:
+		if ack != nil {
+			select {
+			case ack <- true:
+			default:
+			}
+		}
+	case messagePingReq:
+		go this.indirectProbe(msg.From, msg.Seq, msg.Target)
+	}
+}
+
+func (this *swimInternal) expectAck() (uint64, chan bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.seq++
+	ack := make(chan bool, 1)
+	this.acks[this.seq] = ack
+	return this.seq, ack
+}
+
+func (this *swimInternal) forgetAck(seq uint64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.acks, seq)
+}
+
+func (this *swimInternal) timing() (interval, timeout, suspicion time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.config.ProbeInterval, this.config.ProbeTimeout, this.config.SuspicionTimeout
+}
+
+func (this *swimInternal) probeLoop(closeChannel chan bool) {
+	// ping everyone straight away rather than waiting for each to come up
+	// in the round robin
+	this.lock.Lock()
+	hosts := []string{}
+	for host := range this.members {
+		hosts = append(hosts, host)
+	}
+	this.lock.Unlock()
+
+	for _, host := range hosts {
+		this.send(host, message{Type: messagePing})
+	}
+
+	for {
+		interval, _, _ := this.timing()
+
+		select {
+		case <-time.After(interval):
+		case <-closeChannel:
+			return
+		}
+
+		this.expireSuspects()
+
+		if target := this.nextTarget(); target != "" {
+			go this.probe(target)
+		}
+
+		// dead members aren't probed, but one is pinged each round so
+		// members that come back are found even if they don't know about us
+		if dead := this.randomMembers(1, StateDead, ""); len(dead) > 0 {
+			this.send(dead[0], message{Type: messagePing})
+		}
+	}
+}
+
+// probe checks a single member, asking others to try if it doesn't answer
+func (this *swimInternal) probe(target string) {
+	interval, timeout, _ := this.timing()
+
+	seq, ack := this.expectAck()
+	defer this.forgetAck(seq)
+
+	start := time.Now()
+	this.send(target, message{Type: messagePing, Seq: seq})
+
+	// only direct acks are timed, indirect ones include the helper's trip
+	select {
+	case <-ack:
+		this.rtts.Record(target, time.Since(start))
+		return
+	case <-time.After(timeout):
+	}
+
+	for _, helper := range this.randomMembers(this.config.IndirectProbes, StateAlive, target) {
+		this.send(helper, message{Type: messagePingReq, Seq: seq, Target: target})
+	}
+
+	wait := interval - timeout
+	if wait < timeout {
+		wait = timeout
+	}
+
+	select {
+	case <-ack:
+		return
+	case <-time.After(wait):
+	}
+
+	this.lock.Lock()
+	var changes []checkup.Event
+	if m, found := this.members[target]; found && m.state == StateAlive {
+		changes = this.apply(update{Host: target, State: StateSuspect, Incarnation: m.incarnation})
+	}
+	this.lock.Unlock()
+
+	this.notify(changes)
+}
+
+// indirectProbe pings target for requester and passes the ack back
+func (this *swimInternal) indirectProbe(requester string, requesterSeq uint64, target string) {
+	_, timeout, _ := this.timing()
+
+	seq, ack := this.expectAck()
+	defer this.forgetAck(seq)
+
+	this.send(target, message{Type: messagePing, Seq: seq})
+
+	select {
+	case <-ack:
+		this.send(requester, message{Type: messageAck, Seq: requesterSeq})
+	case <-time.After(timeout):
+	}
+}
+
+// expireSuspects declares members dead that stayed suspect too long
+func (this *swimInternal) expireSuspects() {
+	_, _, suspicion := this.timing()
+
+	this.lock.Lock()
+	var changes []checkup.Event
+	for host, m := range this.members {
+		if m.state == StateSuspect && time.Since(m.changed) > suspicion {
+			changes = append(changes, this.apply(update{Host: host, State: StateDead, Incarnation: m.incarnation})...)
+		}
+	}
+	this.lock.Unlock()
+
+	this.notify(changes)
+}
+
+// nextTarget goes round robin through the members that aren't dead in a
+// random order, shuffling again after each round.
+func (this *swimInternal) nextTarget() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for {
+		if len(this.order) == 0 {
+			for host, m := range this.members {
+				if m.state != StateDead {
+					this.order = append(this.order, host)
+				}
+			}
+
+			if len(this.order) == 0 {
+				return ""
+			}
+
+			this.rand.Shuffle(len(this.order), func(i, j int) {
+				this.order[i], this.order[j] = this.order[j], this.order[i]
+			})
+		}
+
+		target := this.order[0]
+		this.order = this.order[1:]
+
+		if m, found := this.members[target]; found && m.state != StateDead {
+			return target
+		}
+	}
+}
+
+// randomMembers picks up to n random members in state, other than exclude
+func (this *swimInternal) randomMembers(n int, state State, exclude string) []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	candidates := []string{}
+	for host, m := range this.members {
+		if m.state == state && host != exclude {
+			candidates = append(candidates, host)
+		}
+	}
+
+	sort.Strings(candidates)
+	this.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
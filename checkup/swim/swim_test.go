@@ -0,0 +1,367 @@
+package swim
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/checkup"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// hub is an in memory network whose links can be cut
+type hub struct {
+	lock    sync.Mutex
+	nodes   map[string]chan []byte
+	cut     map[[2]string]bool
+	stopped map[string]bool
+}
+
+func newHub() *hub {
+	return &hub{nodes: make(map[string]chan []byte), cut: make(map[[2]string]bool), stopped: make(map[string]bool)}
+}
+
+type hubTransport struct {
+	hub     *hub
+	address string
+	packets chan []byte
+}
+
+func (h *hub) transport(address string) Transport {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	packets := make(chan []byte, 256)
+	h.nodes[address] = packets
+	return &hubTransport{hub: h, address: address, packets: packets}
+}
+
+func (h *hub) cutLink(a, b string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.cut[[2]string{a, b}] = true
+	h.cut[[2]string{b, a}] = true
+}
+
+func (h *hub) setStopped(address string, stopped bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.stopped[address] = stopped
+}
+
+func (t *hubTransport) Send(address string, packet []byte) error {
+	t.hub.lock.Lock()
+	defer t.hub.lock.Unlock()
+
+	if t.hub.stopped[t.address] || t.hub.stopped[address] || t.hub.cut[[2]string{t.address, address}] {
+		return nil
+	}
+
+	destination, found := t.hub.nodes[address]
+	if !found {
+		return errors.New("no such host")
+	}
+
+	select {
+	case destination <- packet:
+	default:
+	}
+	return nil
+}
+
+func (t *hubTransport) Packets() <-chan []byte {
+	return t.packets
+}
+
+func (t *hubTransport) Close() error {
+	return nil
+}
+
+func testConfig(self string, hosts []string) Config {
+	config := DefaultConfig(self, hosts)
+	config.ProbeInterval = time.Millisecond * 20
+	config.ProbeTimeout = time.Millisecond * 5
+	config.SuspicionTimeout = time.Millisecond * 100
+	return config
+}
+
+func startCluster(t *testing.T, names []string) (*hub, map[string]checkup.Checkup) {
+	network := newHub()
+	members := make(map[string]checkup.Checkup)
+
+	for _, name := range names {
+		members[name] = New(testConfig(name, names), network.transport(name))
+	}
+
+	for _, member := range members {
+		member.Start()
+	}
+
+	t.Cleanup(func() {
+		for _, member := range members {
+			member.Stop()
+		}
+	})
+
+	return network, members
+}
+
+// waitFor polls condition until it's true or a few seconds pass
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func aliveCount(member checkup.Checkup, host string) bool {
+	for _, alive := range member.GetAliveHosts() {
+		if alive == host {
+			return true
+		}
+	}
+	return false
+}
+
+var names = []string{"a", "b", "c", "d", "e"}
+
+func TestMembersFindEachOther(t *testing.T) {
+	_, members := startCluster(t, names)
+
+	waitFor(t, "every member to be alive everywhere", func() bool {
+		for _, member := range members {
+			if len(member.GetAliveHosts()) != len(names) {
+				return false
+			}
+		}
+		return true
+	})
+
+	waitFor(t, "a to time a probe", func() bool {
+		for _, name := range names[1:] {
+			if _, ok := members["a"].GetRTT(name); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestWaitReady(t *testing.T) {
+	network := newHub()
+	a := New(testConfig("a", names), network.transport("a"))
+	b := New(testConfig("b", names), network.transport("b"))
+
+	// the interval is long so only the pings sent on start can find b
+	a.SetPingInterval(time.Hour)
+	b.SetPingInterval(time.Hour)
+
+	a.Start()
+	defer a.Stop()
+	b.Start()
+	defer b.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := a.WaitReady(ctx, 2); err != nil {
+		t.Fatalf("a never found b: %s", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := a.WaitReady(ctx, 3); err != context.DeadlineExceeded {
+		t.Errorf("expected to time out waiting for a third member, got %v", err)
+	}
+}
+
+func TestFailureDetected(t *testing.T) {
+	network, members := startCluster(t, names)
+
+	var lock sync.Mutex
+	down := []string{}
+	members["a"].SetStateChangeHandler(func(host string, isAlive bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !isAlive {
+			down = append(down, host)
+		}
+	})
+
+	waitFor(t, "every member to be alive", func() bool {
+		return len(members["a"].GetAliveHosts()) == len(names)
+	})
+
+	subscription := members["b"].Subscribe(0)
+	defer members["b"].Unsubscribe(subscription)
+
+	network.setStopped("e", true)
+
+	waitFor(t, "every member to see e as dead", func() bool {
+		for name, member := range members {
+			if name != "e" && aliveCount(member, "e") {
+				return false
+			}
+		}
+		return true
+	})
+
+	lock.Lock()
+	if len(down) != 1 || down[0] != "e" {
+		t.Errorf("expected a single callback for e going down, got %v", down)
+	}
+	lock.Unlock()
+
+	select {
+	case event := <-subscription.Events():
+		if event.Host != "e" || event.Alive || !event.WasAlive {
+			t.Errorf("expected an event for e going down, got %+v", event)
+		}
+	default:
+		t.Error("the subscriber wasn't told e went down")
+	}
+
+	network.setStopped("e", false)
+
+	waitFor(t, "e to come back", func() bool {
+		return aliveCount(members["a"], "e")
+	})
+}
+
+func TestIndirectProbes(t *testing.T) {
+	network, members := startCluster(t, names)
+
+	waitFor(t, "every member to be alive", func() bool {
+		return len(members["a"].GetAliveHosts()) == len(names)
+	})
+
+	// a can't reach b directly, but the others can vouch for it
+	network.cutLink("a", "b")
+	time.Sleep(testConfig("a", nil).SuspicionTimeout * 3)
+
+	if !aliveCount(members["a"], "b") {
+		t.Error("b was declared dead even though others could reach it")
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	member := New(testConfig("a", []string{"b"}), newHub().transport("a")).(*swimInternal)
+	before := member.incarnation
+
+	member.lock.Lock()
+	member.apply(update{Host: "a", State: StateSuspect, Incarnation: before})
+	after := member.incarnation
+	updates := member.piggyback()
+	member.lock.Unlock()
+
+	if after <= before {
+		t.Fatal("the member didn't refute the suspicion")
+	}
+
+	if len(updates) != 1 || updates[0].State != StateAlive || updates[0].Incarnation != after {
+		t.Errorf("expected the refutation to be gossiped, got %+v", updates)
+	}
+}
+
+func TestApplyOrdering(t *testing.T) {
+	var data = []struct {
+		name     string
+		current  member
+		update   update
+		expected State
+	}{
+		{"alive revives a dead member", member{StateDead, 1, time.Time{}}, update{"b", StateAlive, 2}, StateAlive},
+		{"old alive is ignored", member{StateDead, 2, time.Time{}}, update{"b", StateAlive, 2}, StateDead},
+		{"suspect beats alive", member{StateAlive, 2, time.Time{}}, update{"b", StateSuspect, 2}, StateSuspect},
+		{"old suspect is ignored", member{StateAlive, 3, time.Time{}}, update{"b", StateSuspect, 2}, StateAlive},
+		{"alive at the same incarnation doesn't clear suspicion", member{StateSuspect, 2, time.Time{}}, update{"b", StateAlive, 2}, StateSuspect},
+		{"dead beats suspect", member{StateSuspect, 2, time.Time{}}, update{"b", StateDead, 2}, StateDead},
+		{"suspect doesn't revive", member{StateDead, 2, time.Time{}}, update{"b", StateSuspect, 2}, StateDead},
+	}
+
+	for _, tc := range data {
+		s := New(testConfig("a", []string{"b"}), newHub().transport("a")).(*swimInternal)
+		current := tc.current
+		s.members["b"] = &current
+
+		s.apply(tc.update)
+		if s.members["b"].state != tc.expected {
+			t.Errorf("%s: expected %s got %s", tc.name, tc.expected, s.members["b"].state)
+		}
+	}
+}
+
+func TestAddRemoveHost(t *testing.T) {
+	member := New(testConfig("a", []string{"a", "b"}), newHub().transport("a"))
+
+	member.AddHost("c")
+	member.AddHost("a")
+
+	dead := member.GetDeadHosts()
+	sort.Strings(dead)
+	if len(dead) != 2 || dead[0] != "b" || dead[1] != "c" {
+		t.Errorf("expected b and c to start dead, got %v", dead)
+	}
+
+	member.RemoveHost("b")
+	if len(member.GetDeadHosts()) != 1 {
+		t.Errorf("b wasn't removed: %v", member.GetDeadHosts())
+	}
+
+	if len(member.GetAliveHosts()) != 1 || member.GetAliveHosts()[0] != "a" {
+		t.Errorf("expected only ourselves alive, got %v", member.GetAliveHosts())
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	member := New(testConfig("a", nil), newHub().transport("a"))
+
+	if member.Start() != nil || member.Start() != checkup.AlreadyRunningError {
+		t.Error("expected the second start to fail")
+	}
+
+	if member.Stop() != nil || member.Stop() != checkup.AlreadyStoppedError {
+		t.Error("expected the second stop to fail")
+	}
+}
+
+func TestUDPTransport(t *testing.T) {
+	a, err := NewUDPTransport("127.0.0.1:0")
+	if err != nil {
+		t.Skipf("couldn't listen on UDP: %s", err)
+	}
+	defer a.Close()
+
+	b, err := NewUDPTransport("127.0.0.1:0")
+	if err != nil {
+		t.Skipf("couldn't listen on UDP: %s", err)
+	}
+	defer b.Close()
+
+	address := b.(*udpTransport).conn.LocalAddr().String()
+	if err := a.Send(address, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case packet := <-b.Packets():
+		if string(packet) != "hello" {
+			t.Errorf("expected hello got %q", packet)
+		}
+	case <-time.After(time.Second):
+		t.Error("the packet never arrived")
+	}
+}
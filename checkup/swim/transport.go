@@ -0,0 +1,99 @@
+package swim
+
+import (
+	"net"
+	"sync"
+)
+
+// Transport carries SWIM's packets between members. Packets may be lost or
+// reordered, the protocol copes with both.
+type Transport interface {
+	// Send delivers packet to the member at address, best effort
+	Send(address string, packet []byte) error
+	// Packets returns the channel received packets are delivered on, it's
+	// closed when the transport is.
+	Packets() <-chan []byte
+	Close() error
+}
+
+// MaxPacketSize is the largest UDP packet that will be read
+var MaxPacketSize = 64 * 1024
+
+type udpTransport struct {
+	conn    net.PacketConn
+	packets chan []byte
+
+	lock      sync.Mutex
+	addresses map[string]net.Addr
+}
+
+// NewUDPTransport listens for packets on the UDP address, which is usually
+// the same host:port the member is known by.
+func NewUDPTransport(address string) (Transport, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &udpTransport{
+		conn:      conn,
+		packets:   make(chan []byte, 64),
+		addresses: make(map[string]net.Addr),
+	}
+	go transport.receive()
+	return transport, nil
+}
+
+func (this *udpTransport) receive() {
+	defer close(this.packets)
+
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, _, err := this.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		packet := append([]byte{}, buf[:n]...)
+		select {
+		case this.packets <- packet:
+		default:
+			// the member is behind, dropping is no worse than the network
+			// losing it
+		}
+	}
+}
+
+func (this *udpTransport) resolve(address string) (net.Addr, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if addr, found := this.addresses[address]; found {
+		return addr, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	this.addresses[address] = addr
+	return addr, nil
+}
+
+func (this *udpTransport) Send(address string, packet []byte) error {
+	addr, err := this.resolve(address)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.conn.WriteTo(packet, addr)
+	return err
+}
+
+func (this *udpTransport) Packets() <-chan []byte {
+	return this.packets
+}
+
+func (this *udpTransport) Close() error {
+	return this.conn.Close()
+}
@@ -3,6 +3,7 @@ package cohort
 import (
 	"errors"
 	"math/rand"
+	"sync"
 
 	"github.com/josephlewis42/historia/checkup"
 )
@@ -21,14 +22,111 @@ func NewDefaultCohort(thishost int, hosts []string) Cohort {
 
 // Creates a new cohort
 func NewCohort(thishost int, hosts []string, mode RWMode, ckup LivenessChecker) Cohort {
-	c := Cohort{mode: mode, ckup: ckup, thishost: hosts[thishost]}
+	return NewCohortWithSelection(thishost, hosts, mode, ckup, NewRandomSelection())
+}
+
+// NewCohortWithSelection creates a new cohort that uses selection to choose
+// which alive hosts take part in each request, a nil selection picks them at
+// random
+func NewCohortWithSelection(thishost int, hosts []string, mode RWMode, ckup LivenessChecker, selection SelectionStrategy) Cohort {
+	if selection == nil {
+		selection = NewRandomSelection()
+	}
+
+	members := &memberList{hosts: append([]string{}, hosts...), mode: mode, labels: make(map[string]Labels)}
+	c := Cohort{members: members, ckup: ckup, thishost: hosts[thishost], selection: selection}
 	return c
 }
 
+// Cohort picks which hosts take part in each request. Copies of a Cohort
+// share the same member list.
 type Cohort struct {
-	mode     RWMode
-	ckup     LivenessChecker
-	thishost string
+	members   *memberList
+	ckup      LivenessChecker
+	thishost  string
+	selection SelectionStrategy
+	// placement limits the hosts that can be picked, see WithPlacement
+	placement Placement
+}
+
+// memberList is the current membership, the quorum sizes for it and where
+// the hosts are
+type memberList struct {
+	lock    sync.RWMutex
+	hosts   []string
+	mode    RWMode
+	version int
+	labels  map[string]Labels
+	// spread lists the labels sets are spread across, see SpreadAcross
+	spread []string
+}
+
+// mode returns the quorum sizes, with a placement they're sized for the
+// members satisfying it since those are the only ones holding its data
+func (this *Cohort) mode() RWMode {
+	this.members.lock.RLock()
+	defer this.members.lock.RUnlock()
+
+	if len(this.placement) == 0 {
+		return this.members.mode
+	}
+
+	placed := 0
+	for _, host := range this.members.hosts {
+		if this.placement.Allows(this.members.labels[host]) {
+			placed++
+		}
+	}
+	return this.members.mode.Resize(placed)
+}
+
+// Members returns the hosts currently in the cluster
+func (this *Cohort) Members() []string {
+	this.members.lock.RLock()
+	defer this.members.lock.RUnlock()
+	return append([]string{}, this.members.hosts...)
+}
+
+// SetMembers replaces the member list and resizes the quorums to match. If the
+// liveness checker is a HostTracker it's told about added and removed hosts.
+// Members are normally changed with ChangeMembers so the whole cluster agrees.
+func (this *Cohort) SetMembers(hosts []string) {
+	this.members.lock.Lock()
+	old := this.members.hosts
+	this.members.hosts = append([]string{}, hosts...)
+	this.members.mode = this.members.mode.Resize(len(hosts))
+	this.members.lock.Unlock()
+
+	tracker, ok := this.ckup.(HostTracker)
+	if !ok {
+		return
+	}
+
+	for _, host := range hosts {
+		if !contains(old, host) {
+			tracker.AddHost(host)
+		}
+	}
+
+	for _, host := range old {
+		if !contains(hosts, host) {
+			tracker.RemoveHost(host)
+		}
+	}
+}
+
+func contains(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Self returns this node's host
+func (this *Cohort) Self() string {
+	return this.thishost
 }
 
 func (this *Cohort) GetAliveSet() []string {
@@ -36,39 +134,48 @@ func (this *Cohort) GetAliveSet() []string {
 }
 
 func (this *Cohort) GetCreateSet() ([]string, error) {
-	numRequired := this.mode.NodesNeededToCreate()
+	numRequired := this.mode().NodesNeededToCreate()
 	return this.getNodes(numRequired)
 }
 
 func (this *Cohort) GetReadSet() ([]string, error) {
-	numRequired := this.mode.NodesNeededToRead()
+	numRequired := this.mode().NodesNeededToRead()
 	return this.getNodes(numRequired)
 }
 
 func (this *Cohort) GetUpdateSet() ([]string, error) {
-	numRequired := this.mode.NodesNeededToUpdate()
+	numRequired := this.mode().NodesNeededToUpdate()
 	return this.getNodes(numRequired)
 }
 
 func (this *Cohort) GetDeleteSet() ([]string, error) {
-	numRequired := this.mode.NodesNeededToDelete()
+	numRequired := this.mode().NodesNeededToDelete()
 	return this.getNodes(numRequired)
 }
 
 func (this *Cohort) getNodes(num int) (nodes []string, err error) {
-	if num == 1 {
+	if num == 1 && len(this.eligible([]string{this.thishost})) == 1 {
 		return []string{this.thishost}, nil
 	}
 
-	alive := this.ckup.GetAliveHosts()
+	alive := this.aliveMembers()
 
 	if len(alive) < num {
 		return nil, NotEnoughHostsError
 	}
 
-	permute(alive) // we shuffle so we don't keep hitting the same hosts over and over
+	alive = this.eligible(alive)
+	if len(alive) < num {
+		return nil, NoEligibleHostsError
+	}
 
-	alive = alive[:num] // get just the hosts we need
+	if this.spreading() {
+		// the strategy ranks every host and the best of each domain is
+		// taken in turn
+		alive = this.spread(this.selection.Select(alive, len(alive)))[:num]
+	} else {
+		alive = this.selection.Select(alive, num)
+	}
 
 	// TODO make sure we're in the list for speed purposes
 	/**for _, value := range alive {
@@ -81,6 +188,26 @@ func (this *Cohort) getNodes(num int) (nodes []string, err error) {
 	return alive[:num], nil
 }
 
+func (this *Cohort) spreading() bool {
+	this.members.lock.RLock()
+	defer this.members.lock.RUnlock()
+	return len(this.members.spread) > 0
+}
+
+// aliveMembers returns the alive hosts that are still members, a liveness
+// checker may lag behind membership changes.
+func (this *Cohort) aliveMembers() []string {
+	members := this.Members()
+
+	alive := []string{}
+	for _, host := range this.ckup.GetAliveHosts() {
+		if contains(members, host) {
+			alive = append(alive, host)
+		}
+	}
+	return alive
+}
+
 // permutes an array
 func permute(hosts []string) {
 	// http://stackoverflow.com/a/12267471
@@ -6,3 +6,10 @@ type LivenessChecker interface {
 	// GetAliveHosts returns a list of hosts that are currently reachable
 	GetAliveHosts() []string
 }
+
+// HostTracker is implemented by liveness checkers that can start and stop
+// watching hosts as the membership changes, checkup.Checkup is one.
+type HostTracker interface {
+	AddHost(host string)
+	RemoveHost(host string)
+}
@@ -0,0 +1,222 @@
+package cohort
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	// MembershipKey is the key membership changes are committed under, it's
+	// handled by the storage returned from NewMembershipStorage and never
+	// reaches the underlying store.
+	MembershipKey = []byte("historia/membership")
+
+	MembershipVersionError  = errors.New("The membership change is older than the current membership")
+	MembershipPendingError  = errors.New("Another membership change is already in progress")
+	EmptyMembershipError    = errors.New("A cluster needs at least one member")
+	MembershipRejectedError = errors.New("The cluster didn't commit the membership change")
+	MemberExistsError       = errors.New("The host is already a member")
+	NotAMemberError         = errors.New("The host isn't a member")
+)
+
+// Membership is a numbered version of the member list, each change commits a
+// newer version.
+type Membership struct {
+	Version int
+	Hosts   []string
+}
+
+// Membership returns the current member list and its version
+func (this *Cohort) Membership() Membership {
+	this.members.lock.RLock()
+	defer this.members.lock.RUnlock()
+	return Membership{Version: this.members.version, Hosts: append([]string{}, this.members.hosts...)}
+}
+
+// adopt switches to membership if it's newer than the current one
+func (this *Cohort) adopt(membership Membership) bool {
+	this.members.lock.Lock()
+	if membership.Version <= this.members.version {
+		this.members.lock.Unlock()
+		return false
+	}
+	this.members.version = membership.Version
+	this.members.lock.Unlock()
+
+	log.Printf("Cohort: membership version %d is %v\n", membership.Version, membership.Hosts)
+	this.SetMembers(membership.Hosts)
+	return true
+}
+
+// ChangeMembers commits a new member list to every alive member through tpc.
+// A majority of the current members has to be alive. Hosts that are added
+// should be started with the new list or call SyncMembers.
+func (this *Cohort) ChangeMembers(tpc threephase.ThreePhaseCommit, hosts []string) error {
+	if len(hosts) == 0 {
+		return EmptyMembershipError
+	}
+
+	current := this.Membership()
+	nodes := this.aliveMembers()
+	if len(nodes) < majority(len(current.Hosts)) {
+		return NotEnoughHostsError
+	}
+
+	data, err := json.Marshal(Membership{Version: current.Version + 1, Hosts: hosts})
+	if err != nil {
+		return err
+	}
+
+	if !tpc.CommitOperation(tpc.NewTransactionID(), storage.OpUpdate, MembershipKey, data, nodes) {
+		return MembershipRejectedError
+	}
+
+	return nil
+}
+
+// AddMember commits a membership with host added
+func (this *Cohort) AddMember(tpc threephase.ThreePhaseCommit, host string) error {
+	hosts := this.Members()
+	if contains(hosts, host) {
+		return MemberExistsError
+	}
+
+	return this.ChangeMembers(tpc, append(hosts, host))
+}
+
+// RemoveMember commits a membership without host
+func (this *Cohort) RemoveMember(tpc threephase.ThreePhaseCommit, host string) error {
+	hosts := []string{}
+	for _, member := range this.Members() {
+		if member != host {
+			hosts = append(hosts, member)
+		}
+	}
+
+	if len(hosts) == len(this.Members()) {
+		return NotAMemberError
+	}
+
+	return this.ChangeMembers(tpc, hosts)
+}
+
+// SyncMembers reads the membership from every alive member and adopts the
+// newest, it's how a node that was down or just added catches up.
+func (this *Cohort) SyncMembers(comm threephase.CommunicationHandler) error {
+	var lastErr error
+	for _, host := range this.aliveMembers() {
+		if host == this.thishost {
+			continue
+		}
+
+		data, err := comm.ReadData(MembershipKey, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var membership Membership
+		if err := json.Unmarshal(data, &membership); err != nil {
+			lastErr = err
+			continue
+		}
+
+		this.adopt(membership)
+	}
+
+	return lastErr
+}
+
+// membershipStorage intercepts transactions on MembershipKey and applies them
+// to a Cohort when they commit, everything else goes to the wrapped store.
+type membershipStorage struct {
+	storage.Storage
+	cohort *Cohort
+
+	lock    sync.Mutex
+	pending map[string]Membership
+}
+
+// NewMembershipStorage wraps inner so membership changes committed with
+// ChangeMembers are applied to c.
+func NewMembershipStorage(inner storage.Storage, c *Cohort) storage.Storage {
+	return &membershipStorage{Storage: inner, cohort: c, pending: make(map[string]Membership)}
+}
+
+func (this *membershipStorage) Read(key []byte) (value []byte, ok bool) {
+	if !bytes.Equal(key, MembershipKey) {
+		return this.Storage.Read(key)
+	}
+
+	data, err := json.Marshal(this.cohort.Membership())
+	return data, err == nil
+}
+
+func (this *membershipStorage) PrepareOperation(transactionID []byte, op storage.Operation, key, value []byte) error {
+	if !bytes.Equal(key, MembershipKey) {
+		return this.Storage.PrepareOperation(transactionID, op, key, value)
+	}
+
+	if op != storage.OpUpdate {
+		return storage.UnknownOperationError
+	}
+
+	var membership Membership
+	if err := json.Unmarshal(value, &membership); err != nil {
+		return err
+	}
+
+	if len(membership.Hosts) == 0 {
+		return EmptyMembershipError
+	}
+
+	if membership.Version <= this.cohort.Membership().Version {
+		return MembershipVersionError
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, found := this.pending[string(transactionID)]; found {
+		return storage.TransactionExistsError
+	}
+
+	if len(this.pending) > 0 {
+		return MembershipPendingError
+	}
+
+	this.pending[string(transactionID)] = membership
+	return nil
+}
+
+func (this *membershipStorage) Commit(transactionID []byte) error {
+	this.lock.Lock()
+	membership, found := this.pending[string(transactionID)]
+	delete(this.pending, string(transactionID))
+	this.lock.Unlock()
+
+	if !found {
+		return this.Storage.Commit(transactionID)
+	}
+
+	this.cohort.adopt(membership)
+	return nil
+}
+
+func (this *membershipStorage) Abort(transactionID []byte) bool {
+	this.lock.Lock()
+	_, found := this.pending[string(transactionID)]
+	delete(this.pending, string(transactionID))
+	this.lock.Unlock()
+
+	if !found {
+		return this.Storage.Abort(transactionID)
+	}
+	return true
+}
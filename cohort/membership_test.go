@@ -0,0 +1,193 @@
+package cohort
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+	"github.com/josephlewis42/historia/transport/chantransport"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+type memberNode struct {
+	cohort *Cohort
+	tpc    threephase.ThreePhaseCommit
+}
+
+// newMemberCluster registers a node for each name in all, each starts with
+// the members it's given.
+func newMemberCluster(t *testing.T, all []string, members map[string][]string) (*chantransport.Network, map[string]*memberNode) {
+	network := chantransport.NewNetwork()
+	nodes := make(map[string]*memberNode)
+
+	for _, name := range all {
+		hosts := members[name]
+		index := 0
+		for i, host := range hosts {
+			if host == name {
+				index = i
+			}
+		}
+
+		c := NewCohort(index, hosts, NewReadMajorityWriteMajority(len(hosts)), network)
+		db := NewMembershipStorage(storage.NewInMemoryStorage(), &c)
+		tpc := threephase.NewThreePhaseCommit(network.Handler(name), db, &c)
+		network.Register(name, tpc, db)
+
+		nodes[name] = &memberNode{cohort: &c, tpc: tpc}
+	}
+
+	t.Cleanup(func() {
+		network.Close()
+		for _, node := range nodes {
+			node.tpc.Close()
+		}
+	})
+
+	return network, nodes
+}
+
+func sorted(hosts []string) []string {
+	hosts = append([]string{}, hosts...)
+	sort.Strings(hosts)
+	return hosts
+}
+
+func TestChangeMembers(t *testing.T) {
+	initial := []string{"a", "b", "c"}
+	network, nodes := newMemberCluster(t, []string{"a", "b", "c", "d"}, map[string][]string{
+		"a": initial,
+		"b": initial,
+		"c": initial,
+		"d": {"a", "b", "c", "d"},
+	})
+
+	if err := nodes["a"].cohort.AddMember(nodes["a"].tpc, "d"); err != nil {
+		t.Fatalf("couldn't add d: %s", err)
+	}
+
+	for _, name := range initial {
+		membership := nodes[name].cohort.Membership()
+		if membership.Version != 1 || !reflect.DeepEqual(sorted(membership.Hosts), []string{"a", "b", "c", "d"}) {
+			t.Errorf("%s: expected version 1 with d added, got %+v", name, membership)
+		}
+
+		if nodes[name].cohort.mode().NodesNeededToCreate() != 3 {
+			t.Errorf("%s: the quorum wasn't resized", name)
+		}
+	}
+
+	if err := nodes["d"].cohort.SyncMembers(network.Handler("d")); err != nil {
+		t.Fatalf("d couldn't sync: %s", err)
+	}
+	if nodes["d"].cohort.Membership().Version != 1 {
+		t.Errorf("d didn't catch up, got %+v", nodes["d"].cohort.Membership())
+	}
+
+	if nodes["a"].cohort.AddMember(nodes["a"].tpc, "d") != MemberExistsError {
+		t.Error("added d twice")
+	}
+
+	network.Stop("c")
+	if err := nodes["d"].cohort.RemoveMember(nodes["d"].tpc, "c"); err != nil {
+		t.Fatalf("couldn't remove the stopped node: %s", err)
+	}
+
+	for _, name := range []string{"a", "b", "d"} {
+		if !reflect.DeepEqual(sorted(nodes[name].cohort.Members()), []string{"a", "b", "d"}) {
+			t.Errorf("%s: expected c removed, got %v", name, nodes[name].cohort.Members())
+		}
+	}
+
+	if nodes["a"].cohort.RemoveMember(nodes["a"].tpc, "c") != NotAMemberError {
+		t.Error("removed c twice")
+	}
+
+	network.Stop("b")
+	network.Stop("d")
+	if nodes["a"].cohort.RemoveMember(nodes["a"].tpc, "b") != NotEnoughHostsError {
+		t.Error("changed the membership without a majority")
+	}
+}
+
+func TestMembershipStorage(t *testing.T) {
+	c := NewCohort(0, []string{"a"}, NewReadMajorityWriteMajority(1), &fakeLiveness{[]string{"a"}})
+	db := NewMembershipStorage(storage.NewInMemoryStorage(), &c)
+
+	encode := func(version int, hosts ...string) []byte {
+		data, _ := json.Marshal(Membership{Version: version, Hosts: hosts})
+		return data
+	}
+
+	var data = []struct {
+		name     string
+		op       storage.Operation
+		value    []byte
+		expected error
+	}{
+		{"stale", storage.OpUpdate, encode(0, "a", "b"), MembershipVersionError},
+		{"empty", storage.OpUpdate, encode(1), EmptyMembershipError},
+		{"create", storage.OpCreate, encode(1, "a", "b"), storage.UnknownOperationError},
+		{"valid", storage.OpUpdate, encode(1, "a", "b"), nil},
+		{"concurrent", storage.OpUpdate, encode(2, "a", "c"), MembershipPendingError},
+	}
+
+	for i, tc := range data {
+		err := db.PrepareOperation([]byte{byte(i)}, tc.op, MembershipKey, tc.value)
+		if err != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, err)
+		}
+	}
+
+	db.Commit([]byte{3})
+	if !reflect.DeepEqual(c.Members(), []string{"a", "b"}) {
+		t.Errorf("the committed membership wasn't applied, got %v", c.Members())
+	}
+
+	value, ok := db.Read(MembershipKey)
+	if !ok || string(value) != string(encode(1, "a", "b")) {
+		t.Errorf("expected the membership to be readable, got %s", value)
+	}
+
+	if _, ok := db.Read([]byte{3}); ok {
+		t.Error("the membership change reached the wrapped store")
+	}
+}
+
+type fakeTracker struct {
+	fakeLiveness
+	added   []string
+	removed []string
+}
+
+func (this *fakeTracker) AddHost(host string)    { this.added = append(this.added, host) }
+func (this *fakeTracker) RemoveHost(host string) { this.removed = append(this.removed, host) }
+
+func TestSetMembersTracksHosts(t *testing.T) {
+	tracker := &fakeTracker{fakeLiveness: fakeLiveness{[]string{"a", "b", "c", "d"}}}
+	c := NewCohort(0, []string{"a", "b", "c"}, NewReadOneWriteAll(3), tracker)
+
+	c.SetMembers([]string{"a", "c", "d"})
+
+	if !reflect.DeepEqual(tracker.added, []string{"d"}) || !reflect.DeepEqual(tracker.removed, []string{"b"}) {
+		t.Errorf("expected d added and b removed, got %v %v", tracker.added, tracker.removed)
+	}
+
+	if !reflect.DeepEqual(sorted(c.aliveMembers()), []string{"a", "c", "d"}) {
+		t.Errorf("alive hosts that aren't members were used: %v", c.aliveMembers())
+	}
+
+	if c.mode().NodesNeededToCreate() != 3 {
+		t.Error("the quorum wasn't resized")
+	}
+}
@@ -0,0 +1,101 @@
+package cohort
+
+import (
+	"errors"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+// Labels commonly given to hosts
+const (
+	LabelRegion = "region"
+	LabelZone   = "zone"
+	LabelRack   = "rack"
+)
+
+var (
+	NoEligibleHostsError = errors.New("There are not enough alive hosts satisfying the placement constraints.")
+)
+
+// Labels, Constraint and Placement live in threephase so transactions can
+// carry their placement to the participants.
+type (
+	Labels     = threephase.Labels
+	Constraint = threephase.Constraint
+	Placement  = threephase.Placement
+)
+
+// In requires label to be one of values
+func In(label string, values ...string) Constraint {
+	return Constraint{Label: label, Values: values}
+}
+
+// NotIn requires label to be set to something other than values
+func NotIn(label string, values ...string) Constraint {
+	return Constraint{Label: label, Values: values, Exclude: true}
+}
+
+// SetLabels replaces the labels of host
+func (this *Cohort) SetLabels(host string, labels Labels) {
+	copied := make(Labels)
+	for key, value := range labels {
+		copied[key] = value
+	}
+
+	this.members.lock.Lock()
+	defer this.members.lock.Unlock()
+	this.members.labels[host] = copied
+}
+
+// Labels returns the labels of host
+func (this *Cohort) Labels(host string) Labels {
+	this.members.lock.RLock()
+	defer this.members.lock.RUnlock()
+
+	copied := make(Labels)
+	for key, value := range this.members.labels[host] {
+		copied[key] = value
+	}
+	return copied
+}
+
+// SelfLabels returns the labels of this node, participants check a
+// transaction's placement against them
+func (this *Cohort) SelfLabels() Labels {
+	return this.Labels(this.thishost)
+}
+
+// WithPlacement returns a copy of the cohort whose sets only contain hosts
+// satisfying placement, it shares the members and labels with the original.
+// ThreePhaseCommit.WithPlacement uses it to pick the nodes for transactions
+// that have to stay in certain places:
+//
+//	tpc.WithPlacement(Placement{In(LabelRegion, "eu-west")}).Update(key, value)
+func (this *Cohort) WithPlacement(placement Placement) *Cohort {
+	placed := *this
+	placed.placement = append(Placement{}, placement...)
+	return &placed
+}
+
+// PlacedSet is WithPlacement as a threephase.NodeSet
+func (this *Cohort) PlacedSet(placement Placement) threephase.NodeSet {
+	return this.WithPlacement(placement)
+}
+
+// eligible filters hosts down to the ones satisfying the cohort's placement
+func (this *Cohort) eligible(hosts []string) []string {
+	if len(this.placement) == 0 {
+		return hosts
+	}
+
+	this.members.lock.RLock()
+	defer this.members.lock.RUnlock()
+
+	eligible := []string{}
+	for _, host := range hosts {
+		if this.placement.Allows(this.members.labels[host]) {
+			eligible = append(eligible, host)
+		}
+	}
+	return eligible
+}
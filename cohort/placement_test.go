@@ -0,0 +1,113 @@
+package cohort
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestPlacementAllows(t *testing.T) {
+	eu := Labels{LabelRegion: "eu-west", LabelZone: "a"}
+	us := Labels{LabelRegion: "us-east", LabelZone: "a"}
+	unlabeled := Labels{}
+
+	var data = []struct {
+		name      string
+		placement Placement
+		labels    Labels
+		expected  bool
+	}{
+		{"no constraints", Placement{}, unlabeled, true},
+		{"in", Placement{In(LabelRegion, "eu-west", "eu-central")}, eu, true},
+		{"not in", Placement{In(LabelRegion, "eu-west", "eu-central")}, us, false},
+		{"excluded", Placement{NotIn(LabelRegion, "us-east")}, us, false},
+		{"not excluded", Placement{NotIn(LabelRegion, "us-east")}, eu, true},
+		{"unlabeled in", Placement{In(LabelRegion, "eu-west")}, unlabeled, false},
+		{"unlabeled not in", Placement{NotIn(LabelRegion, "us-east")}, unlabeled, false},
+		{"all must pass", Placement{In(LabelRegion, "eu-west"), In(LabelZone, "b")}, eu, false},
+	}
+
+	for _, tc := range data {
+		if result := tc.placement.Allows(tc.labels); result != tc.expected {
+			t.Errorf("%s: expected %t got %t", tc.name, tc.expected, result)
+		}
+	}
+}
+
+func newLabeledCohort(alive []string) *Cohort {
+	hosts := []string{"eu1", "eu2", "eu3", "us1", "us2"}
+	c := NewCohort(3, hosts, NewReadMajorityWriteMajority(len(hosts)), &fakeLiveness{alive})
+
+	for _, host := range hosts {
+		c.SetLabels(host, Labels{LabelRegion: host[:2]})
+	}
+	return &c
+}
+
+func TestWithPlacement(t *testing.T) {
+	c := newLabeledCohort([]string{"eu1", "eu2", "eu3", "us1", "us2"})
+	eu := c.WithPlacement(Placement{In(LabelRegion, "eu")})
+
+	nodes, err := eu.GetCreateSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a majority of the three eu hosts
+	if len(nodes) != 2 || nodes[0][:2] != "eu" || nodes[1][:2] != "eu" {
+		t.Errorf("expected two eu hosts, got %v", nodes)
+	}
+
+	// we're in the US so a single node read has to go elsewhere
+	eu.members.mode = NewReadOneWriteAll(5)
+	nodes, err = eu.GetReadSet()
+	if err != nil || len(nodes) != 1 || nodes[0][:2] != "eu" {
+		t.Errorf("expected a single eu host, got %v %v", nodes, err)
+	}
+
+	// the original isn't constrained
+	if len(c.placement) != 0 {
+		t.Error("WithPlacement changed the original cohort")
+	}
+}
+
+func TestNoEligibleHosts(t *testing.T) {
+	c := newLabeledCohort([]string{"eu1", "us1", "us2"})
+	eu := c.WithPlacement(Placement{In(LabelRegion, "eu")})
+
+	if _, err := eu.GetCreateSet(); err != NoEligibleHostsError {
+		t.Errorf("expected NoEligibleHostsError got %v", err)
+	}
+
+	if _, err := c.GetCreateSet(); err != nil {
+		t.Errorf("without constraints there are enough hosts: %v", err)
+	}
+
+	c = newLabeledCohort([]string{"eu1"})
+	if _, err := c.WithPlacement(Placement{In(LabelRegion, "eu")}).GetCreateSet(); err != NotEnoughHostsError {
+		t.Errorf("expected NotEnoughHostsError when too few hosts are alive at all, got %v", err)
+	}
+}
+
+func TestLabelsAreCopied(t *testing.T) {
+	c := newLabeledCohort(nil)
+	labels := c.Labels("eu1")
+	labels[LabelRegion] = "us"
+
+	if c.Labels("eu1")[LabelRegion] != "eu" {
+		t.Error("changing the returned labels changed the cohort")
+	}
+}
+
+func TestPlacedSet(t *testing.T) {
+	c := newLabeledCohort([]string{"eu1", "eu2", "eu3", "us1", "us2"})
+
+	if labels := c.SelfLabels(); labels[LabelRegion] != "us" {
+		t.Errorf("expected us1 to be in the us, got %v", labels)
+	}
+
+	nodes, err := c.PlacedSet(Placement{In(LabelRegion, "eu")}).GetUpdateSet()
+	sort.Strings(nodes)
+	if err != nil || len(nodes) != 3 || nodes[0] != "eu1" || nodes[2] != "eu3" {
+		t.Errorf("expected the update set to only have eu hosts, got %v %v", nodes, err)
+	}
+}
@@ -13,6 +13,9 @@ type RWMode interface {
 	NodesNeededToUpdate() int
 	NodesNeededToDelete() int
 	NodesNeededToRead() int
+
+	// Resize returns the same mode for a cluster of a different size
+	Resize(numberOfNodes int) RWMode
 }
 
 func NewReadOneWriteAll(numberOfNodes int) RWMode {
@@ -39,6 +42,10 @@ func (r readOneWriteAll) NodesNeededToDelete() int {
 	return r.numberOfNodes
 }
 
+func (r readOneWriteAll) Resize(numberOfNodes int) RWMode {
+	return NewReadOneWriteAll(numberOfNodes)
+}
+
 func NewReadMajorityWriteMajority(numberOfNodes int) RWMode {
 	return rmwm{numberOfNodes}
 }
@@ -62,3 +69,7 @@ func (r rmwm) NodesNeededToUpdate() int {
 func (r rmwm) NodesNeededToDelete() int {
 	return r.numberOfNodes
 }
+
+func (r rmwm) Resize(numberOfNodes int) RWMode {
+	return NewReadMajorityWriteMajority(numberOfNodes)
+}
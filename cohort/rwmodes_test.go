@@ -69,3 +69,23 @@ func TestRMWM(t *testing.T) {
 		}
 	}
 }
+
+func TestResize(t *testing.T) {
+	var data = []struct {
+		mode     RWMode
+		size     int
+		expected int
+	}{
+		{NewReadOneWriteAll(3), 5, 5},
+		{NewReadOneWriteAll(5), 2, 2},
+		{NewReadMajorityWriteMajority(3), 5, 3},
+		{NewReadMajorityWriteMajority(5), 7, 4},
+	}
+
+	for _, tc := range data {
+		resized := tc.mode.Resize(tc.size)
+		if resized.NodesNeededToCreate() != tc.expected {
+			t.Errorf("expected %d nodes needed to create after resizing to %d, got %d", tc.expected, tc.size, resized.NodesNeededToCreate())
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package cohort
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/josephlewis42/historia/checkup"
+)
+
+// SelectionStrategy decides which of the alive hosts take part in a request
+type SelectionStrategy interface {
+	// Select returns num hosts from alive, which has at least num hosts in
+	// it. alive is a copy and can be changed.
+	Select(alive []string, num int) []string
+}
+
+// SelectionFunc lets an ordinary function act as a SelectionStrategy
+type SelectionFunc func(alive []string, num int) []string
+
+func (f SelectionFunc) Select(alive []string, num int) []string {
+	return f(alive, num)
+}
+
+// NewRandomSelection picks hosts at random so requests are spread out, it's
+// what a Cohort uses unless it's given another strategy.
+func NewRandomSelection() SelectionStrategy {
+	return SelectionFunc(func(alive []string, num int) []string {
+		permute(alive)
+		return alive[:num]
+	})
+}
+
+// RTTSource reports round trip times to hosts, checkup.Checkup is one
+type RTTSource interface {
+	GetRTT(host string) (stats checkup.RTTStats, ok bool)
+}
+
+// NewLatencySelection picks the hosts with the lowest average round trip
+// time. Hosts that haven't been timed yet come last.
+func NewLatencySelection(rtts RTTSource) SelectionStrategy {
+	return SelectionFunc(func(alive []string, num int) []string {
+		latency := make(map[string]time.Duration)
+		for _, host := range alive {
+			latency[host] = time.Duration(math.MaxInt64)
+			if stats, ok := rtts.GetRTT(host); ok {
+				latency[host] = stats.EWMA
+			}
+		}
+
+		// shuffling first spreads requests over hosts that are as fast
+		permute(alive)
+		sort.SliceStable(alive, func(i, j int) bool {
+			return latency[alive[i]] < latency[alive[j]]
+		})
+		return alive[:num]
+	})
+}
+
+// FailureMemory is how long NewLeastRecentlyFailedSelection holds a failure
+// against a host, after that it ranks with hosts that never went down.
+var FailureMemory = 24 * time.Hour
+
+// FailureSource is something that reports hosts going up and down,
+// checkup.Checkup is one.
+type FailureSource interface {
+	Subscribe(buffer int) *checkup.Subscription
+	Unsubscribe(subscription *checkup.Subscription)
+}
+
+// ClosableSelection is a SelectionStrategy that watches something in the
+// background until it's closed
+type ClosableSelection interface {
+	SelectionStrategy
+	Close() error
+}
+
+type failureSelection struct {
+	source       FailureSource
+	subscription *checkup.Subscription
+	now          func() time.Time
+
+	lock   sync.Mutex
+	failed map[string]time.Time
+}
+
+// NewLeastRecentlyFailedSelection picks the hosts that went down longest ago,
+// hosts that have never gone down, or not within FailureMemory, come first.
+// It watches source until it's closed.
+func NewLeastRecentlyFailedSelection(source FailureSource) ClosableSelection {
+	selection := &failureSelection{
+		source:       source,
+		subscription: source.Subscribe(0),
+		now:          time.Now,
+		failed:       make(map[string]time.Time),
+	}
+
+	go func() {
+		for event := range selection.subscription.Events() {
+			if event.WasAlive && !event.Alive {
+				selection.lock.Lock()
+				selection.failed[event.Host] = event.Time
+				selection.lock.Unlock()
+			}
+		}
+	}()
+
+	return selection
+}
+
+func (this *failureSelection) Select(alive []string, num int) []string {
+	forgotten := this.now().Add(-FailureMemory)
+
+	this.lock.Lock()
+	failed := make(map[string]time.Time)
+	for _, host := range alive {
+		if when := this.failed[host]; when.Before(forgotten) {
+			delete(this.failed, host)
+		} else {
+			failed[host] = when
+		}
+	}
+	this.lock.Unlock()
+
+	permute(alive)
+	sort.SliceStable(alive, func(i, j int) bool {
+		return failed[alive[i]].Before(failed[alive[j]])
+	})
+	return alive[:num]
+}
+
+// Close stops watching the source
+func (this *failureSelection) Close() error {
+	this.source.Unsubscribe(this.subscription)
+	return nil
+}
+
+// NewWeightedSelection picks hosts at random in proportion to their capacity,
+// so a host with twice the capacity of another is picked about twice as
+// often. Hosts missing from capacity have a capacity of 1.
+func NewWeightedSelection(capacity map[string]float64) SelectionStrategy {
+	weights := make(map[string]float64)
+	for host, weight := range capacity {
+		weights[host] = weight
+	}
+
+	return SelectionFunc(func(alive []string, num int) []string {
+		// each host gets a key of u^(1/weight) and the largest keys win,
+		// which samples without replacement in proportion to the weights
+		keys := make(map[string]float64)
+		for _, host := range alive {
+			weight, found := weights[host]
+			if !found {
+				weight = 1
+			}
+
+			if weight <= 0 {
+				keys[host] = -1
+			} else {
+				keys[host] = math.Pow(rand.Float64(), 1/weight)
+			}
+		}
+
+		sort.Slice(alive, func(i, j int) bool {
+			return keys[alive[i]] > keys[alive[j]]
+		})
+		return alive[:num]
+	})
+}
@@ -0,0 +1,171 @@
+package cohort
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/checkup"
+)
+
+type fakeRTTs map[string]time.Duration
+
+func (this fakeRTTs) GetRTT(host string) (checkup.RTTStats, bool) {
+	rtt, found := this[host]
+	return checkup.RTTStats{EWMA: rtt}, found
+}
+
+func TestLatencySelection(t *testing.T) {
+	rtts := fakeRTTs{"a": 30 * time.Millisecond, "b": 10 * time.Millisecond, "c": 20 * time.Millisecond}
+	selection := NewLatencySelection(rtts)
+
+	var data = []struct {
+		num      int
+		expected []string
+	}{
+		{1, []string{"b"}},
+		{2, []string{"b", "c"}},
+		{3, []string{"b", "c", "a"}},
+		{4, []string{"b", "c", "a", "d"}},
+	}
+
+	for _, tc := range data {
+		result := selection.Select([]string{"a", "b", "c", "d"}, tc.num)
+		if !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("%d: expected %v got %v", tc.num, tc.expected, result)
+		}
+	}
+}
+
+// recordingSource hands out a subscription it can publish to
+type recordingSource struct {
+	checkup.Subscriptions
+}
+
+func TestLeastRecentlyFailedSelection(t *testing.T) {
+	selection := NewLeastRecentlyFailedSelection(&recordingSource{}).(*failureSelection)
+	defer selection.Close()
+
+	now := time.Now()
+	selection.now = func() time.Time { return now }
+	selection.failed["a"] = now
+	selection.failed["b"] = now.Add(-time.Hour)
+	selection.failed["d"] = now.Add(-FailureMemory - time.Hour)
+
+	var data = []struct {
+		num      int
+		expected []string
+	}{
+		{2, []string{"c", "d"}},
+		{3, []string{"c", "d", "b"}},
+		{4, []string{"c", "d", "b", "a"}},
+	}
+
+	for _, tc := range data {
+		result := selection.Select([]string{"a", "b", "c", "d"}, tc.num)
+		sort.Strings(result[:2])
+		if !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("%d: expected %v got %v", tc.num, tc.expected, result)
+		}
+	}
+
+	if _, found := selection.failed["d"]; found {
+		t.Error("a failure older than FailureMemory wasn't forgotten")
+	}
+}
+
+func TestLeastRecentlyFailedClose(t *testing.T) {
+	var source recordingSource
+	selection := NewLeastRecentlyFailedSelection(&source).(*failureSelection)
+	selection.Close()
+
+	select {
+	case _, open := <-selection.subscription.Events():
+		if open {
+			t.Error("got an event after closing")
+		}
+	case <-time.After(time.Second):
+		t.Error("closing didn't unsubscribe")
+	}
+
+	source.Publish(checkup.Event{Host: "a", Alive: false, WasAlive: true, Time: time.Now()})
+	selection.Close()
+}
+
+func TestLeastRecentlyFailedWatchesSource(t *testing.T) {
+	var source recordingSource
+	selection := NewLeastRecentlyFailedSelection(&source).(*failureSelection)
+	defer selection.Close()
+
+	source.Publish(checkup.Event{Host: "a", Alive: true, WasAlive: false, Time: time.Now()})
+	source.Publish(checkup.Event{Host: "b", Alive: false, WasAlive: true, Time: time.Now()})
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		selection.lock.Lock()
+		_, aFailed := selection.failed["a"]
+		_, bFailed := selection.failed["b"]
+		selection.lock.Unlock()
+
+		if aFailed {
+			t.Fatal("a host coming up was counted as a failure")
+		}
+		if bFailed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Error("the failure was never recorded")
+}
+
+func TestWeightedSelection(t *testing.T) {
+	selection := NewWeightedSelection(map[string]float64{"a": 8, "b": 1, "c": 0})
+	counts := make(map[string]int)
+
+	for i := 0; i < 1000; i++ {
+		counts[selection.Select([]string{"a", "b", "c"}, 1)[0]]++
+	}
+
+	if counts["c"] != 0 {
+		t.Errorf("a host with no capacity was picked %d times", counts["c"])
+	}
+
+	if counts["a"] < 5*counts["b"] {
+		t.Errorf("expected a to be picked far more than b, got %v", counts)
+	}
+
+	// hosts without capacity are still used when there's nothing else
+	result := selection.Select([]string{"a", "b", "c"}, 3)
+	sort.Strings(result)
+	if !reflect.DeepEqual(result, []string{"a", "b", "c"}) {
+		t.Errorf("expected every host, got %v", result)
+	}
+}
+
+func TestCohortUsesSelection(t *testing.T) {
+	hosts := []string{"a", "b", "c"}
+	first := SelectionFunc(func(alive []string, num int) []string {
+		sort.Strings(alive)
+		return alive[:num]
+	})
+
+	c := NewCohortWithSelection(0, hosts, NewReadMajorityWriteMajority(3), &fakeLiveness{[]string{"c", "b"}}, first)
+
+	nodes, err := c.GetCreateSet()
+	if err != nil || !reflect.DeepEqual(nodes, []string{"b", "c"}) {
+		t.Errorf("expected the selection to pick b and c, got %v %v", nodes, err)
+	}
+}
+
+func TestCohortNilSelection(t *testing.T) {
+	hosts := []string{"a", "b", "c"}
+	c := NewCohortWithSelection(0, hosts, NewReadMajorityWriteMajority(3), &fakeLiveness{[]string{"c", "b"}}, nil)
+
+	nodes, err := c.GetCreateSet()
+	sort.Strings(nodes)
+	if err != nil || !reflect.DeepEqual(nodes, []string{"b", "c"}) {
+		t.Errorf("expected a random selection of b and c, got %v %v", nodes, err)
+	}
+}
@@ -0,0 +1,54 @@
+package cohort
+
+// SpreadAcross makes the cohort spread each set of hosts over the values of
+// the given labels, most important first, e.g. LabelZone then LabelRack. Hosts
+// are taken from each zone in turn so no zone holds more of a quorum than it
+// has to, and within a zone from each rack in turn. The selection strategy
+// still decides the order hosts are taken in within each rack. Hosts missing
+// a label are grouped together.
+func (this *Cohort) SpreadAcross(labels ...string) {
+	this.members.lock.Lock()
+	defer this.members.lock.Unlock()
+	this.members.spread = append([]string{}, labels...)
+}
+
+// spread reorders hosts so consecutive hosts are in different failure
+// domains, keeping the existing order within each domain.
+func (this *Cohort) spread(hosts []string) []string {
+	this.members.lock.RLock()
+	defer this.members.lock.RUnlock()
+	return spreadBy(hosts, this.members.spread, this.members.labels)
+}
+
+func spreadBy(hosts []string, labels []string, hostLabels map[string]Labels) []string {
+	if len(labels) == 0 || len(hosts) < 2 {
+		return hosts
+	}
+
+	// group by the first label, in the order the values first appear
+	var order []string
+	groups := make(map[string][]string)
+	for _, host := range hosts {
+		value := hostLabels[host][labels[0]]
+		if _, found := groups[value]; !found {
+			order = append(order, value)
+		}
+		groups[value] = append(groups[value], host)
+	}
+
+	for _, value := range order {
+		groups[value] = spreadBy(groups[value], labels[1:], hostLabels)
+	}
+
+	// then take one from each group in turn
+	spread := []string{}
+	for len(spread) < len(hosts) {
+		for _, value := range order {
+			if len(groups[value]) > 0 {
+				spread = append(spread, groups[value][0])
+				groups[value] = groups[value][1:]
+			}
+		}
+	}
+	return spread
+}
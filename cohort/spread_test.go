@@ -0,0 +1,86 @@
+package cohort
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpreadBy(t *testing.T) {
+	labels := map[string]Labels{
+		"a1": {LabelZone: "a", LabelRack: "1"},
+		"a2": {LabelZone: "a", LabelRack: "1"},
+		"a3": {LabelZone: "a", LabelRack: "2"},
+		"b1": {LabelZone: "b", LabelRack: "1"},
+		"b2": {LabelZone: "b", LabelRack: "1"},
+		"c1": {LabelZone: "c", LabelRack: "1"},
+		"x":  {},
+	}
+
+	var data = []struct {
+		name     string
+		hosts    []string
+		labels   []string
+		expected []string
+	}{
+		{"nothing to spread by", []string{"a1", "a2", "b1"}, nil, []string{"a1", "a2", "b1"}},
+		{"zones", []string{"a1", "a2", "a3", "b1", "b2", "c1"}, []string{LabelZone}, []string{"a1", "b1", "c1", "a2", "b2", "a3"}},
+		{"keeps the order", []string{"b2", "a3", "a1", "b1"}, []string{LabelZone}, []string{"b2", "a3", "b1", "a1"}},
+		{"racks within zones", []string{"a1", "a2", "a3", "b1"}, []string{LabelZone, LabelRack}, []string{"a1", "b1", "a3", "a2"}},
+		{"unlabeled hosts are grouped", []string{"a1", "a2", "x"}, []string{LabelZone}, []string{"a1", "x", "a2"}},
+	}
+
+	for _, tc := range data {
+		result := spreadBy(tc.hosts, tc.labels, labels)
+		if !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, result)
+		}
+	}
+}
+
+func TestSpreadAcross(t *testing.T) {
+	hosts := []string{"a1", "a2", "a3", "b1", "b2", "c1"}
+	c := NewCohort(0, hosts, NewReadMajorityWriteMajority(5), &fakeLiveness{hosts})
+
+	for _, host := range hosts {
+		c.SetLabels(host, Labels{LabelZone: host[:1]})
+	}
+	c.SpreadAcross(LabelZone)
+
+	// a write quorum of 3 should always get one host from each zone
+	for i := 0; i < 100; i++ {
+		nodes, err := c.GetCreateSet()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zones := make(map[string]int)
+		for _, node := range nodes {
+			zones[node[:1]]++
+		}
+
+		if len(nodes) != 3 || len(zones) != 3 {
+			t.Fatalf("expected one host from each zone, got %v", nodes)
+		}
+	}
+}
+
+func TestSpreadAcrossWithPlacement(t *testing.T) {
+	hosts := []string{"eu-a1", "eu-a2", "eu-b1", "us-a1", "us-b1"}
+	c := NewCohort(0, hosts, NewReadMajorityWriteMajority(3), &fakeLiveness{hosts})
+
+	for _, host := range hosts {
+		c.SetLabels(host, Labels{LabelRegion: host[:2], LabelZone: host[3:4]})
+	}
+	c.SpreadAcross(LabelZone)
+
+	for i := 0; i < 100; i++ {
+		nodes, err := c.WithPlacement(Placement{In(LabelRegion, "eu")}).GetCreateSet()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(nodes) != 2 || nodes[0][:2] != "eu" || nodes[1][:2] != "eu" || nodes[0][3] == nodes[1][3] {
+			t.Fatalf("expected eu hosts in different zones, got %v", nodes)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josephlewis42/historia/history"
+)
+
+var (
+	numSeconds = flag.Int("seconds", 5, "run for x seconds (default 5)")
+	threads    = flag.Int("threads", 1, "number of concurrent clients")
+	replicas   = flag.Int("replicas", 0, "number of nodes each create is replicated to (default a majority of the hosts)")
+	settle     = flag.Int("settle", 5, "seconds to wait for recovery before reading the nodes")
+)
+
+func main() {
+	fmt.Println("Usage: historycheck <flags> host:port [host:port]+")
+	fmt.Println("Example: historycheck --threads 5 --replicas 2 localhost:8000 localhost:8001 localhost:8002")
+
+	flag.Parse()
+
+	hosts := flag.Args()
+	if len(hosts) == 0 {
+		fmt.Println("Error, you must specify at least one host.")
+		return
+	}
+
+	if *replicas < 1 {
+		*replicas = len(hosts)/2 + 1
+	}
+
+	recorder := history.NewRecorder()
+	stop := time.Now().Add(time.Duration(*numSeconds) * time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *threads; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			runClient(client, hosts, recorder, stop)
+		}(i)
+	}
+	wg.Wait()
+
+	fmt.Printf("Waiting %d seconds for the cluster to settle\n", *settle)
+	time.Sleep(time.Duration(*settle) * time.Second)
+
+	snapshot := history.Snapshot{}
+	for _, host := range hosts {
+		contents, err := readNode(host)
+		if err != nil {
+			fmt.Printf("Error, could not read %s: %s\n", host, err)
+			os.Exit(2)
+		}
+		snapshot[host] = contents
+	}
+
+	ops := recorder.History()
+	counts := map[history.Outcome]int{}
+	for _, op := range ops {
+		counts[op.Outcome]++
+	}
+	fmt.Printf("Recorded %d creates: %d ok %d failed %d unknown\n",
+		len(ops), counts[history.OK], counts[history.Fail], counts[history.Info])
+
+	violations := history.CheckAtomicity(ops, snapshot, *replicas)
+	for _, violation := range violations {
+		fmt.Println("VIOLATION:", violation)
+	}
+
+	if len(violations) > 0 {
+		fmt.Printf("Found %d violations\n", len(violations))
+		os.Exit(1)
+	}
+
+	fmt.Println("No violations found")
+}
+
+// runClient creates unique values on random hosts until stop
+func runClient(client int, hosts []string, recorder *history.Recorder, stop time.Time) {
+	pid := strconv.Itoa(os.Getpid())
+	httpClient := http.Client{Timeout: 10 * time.Second}
+
+	for count := 0; time.Now().Before(stop); count++ {
+		value := "check_" + pid + "_" + strconv.Itoa(client) + "_" + strconv.Itoa(count)
+		host := hosts[rand.Intn(len(hosts))]
+
+		id := recorder.Invoke(client, history.OpCreate, value)
+		resp, err := httpClient.Get("http://" + host + "/log/" + value)
+
+		// a failed create may still have been committed by some nodes and
+		// finish through the termination protocol, only a server that isn't
+		// ready yet definitely didn't start it
+		switch {
+		case err != nil:
+			recorder.Complete(id, history.Info, "")
+		case resp.StatusCode == http.StatusOK:
+			recorder.Complete(id, history.OK, "")
+		case resp.StatusCode == http.StatusServiceUnavailable:
+			recorder.Complete(id, history.Fail, "")
+		default:
+			recorder.Complete(id, history.Info, "")
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// readNode parses the contents of a node from its statistics page
+func readNode(host string) (map[string]string, error) {
+	resp, err := http.Get("http://" + host + "/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) == 2 {
+			contents[fields[0]] = fields[1]
+		}
+	}
+
+	return contents, nil
+}
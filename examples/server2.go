@@ -1,110 +1,212 @@
 package main
 
 import (
-	"encoding/base64"
-	"errors"
+	"context"
+	"crypto/hmac"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/gorilla/mux"
+	"github.com/josephlewis42/historia/checkup"
 	"github.com/josephlewis42/historia/cohort"
 	"github.com/josephlewis42/historia/storage"
 	"github.com/josephlewis42/historia/threephase"
+	"github.com/josephlewis42/historia/threephase/auth"
+	"github.com/josephlewis42/historia/transport/httptransport"
+	"github.com/josephlewis42/historia/transport/mtls"
 )
 
 func NewThreePhaseHTTP(thishost int, hosts []string, db storage.Storage) {
-	cohort := cohort.NewDefaultCohort(thishost, hosts)
+	// with certificates configured peers talk over TLS and must present a
+	// certificate signed by the cluster CA
+	var config httptransport.Config
+	reloader := loadTLS()
+	scheme := "http"
+	if reloader != nil {
+		config.TLSConfig = reloader.ClientTLSConfig()
+		scheme = "https"
+	}
+
+	// peers are checked through /health so a node with a stuck engine counts
+	// as down even though it still accepts connections
+	prober := checkup.NewHTTPProber(scheme, "/health", &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config.TLSConfig},
+	})
+	ckup := checkup.NewProberCheckup(hosts, prober)
+	ckup.(checkup.DampedCheckup).SetDamping(checkup.DefaultDampingConfig)
+	ckup.Start()
+	// the fastest peers are picked for each request
+	selection := cohort.NewLatencySelection(ckup)
+	chrt := cohort.NewCohortWithSelection(thishost, hosts, cohort.NewReadMajorityWriteMajority(len(hosts)), ckup, selection)
+
+	// HISTORIA_LABELS describes where each node is, for example
+	// "localhost:8000=region:eu,zone:a localhost:8001=region:us,zone:b"
+	for host, labels := range parseLabels(os.Getenv("HISTORIA_LABELS")) {
+		chrt.SetLabels(host, labels)
+	}
+
+	// replicas are spread over zones, then racks, so losing one doesn't
+	// take out a quorum
+	chrt.SpreadAcross(cohort.LabelZone, cohort.LabelRack)
+
+	// membership changes are committed like any other transaction and
+	// applied to the cohort by the storage
+	db = cohort.NewMembershipStorage(db, &chrt)
 
 	var tpi threePhaseHTTPImplementation
 	tpi.db = db
 	tpi.hosts = hosts
 	tpi.myhost = hosts[thishost]
-	tpi.chrt = cohort
+	tpi.chrt = &chrt
+	tpi.ckup = ckup
+
+	// when a cluster key is set every message between nodes is signed and
+	// unsigned ones are refused
+	var comm threephase.CommunicationHandler = httptransport.NewClient(config)
+	key := os.Getenv("HISTORIA_CLUSTER_KEY")
+	if key != "" {
+		comm = auth.NewSigningHandler([]byte(key), comm)
+	}
 
-	tpi.tpc = threephase.NewThreePhaseCommit(tpi, db, &cohort)
+	tpi.tpc = threephase.NewThreePhaseCommit(comm, db, &chrt)
 
-	r := mux.NewRouter()
+	// clients are turned away until enough peers are up to commit writes,
+	// then we catch up on membership changes made while we were down
+	ready := make(chan bool)
+	go func() {
+		ckup.WaitReady(context.Background(), len(hosts)/2+1)
+		log.Printf("Enough peers are up, accepting requests\n")
+		if err := chrt.SyncMembers(comm); err != nil {
+			log.Printf("Error syncing membership: %s\n", err)
+		}
+		close(ready)
+	}()
+
+	participant := tpi.tpc
+	var peerdb storage.Storage = db
+	if key != "" {
+		participant = auth.NewVerifyingCommit([]byte(key), tpi.myhost, tpi.tpc)
+		peerdb = auth.NewVerifyingStorage([]byte(key), tpi.myhost, db)
+	} else {
+		log.Printf("HISTORIA_CLUSTER_KEY isn't set, messages between nodes won't be authenticated\n")
+	}
 
-	r.HandleFunc("/3pc/init/{id}", threePhaseInit("init", tpi.tpc.InitializeTransaction)).Methods("GET")
-	r.HandleFunc("/3pc/abort/{id}", threePhaseCall("abort", tpi.tpc.Abort)).Methods("GET")
-	r.HandleFunc("/3pc/commit/{id}", threePhaseCall("pre", tpi.tpc.DoCommit)).Methods("GET")
-	r.HandleFunc("/3pc/precommit/{id}", threePhaseCall("commit", tpi.tpc.PreCommit)).Methods("GET")
-	r.HandleFunc("/3pc/check/{id}", threePhaseCall("check", tpi.tpc.CheckCommit)).Methods("GET")
+	var peers http.Handler = httptransport.NewHandler(participant, peerdb)
+	if reloader != nil {
+		peers = mtls.RequirePeer(peers)
+	}
+
+	r := mux.NewRouter()
 
-	r.HandleFunc("/log/{value}", tpi.clientCreate).Methods("GET")
+	r.HandleFunc("/log/{value}", whenReady(ready, tpi.clientCreate)).Methods("GET")
 	r.HandleFunc("/stats", tpi.statistics).Methods("GET")
+	r.HandleFunc("/members", tpi.members).Methods("GET")
+	r.HandleFunc("/members/add/{host}", requireAdmin(key, reloader != nil, whenReady(ready, tpi.changeMembers(tpi.chrt.AddMember))).ServeHTTP).Methods("POST")
+	r.HandleFunc("/members/remove/{host}", requireAdmin(key, reloader != nil, whenReady(ready, tpi.changeMembers(tpi.chrt.RemoveMember))).ServeHTTP).Methods("POST")
 	r.HandleFunc("/", tpi.root)
 
 	log.Printf("Starting on %s\n", tpi.myhost)
 	http.Handle("/", r)
-	http.ListenAndServe(tpi.myhost, nil)
-}
+	http.Handle("/3pc/", peers)
+	http.Handle("/health", httptransport.NewHealthHandler(tpi.tpc, checkup.DefaultTimeout/2))
 
-/**
-	InitializeTransaction(transaction []byte) (ok bool)
-	Abort(transactionID string) (ok bool)
-	DoCommit(transactionID string) (ok bool)
-	PreCommit(transactionID string) (ok bool)
-	CheckCommit(transactionID string) (didcommit bool)
-**/
+	if reloader == nil {
+		http.ListenAndServe(tpi.myhost, nil)
+		return
+	}
 
-func threePhaseInit(name string, wrapped func(tx []byte) bool) func(w http.ResponseWriter, r *http.Request) {
+	server := &http.Server{Addr: tpi.myhost, TLSConfig: reloader.ServerTLSConfig()}
+	log.Println(server.ListenAndServeTLS("", ""))
+}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("handling %s\n", r.URL)
-		vars := mux.Vars(r)
-		id, ok := vars["id"]
+// loadTLS loads the certificates named by HISTORIA_TLS_CERT, HISTORIA_TLS_KEY
+// and HISTORIA_TLS_CA, reloading them on SIGHUP. It returns nil if they
+// aren't set.
+func loadTLS() *mtls.Reloader {
+	config := mtls.Config{
+		CertFile: os.Getenv("HISTORIA_TLS_CERT"),
+		KeyFile:  os.Getenv("HISTORIA_TLS_KEY"),
+		CAFile:   os.Getenv("HISTORIA_TLS_CA"),
+	}
 
-		if !ok {
-			log.Printf("%s Error, id wasn't found.\n", r.URL)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	if config.CertFile == "" {
+		return nil
+	}
 
-		decoded, err := base64.StdEncoding.DecodeString(id)
-		if err != nil {
-			log.Printf("Error decoding Base64: %s\n", err)
-		}
-		result := wrapped(decoded)
+	reloader, err := mtls.NewReloader(config)
+	if err != nil {
+		log.Fatalf("Error loading TLS certificates: %s\n", err)
+	}
 
-		if result == true {
-			w.WriteHeader(200)
-			w.Write([]byte("Success"))
-		} else {
-			w.WriteHeader(400)
-			w.Write([]byte("Failure"))
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloader.Reload(); err != nil {
+				log.Printf("Error reloading TLS certificates, keeping the old ones: %s\n", err)
+			}
 		}
-	}
+	}()
 
+	return reloader
 }
 
-func threePhaseCall(name string, wrapped func(tx string) bool) func(w http.ResponseWriter, r *http.Request) {
+// whenReady answers 503 until ready is closed
+func whenReady(ready chan bool, handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("handling %s\n", r.URL)
+		select {
+		case <-ready:
+			handler(w, r)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Waiting for enough peers to come up"))
+		}
+	}
+}
 
-		vars := mux.Vars(r)
-		id, ok := vars["id"]
+// requireAdmin guards handlers that change the cluster. With TLS the caller
+// needs a certificate signed by the CA, with a cluster key it has to send the
+// key in the X-Historia-Cluster-Key header, and with neither only requests
+// from this machine are let through.
+func requireAdmin(key string, peersOnly bool, handler http.Handler) http.Handler {
+	guarded := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key != "" && !hmac.Equal([]byte(r.Header.Get("X-Historia-Cluster-Key")), []byte(key)) {
+			log.Printf("Refusing %s from %s without the cluster key\n", r.URL, r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 
-		if !ok {
-			log.Printf("%s Error, id wasn't found.", r.URL)
-			w.WriteHeader(http.StatusBadRequest)
+		if key == "" && !peersOnly && !fromLoopback(r) {
+			log.Printf("Refusing %s from %s, set HISTORIA_CLUSTER_KEY to allow remote changes\n", r.URL, r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 
-		result := wrapped(id)
+		handler.ServeHTTP(w, r)
+	})
 
-		if result == true {
-			w.WriteHeader(200)
-			w.Write([]byte("Success"))
-		} else {
-			w.WriteHeader(400)
-			w.Write([]byte("Failure"))
-		}
+	if peersOnly {
+		return mtls.RequirePeer(guarded)
 	}
+	return guarded
+}
+
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 type threePhaseHTTPImplementation struct {
@@ -112,87 +214,50 @@ type threePhaseHTTPImplementation struct {
 	hosts  []string
 	myhost string
 	tpc    threephase.ThreePhaseCommit
-	chrt   cohort.Cohort
+	chrt   *cohort.Cohort
+	ckup   checkup.Checkup
 }
 
-// Satisfies the callback interface for 3PC
-func (this threePhaseHTTPImplementation) Create(tx []byte, destination string) (ok bool, err error) {
-	encoded := base64.StdEncoding.EncodeToString(tx)
-
-	resp, err := http.Get("http://" + destination + "/3pc/init/" + url.QueryEscape(encoded))
-	resp.Body.Close()
-	return resp.StatusCode == 200, err
-}
-
-// Satisfies the callback interface for 3PC
-func (this threePhaseHTTPImplementation) InitializeTransaction(tx []byte, destination string) (ok bool, err error) {
-	encoded := base64.StdEncoding.EncodeToString(tx)
-
-	resp, err := http.Get("http://" + destination + "/3pc/init/" + url.QueryEscape(encoded))
-	if resp != nil {
-		if resp.Body != nil {
-			resp.Body.Close()
-		}
-		return resp.StatusCode == 200, err
-	}
-	return false, err
-}
-
-// Satisfies the callback interface for 3PC
-func (this threePhaseHTTPImplementation) Abort(tx []byte, destination string) (ok bool, err error) {
-	resp, err := http.Get("http://" + destination + "/3pc/abort/" + string(tx))
-	if resp != nil {
-		if resp.Body != nil {
-			resp.Body.Close()
+// parseLabels reads space separated host=label:value,label:value entries
+func parseLabels(config string) map[string]cohort.Labels {
+	result := make(map[string]cohort.Labels)
+	for _, entry := range strings.Fields(config) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("Ignoring malformed labels %q\n", entry)
+			continue
 		}
-		return resp.StatusCode == 200, err
-	}
-	return false, err
-}
 
-// Satisfies the callback interface for 3PC
-func (this threePhaseHTTPImplementation) DoCommit(tx []byte, destination string) (ok bool, err error) {
-	resp, err := http.Get("http://" + destination + "/3pc/commit/" + string(tx))
-	if resp != nil {
-		if resp.Body != nil {
-			resp.Body.Close()
+		labels := make(cohort.Labels)
+		for _, label := range strings.Split(parts[1], ",") {
+			pair := strings.SplitN(label, ":", 2)
+			if len(pair) == 2 {
+				labels[pair[0]] = pair[1]
+			}
 		}
-		return resp.StatusCode == 200, err
+		result[parts[0]] = labels
 	}
-	return false, err
+	return result
 }
 
-// Satisfies the callback interface for 3PC
-func (this threePhaseHTTPImplementation) PreCommit(tx []byte, destination string) (ok bool, err error) {
-	resp, err := http.Get("http://" + destination + "/3pc/precommit/" + string(tx))
-	if resp != nil {
-		if resp.Body != nil {
-			resp.Body.Close()
+// placementLabels are the query parameters parsePlacement understands, any
+// others are left alone
+var placementLabels = []string{cohort.LabelRegion, cohort.LabelZone, cohort.LabelRack}
+
+// parsePlacement turns query parameters like ?region=eu-west,eu-central or
+// ?region=!us into placement constraints
+func parsePlacement(query url.Values) cohort.Placement {
+	placement := cohort.Placement{}
+	for _, label := range placementLabels {
+		for _, value := range query[label] {
+			if strings.HasPrefix(value, "!") {
+				placement = append(placement, cohort.NotIn(label, strings.Split(value[1:], ",")...))
+			} else {
+				placement = append(placement, cohort.In(label, strings.Split(value, ",")...))
+			}
 		}
-		return resp.StatusCode == 200, err
 	}
-	return false, err
-}
-
-// Satisfies the callback interface for 3PC
-func (this threePhaseHTTPImplementation) CheckCommit(tx []byte, destination string) (didcommit bool, err error) {
-	resp, err := http.Get("http://" + destination + "/3pc/check/" + string(tx))
-	if resp != nil {
-		if resp.Body != nil {
-			resp.Body.Close()
-		}
-		return resp.StatusCode == 200, err
-	}
-	return false, err
-}
-
-// Satisfies the callback interface for 3PC
-func (this threePhaseHTTPImplementation) ReadData(tx []byte, destination string) (result []byte, err error) {
-	// TODO allow queries in the future
-	return []byte{}, errors.New("Reading data is not implemented yet")
-
-	//resp, err := http.Get("http://" + destination + "/3pc/read/" + url.QueryEscape(string(tx)))
-	//return resp.StatusCode == 200, err
+	return placement
 }
 
 func (this threePhaseHTTPImplementation) clientCreate(w http.ResponseWriter, r *http.Request) {
@@ -200,7 +265,13 @@ func (this threePhaseHTTPImplementation) clientCreate(w http.ResponseWriter, r *
 	value, _ := vars["value"]
 	log.Printf("inserting %s\n", value)
 
-	result := this.tpc.Create([]byte(value))
+	// with a placement the nodes are picked from the ones satisfying it, and
+	// each of them checks it again before taking the value
+	tpc := this.tpc
+	if placement := parsePlacement(r.URL.Query()); len(placement) > 0 {
+		tpc = tpc.WithPlacement(placement)
+	}
+	result := tpc.Create(nil, []byte(value))
 
 	if result == true {
 		w.WriteHeader(200)
@@ -212,6 +283,32 @@ func (this threePhaseHTTPImplementation) clientCreate(w http.ResponseWriter, r *
 
 }
 
+func (this threePhaseHTTPImplementation) members(w http.ResponseWriter, r *http.Request) {
+	membership := this.chrt.Membership()
+
+	w.WriteHeader(200)
+	w.Write([]byte(fmt.Sprintf("Version %d\n", membership.Version)))
+	for _, host := range membership.Hosts {
+		w.Write([]byte("* " + host + "\n"))
+	}
+}
+
+func (this threePhaseHTTPImplementation) changeMembers(change func(threephase.ThreePhaseCommit, string) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := mux.Vars(r)["host"]
+
+		if err := change(this.tpc, host); err != nil {
+			log.Printf("Error changing membership for %s: %s\n", host, err)
+			w.WriteHeader(400)
+			w.Write([]byte("Failure: " + err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+		w.Write([]byte("Success"))
+	}
+}
+
 func (this threePhaseHTTPImplementation) statistics(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 
@@ -224,7 +321,11 @@ func (this threePhaseHTTPImplementation) root(w http.ResponseWriter, r *http.Req
 	w.Write([]byte("====== Connections ======\n\n"))
 
 	for _, host := range this.chrt.GetAliveSet() {
-		w.Write([]byte("* " + host + "\n"))
+		w.Write([]byte("* " + host))
+		if rtt, ok := this.ckup.GetRTT(host); ok {
+			w.Write([]byte(fmt.Sprintf(" (rtt avg %s, p50 %s, p99 %s)", rtt.EWMA, rtt.P50, rtt.P99)))
+		}
+		w.Write([]byte("\n"))
 	}
 
 	w.Write([]byte("====== Database ======\n\n"))
@@ -0,0 +1,93 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Snapshot is the contents of every node after a run, keyed by node then by
+// storage key.
+type Snapshot map[string]map[string]string
+
+// placement is where a single value ended up
+type placement struct {
+	keys  map[string]bool
+	nodes []string
+}
+
+// CheckAtomicity compares the creates in history against the final contents of
+// the cluster, every create is expected to be replicated to replicas nodes.
+// It reports a violation when:
+//
+//   - a stored entry is on some but not all of the nodes of its cohort
+//   - an OK create isn't on every node of its cohort
+//   - a failed create is on any node
+//   - a value is stored that no client created
+func CheckAtomicity(history []Operation, nodes Snapshot, replicas int) (violations []string) {
+	placements := make(map[string]*placement)
+	entries := make(map[string][]string)
+
+	for node, contents := range nodes {
+		for key, value := range contents {
+			entries[key] = append(entries[key], node)
+
+			p, found := placements[value]
+			if !found {
+				p = &placement{keys: make(map[string]bool)}
+				placements[value] = p
+			}
+			p.keys[key] = true
+			p.nodes = append(p.nodes, node)
+		}
+	}
+
+	for key, holders := range entries {
+		if len(holders) != replicas {
+			sort.Strings(holders)
+			violations = append(violations,
+				fmt.Sprintf("entry %s is on %d of %d nodes: %v", key, len(holders), replicas, holders))
+		}
+	}
+
+	created := make(map[string]bool)
+	for _, op := range history {
+		if op.Type != OpCreate {
+			continue
+		}
+		created[op.Value] = true
+
+		p := placements[op.Value]
+		stored := 0
+		if p != nil {
+			stored = len(p.nodes)
+			if len(p.keys) > 1 {
+				violations = append(violations,
+					fmt.Sprintf("create %d of %q was stored as %d different entries", op.ID, op.Value, len(p.keys)))
+			}
+		}
+
+		switch op.Outcome {
+		case OK:
+			if stored < replicas {
+				violations = append(violations,
+					fmt.Sprintf("create %d of %q succeeded but is only on %d of %d nodes", op.ID, op.Value, stored, replicas))
+			}
+		case Fail:
+			if stored > 0 {
+				violations = append(violations,
+					fmt.Sprintf("create %d of %q failed but is on %d nodes", op.ID, op.Value, stored))
+			}
+		}
+	}
+
+	for value, p := range placements {
+		if !created[value] {
+			sort.Strings(p.nodes)
+			violations = append(violations,
+				fmt.Sprintf("value %q was never created but is on %v", value, p.nodes))
+		}
+	}
+
+	sort.Strings(violations)
+	return violations
+}
@@ -0,0 +1,74 @@
+package history
+
+import (
+	"strings"
+	"testing"
+)
+
+func create(id int, value string, outcome Outcome) Operation {
+	return Operation{ID: id, Type: OpCreate, Value: value, Outcome: outcome}
+}
+
+func TestAtomicityClean(t *testing.T) {
+	history := []Operation{
+		create(0, "a", OK),
+		create(1, "b", Fail),
+		create(2, "c", Info),
+		create(3, "d", Info),
+	}
+
+	nodes := Snapshot{
+		"n1": {"1": "a", "3": "c"},
+		"n2": {"1": "a", "3": "c"},
+		"n3": {},
+	}
+
+	if violations := CheckAtomicity(history, nodes, 2); len(violations) != 0 {
+		t.Errorf("Expected no violations, got %v", violations)
+	}
+}
+
+func TestAtomicityViolations(t *testing.T) {
+	var data = []struct {
+		Description string
+		History     []Operation
+		Nodes       Snapshot
+		Expected    string
+	}{
+		{"partial commit",
+			[]Operation{create(0, "a", Info)},
+			Snapshot{"n1": {"1": "a"}, "n2": {}},
+			"is on 1 of 2 nodes"},
+		{"ok create missing",
+			[]Operation{create(0, "a", OK)},
+			Snapshot{"n1": {}, "n2": {}},
+			"succeeded but is only on 0 of 2 nodes"},
+		{"failed create stored",
+			[]Operation{create(0, "a", Fail)},
+			Snapshot{"n1": {"1": "a"}, "n2": {"1": "a"}},
+			"failed but is on 2 nodes"},
+		{"phantom value",
+			[]Operation{},
+			Snapshot{"n1": {"1": "z"}, "n2": {"1": "z"}},
+			"was never created"},
+		{"stored twice",
+			[]Operation{create(0, "a", OK)},
+			Snapshot{"n1": {"1": "a", "2": "a"}, "n2": {"1": "a", "2": "a"}},
+			"2 different entries"},
+	}
+
+	for _, tmp := range data {
+		violations := CheckAtomicity(tmp.History, tmp.Nodes, 2)
+
+		found := false
+		for _, violation := range violations {
+			if strings.Contains(violation, tmp.Expected) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("%s: expected a violation containing %q, got %v", tmp.Description, tmp.Expected, violations)
+		}
+	}
+}
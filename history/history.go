@@ -0,0 +1,132 @@
+// Package history records the operations clients make against a cluster and
+// checks the recorded history for atomicity and linearizability violations.
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// OpType is the kind of request a client made
+type OpType int
+
+const (
+	OpCreate OpType = iota
+	OpRead
+)
+
+func (o OpType) String() string {
+	switch o {
+	case OpCreate:
+		return "create"
+	case OpRead:
+		return "read"
+	}
+	return "unknown"
+}
+
+// Outcome is what the client learned about an operation
+type Outcome int
+
+const (
+	// Pending operations have been invoked but haven't completed yet
+	Pending Outcome = iota
+	// OK operations definitely took effect
+	OK
+	// Fail operations definitely didn't take effect
+	Fail
+	// Info operations may or may not have taken effect, e.g. the request
+	// timed out
+	Info
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Pending:
+		return "pending"
+	case OK:
+		return "ok"
+	case Fail:
+		return "fail"
+	case Info:
+		return "info"
+	}
+	return "unknown"
+}
+
+// Operation is a single client request and its result
+type Operation struct {
+	ID       int
+	Client   int
+	Type     OpType
+	Value    string // the value written by a create or returned by a read
+	Invoke   time.Time
+	Complete time.Time
+	Outcome  Outcome
+}
+
+// Recorder collects operations from concurrent clients
+type Recorder struct {
+	mutex sync.Mutex
+	ops   []*Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Invoke records the start of an operation, the returned ID is passed to
+// Complete once the client gets a response.
+func (r *Recorder) Invoke(client int, opType OpType, value string) (id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id = len(r.ops)
+	r.ops = append(r.ops, &Operation{
+		ID:     id,
+		Client: client,
+		Type:   opType,
+		Value:  value,
+		Invoke: time.Now(),
+	})
+
+	return id
+}
+
+// Complete records the outcome of an operation. For reads value is what was
+// returned, for creates it's ignored.
+func (r *Recorder) Complete(id int, outcome Outcome, value string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	op := r.ops[id]
+	op.Complete = time.Now()
+	op.Outcome = outcome
+
+	if op.Type == OpRead {
+		op.Value = value
+	}
+}
+
+// History returns a copy of every operation recorded so far, ordered by
+// invocation time. Operations that never completed are reported as Info.
+func (r *Recorder) History() []Operation {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	history := make([]Operation, 0, len(r.ops))
+	for _, op := range r.ops {
+		copied := *op
+		if copied.Outcome == Pending {
+			copied.Outcome = Info
+		}
+		history = append(history, copied)
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Invoke.Before(history[j].Invoke)
+	})
+
+	return history
+}
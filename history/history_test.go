@@ -0,0 +1,35 @@
+package history
+
+import "testing"
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+
+	create := r.Invoke(1, OpCreate, "a")
+	read := r.Invoke(2, OpRead, "")
+	pending := r.Invoke(3, OpCreate, "b")
+
+	r.Complete(create, OK, "ignored")
+	r.Complete(read, OK, "a")
+
+	history := r.History()
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 operations, got %d", len(history))
+	}
+
+	if history[create].Value != "a" || history[create].Outcome != OK {
+		t.Errorf("Create was recorded wrong: %+v", history[create])
+	}
+
+	if history[read].Value != "a" {
+		t.Errorf("Read result wasn't recorded: %+v", history[read])
+	}
+
+	if history[pending].Outcome != Info {
+		t.Errorf("An operation that never completed should be info, got %s", history[pending].Outcome)
+	}
+
+	if history[create].Complete.Before(history[create].Invoke) {
+		t.Error("Operation completed before it was invoked")
+	}
+}
@@ -0,0 +1,173 @@
+package history
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// Model is the sequential specification a history is checked against. States
+// are strings so they can be compared and cached cheaply.
+type Model interface {
+	// Init returns the state before any operation
+	Init() string
+
+	// Step applies op to state, returning false if op couldn't have produced
+	// the result it recorded in that state
+	Step(state string, op Operation) (ok bool, next string)
+}
+
+// SetModel models the cluster as a set of values: creates add a value and
+// reads return every value created so far, sorted and comma separated.
+type SetModel struct{}
+
+func (SetModel) Init() string {
+	return ""
+}
+
+func (SetModel) Step(state string, op Operation) (ok bool, next string) {
+	values := []string{}
+	if state != "" {
+		values = strings.Split(state, ",")
+	}
+
+	switch op.Type {
+	case OpCreate:
+		for _, value := range values {
+			if value == op.Value {
+				return false, state
+			}
+		}
+		values = append(values, op.Value)
+		sort.Strings(values)
+		return true, strings.Join(values, ",")
+
+	case OpRead:
+		return op.Value == state, state
+	}
+
+	return false, state
+}
+
+// CheckLinearizable searches for an order of the operations in history that
+// is legal for model and respects real time: an operation that completed
+// before another was invoked must come first. Failed operations are ignored
+// and Info operations may or may not have taken effect.
+//
+// It returns false and the longest prefix of the history that could be
+// linearized if there is no such order.
+func CheckLinearizable(model Model, history []Operation) (ok bool, longest []Operation) {
+	var calls []call
+	required := 0
+
+	for _, op := range history {
+		if op.Outcome == Fail || op.Outcome == Pending {
+			continue
+		}
+
+		c := call{op: op, invoke: op.Invoke.UnixNano(), complete: op.Complete.UnixNano()}
+		if op.Outcome == Info {
+			c.complete = math.MaxInt64
+		} else {
+			required++
+		}
+		calls = append(calls, c)
+	}
+
+	s := search{
+		model:    model,
+		calls:    calls,
+		required: required,
+		done:     make([]bool, len(calls)),
+		seen:     make(map[string]bool),
+	}
+
+	if s.run(model.Init(), 0) {
+		return true, nil
+	}
+
+	for _, index := range s.longest {
+		longest = append(longest, calls[index].op)
+	}
+	return false, longest
+}
+
+type call struct {
+	op       Operation
+	invoke   int64
+	complete int64
+}
+
+// search is a Wing & Gong style backtracking search with memoization of the
+// (linearized set, state) pairs that have already been explored.
+type search struct {
+	model    Model
+	calls    []call
+	required int
+	done     []bool
+	order    []int
+	longest  []int
+	seen     map[string]bool
+}
+
+func (s *search) run(state string, requiredDone int) bool {
+	if requiredDone == s.required {
+		return true
+	}
+
+	if len(s.order) > len(s.longest) {
+		s.longest = append([]int{}, s.order...)
+	}
+
+	// an operation can go next only if it was invoked before every pending
+	// operation completed
+	deadline := int64(math.MaxInt64)
+	for i, c := range s.calls {
+		if !s.done[i] && c.complete < deadline {
+			deadline = c.complete
+		}
+	}
+
+	for i, c := range s.calls {
+		if s.done[i] || c.invoke > deadline {
+			continue
+		}
+
+		ok, next := s.model.Step(state, c.op)
+		if !ok {
+			continue
+		}
+
+		s.done[i] = true
+		key := s.key(next)
+		if !s.seen[key] {
+			s.seen[key] = true
+			s.order = append(s.order, i)
+
+			nowRequired := requiredDone
+			if c.complete != math.MaxInt64 {
+				nowRequired++
+			}
+
+			if s.run(next, nowRequired) {
+				return true
+			}
+			s.order = s.order[:len(s.order)-1]
+		}
+		s.done[i] = false
+	}
+
+	return false
+}
+
+func (s *search) key(state string) string {
+	bits := make([]byte, len(s.done))
+	for i, done := range s.done {
+		if done {
+			bits[i] = '1'
+		} else {
+			bits[i] = '0'
+		}
+	}
+	return string(bits) + "|" + state
+}
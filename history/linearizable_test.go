@@ -0,0 +1,77 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// op builds an operation that ran between the given millisecond offsets
+func op(opType OpType, value string, invoke, complete int, outcome Outcome) Operation {
+	return Operation{
+		Type:     opType,
+		Value:    value,
+		Invoke:   start.Add(time.Duration(invoke) * time.Millisecond),
+		Complete: start.Add(time.Duration(complete) * time.Millisecond),
+		Outcome:  outcome,
+	}
+}
+
+func TestSetModel(t *testing.T) {
+	var m SetModel
+	state := m.Init()
+
+	ok, state := m.Step(state, Operation{Type: OpCreate, Value: "b"})
+	ok2, state := m.Step(state, Operation{Type: OpCreate, Value: "a"})
+	if !ok || !ok2 || state != "a,b" {
+		t.Fatalf("Creates weren't applied, state: %q", state)
+	}
+
+	if ok, _ := m.Step(state, Operation{Type: OpCreate, Value: "a"}); ok {
+		t.Error("Created the same value twice")
+	}
+
+	if ok, _ := m.Step(state, Operation{Type: OpRead, Value: "a,b"}); !ok {
+		t.Error("A correct read was rejected")
+	}
+
+	if ok, _ := m.Step(state, Operation{Type: OpRead, Value: "a"}); ok {
+		t.Error("A stale read was accepted")
+	}
+}
+
+func TestLinearizable(t *testing.T) {
+	history := []Operation{
+		op(OpCreate, "a", 0, 10, OK),
+		// concurrent with the create so it may see either state
+		op(OpRead, "", 5, 15, OK),
+		op(OpRead, "a", 20, 30, OK),
+		// failed operations never happened
+		op(OpCreate, "b", 20, 30, Fail),
+		// timed out, but a later read saw it so it must have happened
+		op(OpCreate, "c", 31, 32, Info),
+		op(OpRead, "a,c", 40, 50, OK),
+	}
+
+	if ok, _ := CheckLinearizable(SetModel{}, history); !ok {
+		t.Error("A linearizable history was rejected")
+	}
+}
+
+func TestNotLinearizable(t *testing.T) {
+	history := []Operation{
+		op(OpCreate, "a", 0, 10, OK),
+		// the create had finished, so this read is stale
+		op(OpRead, "", 20, 30, OK),
+	}
+
+	ok, longest := CheckLinearizable(SetModel{}, history)
+	if ok {
+		t.Fatal("A stale read was accepted")
+	}
+
+	if len(longest) != 1 || longest[0].Value != "a" {
+		t.Errorf("Expected the longest prefix to be the create, got %+v", longest)
+	}
+}
@@ -7,4 +7,9 @@ type Storage interface {
 	Abort(transactionID []byte) bool
 	Merge(request []byte, response [][]byte) (result []byte, ok bool)
 	Stats() string
+
+	// PrepareOperation stages op on key for the given transaction, it fails
+	// if the operation doesn't make sense against what's stored, e.g.
+	// creating a key that already exists or updating one that doesn't.
+	PrepareOperation(transactionID []byte, op Operation, key, value []byte) error
 }
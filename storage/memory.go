@@ -3,57 +3,126 @@ package storage
 import (
 	"encoding/json"
 	"errors"
+	"sync"
 )
 
 func NewInMemoryStorage() Storage {
 	return &inMemoryStorage{backend: make(map[string][]byte),
-		precommit: make(map[string][]byte)}
+		precommit:  make(map[string]pendingOperation),
+		locked:     make(map[string]bool),
+		tombstones: make(map[string]bool)}
 }
 
+// pendingOperation is a change that has been prepared but not yet committed
+type pendingOperation struct {
+	op    Operation
+	key   string
+	value []byte
+}
+
+// inMemoryStorage is safe for concurrent use, transports read from it while
+// transactions commit.
 type inMemoryStorage struct {
-	backend   map[string][]byte
-	precommit map[string][]byte
+	lock       sync.RWMutex
+	backend    map[string][]byte
+	precommit  map[string]pendingOperation
+	locked     map[string]bool
+	tombstones map[string]bool
 }
 
 func (store *inMemoryStorage) Read(key []byte) (value []byte, ok bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
 	value, ok = store.backend[string(key)]
 	return value, ok
 }
 
 func (store *inMemoryStorage) Commit(key []byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
 
-	value, found := store.precommit[string(key)]
+	pending, found := store.precommit[string(key)]
 	if !found {
 		return errors.New("Error, no transaction exists for " + string(key))
 	}
 
-	store.backend[string(key)] = value
+	switch pending.op {
+	case OpDelete:
+		delete(store.backend, pending.key)
+		store.tombstones[pending.key] = true
+	default:
+		store.backend[pending.key] = pending.value
+		delete(store.tombstones, pending.key)
+	}
+
+	delete(store.locked, pending.key)
 	delete(store.precommit, string(key))
 	return nil
 }
 
+// Prepare stages value to be created under the transaction ID itself
 func (store *inMemoryStorage) Prepare(key, value []byte) bool {
+	return store.PrepareOperation(key, OpCreate, key, value) == nil
+}
+
+func (store *inMemoryStorage) PrepareOperation(transactionID []byte, op Operation, key, value []byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
 
 	// make sure the transaction isn't already processing
-	_, found := store.precommit[string(key)]
+	_, found := store.precommit[string(transactionID)]
 	if found {
-		return false
+		return TransactionExistsError
 	}
 
-	store.precommit[string(key)] = value
-	return true
+	// only one transaction can have a change pending on a key at a time,
+	// otherwise two creates could both see it missing
+	if store.locked[string(key)] {
+		return KeyLockedError
+	}
+
+	_, exists := store.backend[string(key)]
+	switch op {
+	case OpCreate:
+		if exists {
+			return KeyExistsError
+		}
+	case OpUpdate, OpDelete:
+		if !exists {
+			return KeyNotFoundError
+		}
+	default:
+		return UnknownOperationError
+	}
+
+	store.precommit[string(transactionID)] = pendingOperation{op: op, key: string(key), value: value}
+	store.locked[string(key)] = true
+	return nil
 }
 
 func (store *inMemoryStorage) Abort(transactionID []byte) bool {
-	_, found := store.precommit[string(transactionID)]
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	pending, found := store.precommit[string(transactionID)]
 	if !found {
 		return false
 	}
 
+	delete(store.locked, pending.key)
 	delete(store.precommit, string(transactionID))
 	return true
 }
 
+// IsDeleted reports whether key was removed by a committed delete and hasn't
+// been created again since.
+func (store *inMemoryStorage) IsDeleted(key []byte) bool {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.tombstones[string(key)]
+}
+
 func (store *inMemoryStorage) Merge(request []byte, response [][]byte) (result []byte, ok bool) {
 	results := make(map[string]interface{})
 
@@ -75,6 +144,9 @@ func (store *inMemoryStorage) Merge(request []byte, response [][]byte) (result [
 }
 
 func (store *inMemoryStorage) Stats() string {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
 	output := "In Memory Storage Statistics\n"
 
 	for k, v := range store.backend {
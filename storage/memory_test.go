@@ -3,6 +3,7 @@ package storage
 import (
 	"encoding/json"
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -89,6 +90,88 @@ func TestMemoryPrepareBad(t *testing.T) {
 
 }
 
+func TestMemoryPrepareOperation(t *testing.T) {
+	var data = []struct {
+		name     string
+		existing bool
+		op       Operation
+		expected error
+	}{
+		{"create missing", false, OpCreate, nil},
+		{"create existing", true, OpCreate, KeyExistsError},
+		{"update missing", false, OpUpdate, KeyNotFoundError},
+		{"update existing", true, OpUpdate, nil},
+		{"delete missing", false, OpDelete, KeyNotFoundError},
+		{"delete existing", true, OpDelete, nil},
+		{"unknown", true, Operation(99), UnknownOperationError},
+	}
+
+	for _, tc := range data {
+		m := NewInMemoryStorage()
+		if tc.existing {
+			m.PrepareOperation([]byte("setup"), OpCreate, testKey, testValue)
+			m.Commit([]byte("setup"))
+		}
+
+		err := m.PrepareOperation([]byte("tx"), tc.op, testKey, []byte("new"))
+		if err != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestMemoryOperationCommit(t *testing.T) {
+	m := NewInMemoryStorage()
+
+	m.PrepareOperation([]byte("1"), OpCreate, testKey, []byte("a"))
+	m.Commit([]byte("1"))
+	m.PrepareOperation([]byte("2"), OpUpdate, testKey, []byte("b"))
+	m.Commit([]byte("2"))
+
+	value, ok := m.Read(testKey)
+	if !ok || string(value) != "b" {
+		t.Fatalf("expected updated value b, got %q %t", value, ok)
+	}
+
+	m.PrepareOperation([]byte("3"), OpDelete, testKey, nil)
+	m.Commit([]byte("3"))
+
+	if _, ok := m.Read(testKey); ok {
+		t.Error("the key was still readable after a delete")
+	}
+
+	if !m.(*inMemoryStorage).IsDeleted(testKey) {
+		t.Error("the delete didn't leave a tombstone")
+	}
+
+	if err := m.PrepareOperation([]byte("4"), OpCreate, testKey, []byte("c")); err != nil {
+		t.Fatalf("couldn't recreate a deleted key: %s", err)
+	}
+	m.Commit([]byte("4"))
+
+	if m.(*inMemoryStorage).IsDeleted(testKey) {
+		t.Error("the tombstone survived the key being created again")
+	}
+}
+
+func TestMemoryOperationLocksKey(t *testing.T) {
+	m := NewInMemoryStorage()
+
+	if err := m.PrepareOperation([]byte("1"), OpCreate, testKey, testValue); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.PrepareOperation([]byte("2"), OpCreate, testKey, testValue); err != KeyLockedError {
+		t.Errorf("expected the key to be locked, got %v", err)
+	}
+
+	m.Abort([]byte("1"))
+
+	if err := m.PrepareOperation([]byte("2"), OpCreate, testKey, testValue); err != nil {
+		t.Errorf("the key was still locked after the abort: %s", err)
+	}
+}
+
 func TestMemoryCommitBad(t *testing.T) {
 	m := NewInMemoryStorage()
 	if m.Commit([]byte{3}) == nil {
@@ -126,3 +209,29 @@ func TestMemoryMerge(t *testing.T) {
 		t.Fatal("merge accepted invalid JSON")
 	}
 }
+
+// run with -race, transports read while transactions commit
+func TestMemoryConcurrentReadCommit(t *testing.T) {
+	m := NewInMemoryStorage()
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			id := []byte(strconv.Itoa(i))
+			m.PrepareOperation(id, OpCreate, id, testValue)
+			m.Commit(id)
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		m.Read([]byte(strconv.Itoa(i)))
+		m.(*inMemoryStorage).IsDeleted([]byte(strconv.Itoa(i)))
+	}
+	m.Stats()
+	<-done
+
+	if value, ok := m.Read([]byte("999")); !ok || string(value) != string(testValue) {
+		t.Errorf("the last commit was lost: %s %t", value, ok)
+	}
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Operation is the kind of change a transaction makes to a key
+type Operation int
+
+const (
+	// OpCreate stores a value under a key that must not exist yet
+	OpCreate Operation = iota
+	// OpUpdate replaces the value of a key that must already exist
+	OpUpdate
+	// OpDelete removes a key that must already exist, leaving a tombstone
+	OpDelete
+)
+
+var (
+	KeyExistsError         = errors.New("The key already exists")
+	KeyNotFoundError       = errors.New("The key doesn't exist")
+	KeyLockedError         = errors.New("The key is being changed by another transaction")
+	TransactionExistsError = errors.New("The transaction has already been prepared")
+	UnknownOperationError  = errors.New("The operation isn't supported")
+)
+
+var operationNames = map[Operation]string{
+	OpCreate: "create",
+	OpUpdate: "update",
+	OpDelete: "delete",
+}
+
+func (o Operation) String() string {
+	name, found := operationNames[o]
+	if !found {
+		return "operation(" + strconv.Itoa(int(o)) + ")"
+	}
+	return name
+}
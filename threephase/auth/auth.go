@@ -0,0 +1,148 @@
+// Package auth authenticates the messages nodes send each other during a
+// three phase commit with an HMAC keyed by a secret shared across the cluster.
+// Coordinators sign calls by wrapping their CommunicationHandler with
+// NewSigningHandler, participants check them by wrapping their
+// ThreePhaseCommit with NewVerifyingCommit and the storage they serve reads
+// from with NewVerifyingStorage.
+package auth
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	// MaxClockSkew is how far a message's timestamp may be from the
+	// receiver's clock, signatures are remembered this long to catch replays.
+	MaxClockSkew = time.Second * 30
+)
+
+var (
+	MissingSignatureError  = errors.New("The message isn't signed")
+	BadSignatureError      = errors.New("The message signature doesn't match")
+	ExpiredSignatureError  = errors.New("The message timestamp is outside the allowed clock skew")
+	ReplayedSignatureError = errors.New("The message has already been received")
+)
+
+// keyring signs and verifies messages with the shared cluster key
+type keyring struct {
+	key []byte
+	now func() time.Time
+
+	mutex sync.Mutex
+	seen  map[string]time.Time
+	// expiries holds the seen signatures soonest to expire first, so
+	// forgetting them doesn't mean walking all of seen
+	expiries signatureHeap
+}
+
+type signature struct {
+	mac     string
+	expires time.Time
+}
+
+// signatureHeap is a container/heap ordered by expiry
+type signatureHeap []signature
+
+func (h signatureHeap) Len() int            { return len(h) }
+func (h signatureHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h signatureHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *signatureHeap) Push(x interface{}) { *h = append(*h, x.(signature)) }
+
+func (h *signatureHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+func newKeyring(key []byte) *keyring {
+	return &keyring{
+		key:  key,
+		now:  time.Now,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Sealed messages look like timestamp.nonce.mac.payload where the mac covers
+// the kind of message, its destination and everything else.
+func (k *keyring) seal(kind threephase.MessageKind, destination string, payload []byte) ([]byte, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	timestamp := strconv.FormatInt(k.now().UnixNano(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	mac := k.mac(kind, destination, timestamp, nonceHex, payload)
+
+	sealed := timestamp + "." + nonceHex + "." + mac + "."
+	return append([]byte(sealed), payload...), nil
+}
+
+// open verifies a sealed message sent to destination and returns its payload
+func (k *keyring) open(kind threephase.MessageKind, destination string, sealed []byte) ([]byte, error) {
+	fields := strings.SplitN(string(sealed), ".", 4)
+	if len(fields) != 4 {
+		return nil, MissingSignatureError
+	}
+
+	timestamp, nonce, mac := fields[0], fields[1], fields[2]
+	payload := sealed[len(timestamp)+len(nonce)+len(mac)+3:]
+
+	expected := k.mac(kind, destination, timestamp, nonce, payload)
+	if !hmac.Equal([]byte(mac), []byte(expected)) {
+		return nil, BadSignatureError
+	}
+
+	nanos, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, BadSignatureError
+	}
+
+	now := k.now()
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.forget(now)
+
+	sent := time.Unix(0, nanos)
+	if sent.Before(now.Add(-MaxClockSkew)) || sent.After(now.Add(MaxClockSkew)) {
+		return nil, ExpiredSignatureError
+	}
+
+	if _, found := k.seen[mac]; found {
+		return nil, ReplayedSignatureError
+	}
+	k.seen[mac] = sent.Add(MaxClockSkew)
+	heap.Push(&k.expiries, signature{mac: mac, expires: k.seen[mac]})
+
+	return payload, nil
+}
+
+// forget drops the signatures that have expired by now, the caller must hold
+// the mutex
+func (k *keyring) forget(now time.Time) {
+	for k.expiries.Len() > 0 && now.After(k.expiries[0].expires) {
+		expired := heap.Pop(&k.expiries).(signature)
+		delete(k.seen, expired.mac)
+	}
+}
+
+func (k *keyring) mac(kind threephase.MessageKind, destination, timestamp, nonce string, payload []byte) string {
+	h := hmac.New(sha256.New, k.key)
+	h.Write([]byte(kind.String() + "\n" + destination + "\n" + timestamp + "\n" + nonce + "\n"))
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var testKey = []byte("cluster secret")
+
+func TestSealOpen(t *testing.T) {
+	signer := newKeyring(testKey)
+	sealed, err := signer.seal(threephase.MessageAbort, "a:1", []byte("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] = '5'
+
+	var data = []struct {
+		name        string
+		key         []byte
+		kind        threephase.MessageKind
+		destination string
+		sealed      []byte
+		expected    error
+	}{
+		{"unsigned", testKey, threephase.MessageAbort, "a:1", []byte("1234"), MissingSignatureError},
+		{"wrong key", []byte("other"), threephase.MessageAbort, "a:1", sealed, BadSignatureError},
+		{"wrong kind", testKey, threephase.MessageCommit, "a:1", sealed, BadSignatureError},
+		{"wrong destination", testKey, threephase.MessageAbort, "b:2", sealed, BadSignatureError},
+		{"tampered", testKey, threephase.MessageAbort, "a:1", tampered, BadSignatureError},
+		{"valid", testKey, threephase.MessageAbort, "a:1", sealed, nil},
+	}
+
+	for _, tc := range data {
+		verifier := newKeyring(tc.key)
+		payload, err := verifier.open(tc.kind, tc.destination, tc.sealed)
+		if err != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, err)
+		}
+
+		if err == nil && string(payload) != "1234" {
+			t.Errorf("%s: expected payload 1234 got %q", tc.name, payload)
+		}
+	}
+}
+
+func TestOpenReplay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	keys := newKeyring(testKey)
+	keys.now = func() time.Time { return now }
+
+	sealed, _ := keys.seal(threephase.MessageCommit, "a:1", []byte("1234"))
+
+	if _, err := keys.open(threephase.MessageCommit, "a:1", sealed); err != nil {
+		t.Fatalf("couldn't open the message the first time: %s", err)
+	}
+
+	if _, err := keys.open(threephase.MessageCommit, "a:1", sealed); err != ReplayedSignatureError {
+		t.Errorf("expected the replay to be caught, got %v", err)
+	}
+
+	now = now.Add(MaxClockSkew + time.Second)
+	if _, err := keys.open(threephase.MessageCommit, "a:1", sealed); err != ExpiredSignatureError {
+		t.Errorf("expected the message to have expired, got %v", err)
+	}
+
+	if len(keys.seen) != 0 || keys.expiries.Len() != 0 {
+		t.Errorf("expired signatures weren't forgotten: %d left", len(keys.seen))
+	}
+}
+
+func TestOpenForgetsInExpiryOrder(t *testing.T) {
+	now := time.Unix(1000, 0)
+	keys := newKeyring(testKey)
+
+	// signed out of order, each a second apart
+	var sealed [][]byte
+	for _, offset := range []int{3, 1, 2} {
+		keys.now = func() time.Time { return now.Add(time.Duration(offset) * time.Second) }
+		message, _ := keys.seal(threephase.MessageCommit, "a:1", []byte("1234"))
+		sealed = append(sealed, message)
+	}
+
+	keys.now = func() time.Time { return now }
+	for _, message := range sealed {
+		if _, err := keys.open(threephase.MessageCommit, "a:1", message); err != nil {
+			t.Fatalf("couldn't open a message: %s", err)
+		}
+	}
+
+	for i, expected := range []int{2, 1, 0} {
+		keys.forget(now.Add(MaxClockSkew + time.Duration(i+1)*time.Second + time.Millisecond))
+		if len(keys.seen) != expected {
+			t.Errorf("%d seconds after expiry started: expected %d signatures remembered got %d", i+1, expected, len(keys.seen))
+		}
+	}
+}
+
+func TestOpenFutureTimestamp(t *testing.T) {
+	now := time.Unix(1000, 0)
+	signer := newKeyring(testKey)
+	signer.now = func() time.Time { return now.Add(MaxClockSkew * 2) }
+
+	verifier := newKeyring(testKey)
+	verifier.now = func() time.Time { return now }
+
+	sealed, _ := signer.seal(threephase.MessageInit, "a:1", []byte("tx"))
+	if _, err := verifier.open(threephase.MessageInit, "a:1", sealed); err != ExpiredSignatureError {
+		t.Errorf("expected a message from the future to be refused, got %v", err)
+	}
+}
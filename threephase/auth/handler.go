@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"log"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	NoCodecsError = errors.New("The wrapped handler can't negotiate codecs")
+)
+
+type signingHandler struct {
+	keys *keyring
+	comm threephase.CommunicationHandler
+}
+
+// NewSigningHandler wraps comm so every call it makes, reads included, is
+// signed with key.
+func NewSigningHandler(key []byte, comm threephase.CommunicationHandler) threephase.CommunicationHandler {
+	return &signingHandler{keys: newKeyring(key), comm: comm}
+}
+
+func (this *signingHandler) call(kind threephase.MessageKind, callback func([]byte, string) (bool, error), request []byte, destination string) (bool, error) {
+	sealed, err := this.keys.seal(kind, destination, request)
+	if err != nil {
+		return false, err
+	}
+
+	return callback(sealed, destination)
+}
+
+func (this *signingHandler) InitializeTransaction(tx []byte, destination string) (ok bool, err error) {
+	return this.call(threephase.MessageInit, this.comm.InitializeTransaction, tx, destination)
+}
+
+func (this *signingHandler) Abort(transactionID []byte, destination string) (ok bool, err error) {
+	return this.call(threephase.MessageAbort, this.comm.Abort, transactionID, destination)
+}
+
+func (this *signingHandler) DoCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return this.call(threephase.MessageCommit, this.comm.DoCommit, transactionID, destination)
+}
+
+func (this *signingHandler) PreCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return this.call(threephase.MessagePreCommit, this.comm.PreCommit, transactionID, destination)
+}
+
+func (this *signingHandler) CheckCommit(transactionID []byte, destination string) (didcommit bool, err error) {
+	return this.call(threephase.MessageCheck, this.comm.CheckCommit, transactionID, destination)
+}
+
+func (this *signingHandler) ReadData(request []byte, destination string) (result []byte, err error) {
+	sealed, err := this.keys.seal(threephase.MessageRead, destination, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.comm.ReadData(sealed, destination)
+}
+
+// Codecs passes negotiation through so wrapping doesn't force JSON
+func (this *signingHandler) Codecs(destination string) ([]string, error) {
+	negotiator, ok := this.comm.(threephase.CodecNegotiator)
+	if !ok {
+		return nil, NoCodecsError
+	}
+	return negotiator.Codecs(destination)
+}
+
+type verifyingCommit struct {
+	threephase.ThreePhaseCommit
+	keys *keyring
+	self string
+}
+
+// NewVerifyingCommit wraps tpc so the participant calls only go through if
+// they were signed with key for the host self, the name coordinators use to
+// reach this node. Anything unsigned, forged, stale or replayed is refused.
+func NewVerifyingCommit(key []byte, self string, tpc threephase.ThreePhaseCommit) threephase.ThreePhaseCommit {
+	return &verifyingCommit{ThreePhaseCommit: tpc, keys: newKeyring(key), self: self}
+}
+
+func (this *verifyingCommit) open(kind threephase.MessageKind, sealed []byte) ([]byte, bool) {
+	payload, err := this.keys.open(kind, this.self, sealed)
+	if err != nil {
+		log.Printf("auth: refusing %s message: %s\n", kind, err)
+		return nil, false
+	}
+	return payload, true
+}
+
+func (this *verifyingCommit) InitializeTransaction(transaction []byte) (ok bool) {
+	payload, ok := this.open(threephase.MessageInit, transaction)
+	return ok && this.ThreePhaseCommit.InitializeTransaction(payload)
+}
+
+func (this *verifyingCommit) Abort(transactionID string) (ok bool) {
+	payload, ok := this.open(threephase.MessageAbort, []byte(transactionID))
+	return ok && this.ThreePhaseCommit.Abort(string(payload))
+}
+
+func (this *verifyingCommit) DoCommit(transactionID string) (ok bool) {
+	payload, ok := this.open(threephase.MessageCommit, []byte(transactionID))
+	return ok && this.ThreePhaseCommit.DoCommit(string(payload))
+}
+
+func (this *verifyingCommit) PreCommit(transactionID string) (ok bool) {
+	payload, ok := this.open(threephase.MessagePreCommit, []byte(transactionID))
+	return ok && this.ThreePhaseCommit.PreCommit(string(payload))
+}
+
+func (this *verifyingCommit) CheckCommit(transactionID string) (didcommit bool) {
+	payload, ok := this.open(threephase.MessageCheck, []byte(transactionID))
+	return ok && this.ThreePhaseCommit.CheckCommit(string(payload))
+}
+
+type verifyingStorage struct {
+	storage.Storage
+	keys *keyring
+	self string
+}
+
+// NewVerifyingStorage wraps db so reads only go through if they were signed
+// with key for the host self. Transports serve reads straight from storage,
+// so give them this alongside the verifying commit.
+func NewVerifyingStorage(key []byte, self string, db storage.Storage) storage.Storage {
+	return &verifyingStorage{Storage: db, keys: newKeyring(key), self: self}
+}
+
+func (this *verifyingStorage) Read(request []byte) (value []byte, ok bool) {
+	payload, err := this.keys.open(threephase.MessageRead, this.self, request)
+	if err != nil {
+		log.Printf("auth: refusing %s message: %s\n", threephase.MessageRead, err)
+		return nil, false
+	}
+	return this.Storage.Read(payload)
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var testHosts = []string{"a:1", "b:2", "c:3"}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// loopback delivers calls straight to the participants in the same process
+type loopback struct {
+	nodes map[string]threephase.ThreePhaseCommit
+	dbs   map[string]storage.Storage
+}
+
+func (l *loopback) InitializeTransaction(tx []byte, destination string) (bool, error) {
+	return l.nodes[destination].InitializeTransaction(tx), nil
+}
+
+func (l *loopback) Abort(id []byte, destination string) (bool, error) {
+	return l.nodes[destination].Abort(string(id)), nil
+}
+
+func (l *loopback) DoCommit(id []byte, destination string) (bool, error) {
+	return l.nodes[destination].DoCommit(string(id)), nil
+}
+
+func (l *loopback) PreCommit(id []byte, destination string) (bool, error) {
+	return l.nodes[destination].PreCommit(string(id)), nil
+}
+
+func (l *loopback) CheckCommit(id []byte, destination string) (bool, error) {
+	return l.nodes[destination].CheckCommit(string(id)), nil
+}
+
+func (l *loopback) ReadData(request []byte, destination string) ([]byte, error) {
+	value, ok := l.dbs[destination].Read(request)
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return value, nil
+}
+
+func (l *loopback) GetCreateSet() ([]string, error) { return testHosts, nil }
+func (l *loopback) GetReadSet() ([]string, error)   { return testHosts, nil }
+func (l *loopback) GetUpdateSet() ([]string, error) { return testHosts, nil }
+func (l *loopback) GetDeleteSet() ([]string, error) { return testHosts, nil }
+
+func newCluster(coordinatorKey []byte) (threephase.ThreePhaseCommit, map[string]storage.Storage) {
+	network := &loopback{nodes: make(map[string]threephase.ThreePhaseCommit), dbs: make(map[string]storage.Storage)}
+	dbs := make(map[string]storage.Storage)
+
+	for _, host := range testHosts {
+		dbs[host] = storage.NewInMemoryStorage()
+		tpc := threephase.NewThreePhaseCommit(network, dbs[host], network)
+		network.nodes[host] = NewVerifyingCommit(testKey, host, tpc)
+		network.dbs[host] = NewVerifyingStorage(testKey, host, dbs[host])
+	}
+
+	coordinator := threephase.NewThreePhaseCommit(NewSigningHandler(coordinatorKey, network), storage.NewInMemoryStorage(), network)
+	return coordinator, dbs
+}
+
+func TestSignedCommit(t *testing.T) {
+	coordinator, dbs := newCluster(testKey)
+
+	if !coordinator.CommitTx("1", []byte("value"), testHosts) {
+		t.Fatal("a signed transaction didn't commit")
+	}
+
+	for host, db := range dbs {
+		if value, ok := db.Read([]byte("1")); !ok || string(value) != "value" {
+			t.Errorf("%s: expected value got %q %t", host, value, ok)
+		}
+	}
+}
+
+func TestWrongKeyRefused(t *testing.T) {
+	coordinator, dbs := newCluster([]byte("not the cluster key"))
+
+	if coordinator.CommitTx("1", []byte("value"), testHosts) {
+		t.Fatal("a transaction signed with the wrong key committed")
+	}
+
+	for host, db := range dbs {
+		if _, ok := db.Read([]byte("1")); ok {
+			t.Errorf("%s: stored a transaction signed with the wrong key", host)
+		}
+	}
+}
+
+func TestUnsignedParticipantCalls(t *testing.T) {
+	tpc := NewVerifyingCommit(testKey, "a:1", threephase.NewThreePhaseCommit(&loopback{}, storage.NewInMemoryStorage(), &loopback{}))
+	defer tpc.Close()
+
+	if tpc.InitializeTransaction([]byte(`{"TransactionID":"1"}`)) {
+		t.Error("initialized an unsigned transaction")
+	}
+
+	if tpc.Abort("1") || tpc.DoCommit("1") || tpc.PreCommit("1") || tpc.CheckCommit("1") {
+		t.Error("accepted an unsigned call")
+	}
+}
+
+func TestSignedReads(t *testing.T) {
+	db := storage.NewInMemoryStorage()
+	db.PrepareOperation([]byte("1"), storage.OpCreate, []byte("key"), []byte("value"))
+	db.Commit([]byte("1"))
+
+	network := &loopback{dbs: map[string]storage.Storage{"a:1": NewVerifyingStorage(testKey, "a:1", db)}}
+
+	var data = []struct {
+		name     string
+		comm     threephase.CommunicationHandler
+		expected bool
+	}{
+		{"cluster key", NewSigningHandler(testKey, network), true},
+		{"wrong key", NewSigningHandler([]byte("not the cluster key"), network), false},
+		{"unsigned", network, false},
+	}
+
+	for _, tc := range data {
+		value, err := tc.comm.ReadData([]byte("key"), "a:1")
+		if ok := err == nil && string(value) == "value"; ok != tc.expected {
+			t.Errorf("%s: expected read to succeed: %t got %q %v", tc.name, tc.expected, value, err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package threephase
+
+import "time"
+
+// Clock is where a ThreePhaseCommit gets the time from and schedules its
+// timeouts on. Simulations swap it for a virtual clock so runs are repeatable.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// AfterFunc runs task once delay has passed
+	AfterFunc(delay time.Duration, task func())
+
+	// Stop discards any pending tasks, none are run after it returns
+	Stop() error
+}
+
+// NewRealClock returns a Clock backed by the system time. Every task is queued
+// on a single scheduler goroutine until it's due.
+func NewRealClock() Clock {
+	return newScheduler()
+}
@@ -0,0 +1,334 @@
+package threephase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+
+	"github.com/josephlewis42/historia/storage"
+)
+
+// Codec turns transactions into bytes for the wire and back again. Encoded
+// transactions are self describing so a participant can decode anything a
+// coordinator sends it no matter which codec was picked.
+type Codec interface {
+	// Name is what the codec is called during negotiation
+	Name() string
+	Encode(tx *ThreePhaseTransaction) ([]byte, error)
+	Decode(data []byte, tx *ThreePhaseTransaction) error
+}
+
+var (
+	UnknownCodecError   = errors.New("The transaction was encoded with an unknown codec")
+	TruncatedCodecError = errors.New("The encoded transaction was truncated")
+)
+
+// Tags prefixed to encoded transactions. JSON isn't tagged so nodes that only
+// speak plain JSON can still read it, it's recognized by its opening brace.
+const (
+	gobCodecTag    byte = 0x01
+	binaryCodecTag byte = 0x02
+)
+
+var (
+	JSONCodec   Codec = jsonCodec{}
+	GobCodec    Codec = gobCodec{}
+	BinaryCodec Codec = binaryCodec{}
+
+	// DefaultCodecs lists the codecs in order of preference, JSON is last
+	// because it's the largest but it's understood by every node.
+	DefaultCodecs = []Codec{BinaryCodec, GobCodec, JSONCodec}
+)
+
+// DecodeTransaction decodes a transaction produced by any of the codecs
+func DecodeTransaction(data []byte, tx *ThreePhaseTransaction) error {
+	if len(data) == 0 {
+		return TruncatedCodecError
+	}
+
+	switch data[0] {
+	case '{':
+		return JSONCodec.Decode(data, tx)
+	case gobCodecTag:
+		return GobCodec.Decode(data, tx)
+	case binaryCodecTag:
+		return BinaryCodec.Decode(data, tx)
+	}
+
+	return UnknownCodecError
+}
+
+// NegotiateCodec returns the first of the preferred codecs every remote node
+// supports, remotes lists the codec names each node reported. It falls back
+// to JSON if there's nothing in common.
+func NegotiateCodec(preferred []Codec, remotes ...[]string) Codec {
+	for _, codec := range preferred {
+		if supportedByAll(codec.Name(), remotes) {
+			return codec
+		}
+	}
+
+	return JSONCodec
+}
+
+func supportedByAll(name string, remotes [][]string) bool {
+	for _, names := range remotes {
+		found := false
+		for _, remote := range names {
+			if remote == name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CodecNames returns the names of the given codecs
+func CodecNames(codecs []Codec) []string {
+	names := []string{}
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+	return names
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Encode(tx *ThreePhaseTransaction) ([]byte, error) {
+	return json.Marshal(tx)
+}
+
+func (jsonCodec) Decode(data []byte, tx *ThreePhaseTransaction) error {
+	return json.Unmarshal(data, tx)
+}
+
+type gobCodec struct{}
+
+// gobTransaction marks the byte slices that were empty rather than nil, gob
+// sends both as nothing.
+type gobTransaction struct {
+	Transaction         ThreePhaseTransaction
+	EmptyKey, EmptyData bool
+}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Encode(tx *ThreePhaseTransaction) ([]byte, error) {
+	wrapped := gobTransaction{
+		Transaction: *tx,
+		EmptyKey:    tx.Key != nil && len(tx.Key) == 0,
+		EmptyData:   tx.Data != nil && len(tx.Data) == 0,
+	}
+
+	buf := bytes.NewBuffer([]byte{gobCodecTag})
+	err := gob.NewEncoder(buf).Encode(&wrapped)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Decode(data []byte, tx *ThreePhaseTransaction) error {
+	if len(data) == 0 || data[0] != gobCodecTag {
+		return UnknownCodecError
+	}
+
+	var wrapped gobTransaction
+	if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&wrapped); err != nil {
+		return err
+	}
+
+	if wrapped.EmptyKey {
+		wrapped.Transaction.Key = []byte{}
+	}
+
+	if wrapped.EmptyData {
+		wrapped.Transaction.Data = []byte{}
+	}
+
+	// gob leaves out zero fields so copy everything rather than decoding over tx
+	phase := tx.phase
+	*tx = wrapped.Transaction
+	tx.phase = phase
+	return nil
+}
+
+// binaryCodec writes each field as a uvarint length followed by its bytes:
+//
+//	tag | id | hasData data | operation | hasKey key | numPeers peer... |
+//	numConstraints (label numValues value... exclude)...
+//
+// Nil data and keys are kept distinct from empty ones like the other codecs
+// do, a nil key means the transaction ID is used instead. The constraints are left off when there
+// aren't any, so older nodes can still read unplaced transactions.
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Encode(tx *ThreePhaseTransaction) ([]byte, error) {
+	buf := []byte{binaryCodecTag}
+	buf = appendBytes(buf, []byte(tx.TransactionID))
+	buf = appendOptionalBytes(buf, tx.Data)
+	buf = binary.AppendUvarint(buf, uint64(tx.Operation))
+	buf = appendOptionalBytes(buf, tx.Key)
+
+	buf = binary.AppendUvarint(buf, uint64(len(tx.Peers)))
+	for _, peer := range tx.Peers {
+		buf = appendBytes(buf, []byte(peer))
+	}
+
+	if len(tx.Placement) == 0 {
+		return buf, nil
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(tx.Placement)))
+	for _, constraint := range tx.Placement {
+		buf = appendBytes(buf, []byte(constraint.Label))
+		buf = binary.AppendUvarint(buf, uint64(len(constraint.Values)))
+		for _, value := range constraint.Values {
+			buf = appendBytes(buf, []byte(value))
+		}
+
+		if constraint.Exclude {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+
+	return buf, nil
+}
+
+func (binaryCodec) Decode(data []byte, tx *ThreePhaseTransaction) error {
+	if len(data) == 0 || data[0] != binaryCodecTag {
+		return UnknownCodecError
+	}
+
+	r := binaryReader{data: data[1:]}
+
+	tx.TransactionID = string(r.bytes())
+	tx.Data = r.optionalBytes()
+	tx.Operation = storage.Operation(r.uvarint())
+	tx.Key = r.optionalBytes()
+
+	numPeers := r.uvarint()
+	tx.Peers = nil
+	for i := uint64(0); i < numPeers && r.err == nil; i++ {
+		tx.Peers = append(tx.Peers, string(r.bytes()))
+	}
+
+	tx.Placement = nil
+	if r.err != nil || len(r.data) == 0 {
+		return r.err
+	}
+
+	numConstraints := r.uvarint()
+	for i := uint64(0); i < numConstraints && r.err == nil; i++ {
+		constraint := Constraint{Label: string(r.bytes())}
+		numValues := r.uvarint()
+		for j := uint64(0); j < numValues && r.err == nil; j++ {
+			constraint.Values = append(constraint.Values, string(r.bytes()))
+		}
+		constraint.Exclude = r.byte() == 1
+		tx.Placement = append(tx.Placement, constraint)
+	}
+
+	return r.err
+}
+
+func appendBytes(buf, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// appendOptionalBytes writes a presence byte before value so nil survives
+func appendOptionalBytes(buf, value []byte) []byte {
+	if value == nil {
+		return append(buf, 0)
+	}
+
+	buf = append(buf, 1)
+	return appendBytes(buf, value)
+}
+
+// binaryReader reads fields written by binaryCodec, after the first error
+// every read returns the zero value.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = TruncatedCodecError
+		return 0
+	}
+
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+
+	if len(r.data) == 0 {
+		r.err = TruncatedCodecError
+		return 0
+	}
+
+	value := r.data[0]
+	r.data = r.data[1:]
+	return value
+}
+
+func (r *binaryReader) bytes() []byte {
+	length := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+
+	if uint64(len(r.data)) < length {
+		r.err = TruncatedCodecError
+		return nil
+	}
+
+	if length == 0 {
+		return nil
+	}
+
+	value := append([]byte{}, r.data[:length]...)
+	r.data = r.data[length:]
+	return value
+}
+
+func (r *binaryReader) optionalBytes() []byte {
+	if r.byte() != 1 {
+		return nil
+	}
+
+	value := r.bytes()
+	if value == nil && r.err == nil {
+		return []byte{}
+	}
+	return value
+}
@@ -0,0 +1,219 @@
+package threephase
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/storage"
+)
+
+var codecTransaction = ThreePhaseTransaction{
+	Peers:         []string{"a:1", "b:2", "c:3"},
+	Data:          []byte{0xff, 0x00, 0xfe, 'x'},
+	TransactionID: "1234",
+	Operation:     storage.OpUpdate,
+	Key:           []byte("key"),
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	var data = []struct {
+		key       []byte
+		data      []byte
+		placement Placement
+	}{
+		{nil, codecTransaction.Data, nil},
+		{[]byte("key"), codecTransaction.Data, nil},
+		{[]byte{0x80, 0x81}, codecTransaction.Data, nil},
+		{[]byte{}, codecTransaction.Data, nil},
+		{[]byte("key"), []byte{}, nil},
+		{[]byte("key"), nil, nil},
+		{[]byte{}, []byte{}, nil},
+		{[]byte("key"), codecTransaction.Data, Placement{{Label: "region", Values: []string{"eu", "uk"}}, {Label: "zone", Values: []string{"a"}, Exclude: true}}},
+	}
+
+	for _, codec := range DefaultCodecs {
+		for _, tc := range data {
+			tx := codecTransaction
+			tx.Key = tc.key
+			tx.Data = tc.data
+			tx.Placement = tc.placement
+
+			encoded, err := codec.Encode(&tx)
+			if err != nil {
+				t.Fatalf("%s: couldn't encode: %s", codec.Name(), err)
+			}
+
+			var decoded ThreePhaseTransaction
+			if err := DecodeTransaction(encoded, &decoded); err != nil {
+				t.Fatalf("%s: couldn't decode: %s", codec.Name(), err)
+			}
+
+			if !reflect.DeepEqual(tx, decoded) {
+				t.Errorf("%s: expected %+v got %+v", codec.Name(), tx, decoded)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecKeepsEmptyKey(t *testing.T) {
+	tx := codecTransaction
+	tx.Key = []byte{}
+
+	encoded, _ := BinaryCodec.Encode(&tx)
+
+	var decoded ThreePhaseTransaction
+	BinaryCodec.Decode(encoded, &decoded)
+
+	if decoded.Key == nil {
+		t.Error("an empty key was decoded as nil")
+	}
+}
+
+func TestBinaryCodecIsSmaller(t *testing.T) {
+	binary, _ := BinaryCodec.Encode(&codecTransaction)
+	json, _ := JSONCodec.Encode(&codecTransaction)
+
+	if len(binary) >= len(json) {
+		t.Errorf("binary encoding was %d bytes, json was %d", len(binary), len(json))
+	}
+}
+
+func TestDecodeTransactionBad(t *testing.T) {
+	encoded, _ := BinaryCodec.Encode(&codecTransaction)
+
+	var data = []struct {
+		name     string
+		input    []byte
+		expected error
+	}{
+		{"empty", []byte{}, TruncatedCodecError},
+		{"unknown tag", []byte{0x7f, 1, 2}, UnknownCodecError},
+		{"truncated", encoded[:len(encoded)-2], TruncatedCodecError},
+	}
+
+	for _, tc := range data {
+		var tx ThreePhaseTransaction
+		if err := DecodeTransaction(tc.input, &tx); err != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	var data = []struct {
+		remotes  [][]string
+		expected Codec
+	}{
+		{[][]string{}, BinaryCodec},
+		{[][]string{{"binary", "json"}, {"binary"}}, BinaryCodec},
+		{[][]string{{"binary", "gob"}, {"gob", "json"}}, GobCodec},
+		{[][]string{{"binary"}, {"gob"}}, JSONCodec},
+		{[][]string{{}}, JSONCodec},
+	}
+
+	for _, tc := range data {
+		result := NegotiateCodec(DefaultCodecs, tc.remotes...)
+		if result != tc.expected {
+			t.Errorf("%v: expected %s got %s", tc.remotes, tc.expected.Name(), result.Name())
+		}
+	}
+}
+
+// negotiatingComm reports a fixed set of codecs for every node and records
+// the transactions it's asked to send.
+type negotiatingComm struct {
+	fakeCommunicationHandler
+	codecs []string
+	sent   [][]byte
+}
+
+func (n *negotiatingComm) Codecs(destination string) ([]string, error) {
+	return n.codecs, nil
+}
+
+func (n *negotiatingComm) InitializeTransaction(tx []byte, destination string) (bool, error) {
+	n.sent = append(n.sent, tx)
+	return true, nil
+}
+
+func TestCommitTxNegotiatesCodec(t *testing.T) {
+	comm := &negotiatingComm{fakeCommunicationHandler: newFakeComm(testHosts), codecs: []string{"gob", "json"}}
+	tpc := newThreePhaseInternal(comm, storage.NewInMemoryStorage(), comm, NewRealClock())
+	defer tpc.Close()
+
+	if !tpc.CommitTx("1", []byte("data"), testHosts) {
+		t.Fatal("the transaction didn't commit")
+	}
+
+	for _, sent := range comm.sent {
+		if sent[0] != gobCodecTag {
+			t.Errorf("expected the transaction to be sent with gob, got %v", sent)
+		}
+	}
+}
+
+// loopbackComm answers codec requests by asking tpc, the way a node that's in
+// its own node set does over the network, and fails for the other hosts.
+type loopbackComm struct {
+	fakeCommunicationHandler
+	tpc   ThreePhaseCommit
+	self  string
+	asked map[string]int
+}
+
+func (n *loopbackComm) Codecs(destination string) ([]string, error) {
+	n.asked[destination]++
+	if destination == n.self {
+		return n.tpc.SupportedCodecs(), nil
+	}
+	return nil, errors.New("unreachable")
+}
+
+func (n *loopbackComm) Self() string {
+	return n.self
+}
+
+// the node set doesn't know which node is us so we're asked over the network
+func TestNegotiateCodecDoesntHoldLock(t *testing.T) {
+	comm := &loopbackComm{fakeCommunicationHandler: newFakeComm(testHosts), asked: make(map[string]int)}
+	tpc := newThreePhaseInternal(comm, storage.NewInMemoryStorage(), &comm.fakeCommunicationHandler, NewRealClock())
+	defer tpc.Close()
+	comm.tpc = tpc
+	comm.self = testHosts[0]
+
+	done := make(chan Codec)
+	go func() { done <- tpc.negotiateCodec(testHosts[:1]) }()
+
+	select {
+	case codec := <-done:
+		if codec != BinaryCodec {
+			t.Errorf("expected binary got %s", codec.Name())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("asking ourselves for our codecs deadlocked")
+	}
+}
+
+func TestNegotiateCodecAnswersSelfAndCachesFailures(t *testing.T) {
+	comm := &loopbackComm{fakeCommunicationHandler: newFakeComm(testHosts), asked: make(map[string]int)}
+	tpc := newThreePhaseInternal(comm, storage.NewInMemoryStorage(), comm, NewRealClock())
+	defer tpc.Close()
+	comm.tpc = tpc
+	comm.self = testHosts[0]
+
+	for i := 0; i < 3; i++ {
+		if codec := tpc.negotiateCodec(testHosts); codec != JSONCodec {
+			t.Errorf("expected to fall back to json, got %s", codec.Name())
+		}
+	}
+
+	if comm.asked[testHosts[0]] != 0 {
+		t.Error("we asked ourselves over the network")
+	}
+
+	if comm.asked[testHosts[1]] != 1 {
+		t.Errorf("expected the failed lookup to be cached, asked %d times", comm.asked[testHosts[1]])
+	}
+}
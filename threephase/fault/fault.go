@@ -0,0 +1,239 @@
+// Package fault wraps a threephase.CommunicationHandler so calls can be
+// dropped, delayed, duplicated or reordered and hosts partitioned from each
+// other, for testing how the protocol copes with an unreliable network.
+package fault
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	DroppedError     = errors.New("The message was dropped by the fault injector")
+	PartitionedError = errors.New("The destination is on the other side of a partition")
+	NoCodecsError    = errors.New("The wrapped handler can't negotiate codecs")
+)
+
+// Injector holds the fault policy and partitions shared by every
+// CommunicationHandler it wraps, so a single Injector can describe the network
+// of a whole cluster.
+type Injector struct {
+	mutex  sync.Mutex
+	policy Policy
+	groups map[string]int
+	held   map[string][]chan struct{}
+}
+
+// NewInjector creates an Injector that applies policy to every call, a nil
+// policy delivers everything.
+func NewInjector(policy Policy) *Injector {
+	if policy == nil {
+		policy = PassThrough
+	}
+
+	return &Injector{
+		policy: policy,
+		held:   make(map[string][]chan struct{}),
+	}
+}
+
+// SetPolicy replaces the policy for calls made from now on
+func (i *Injector) SetPolicy(policy Policy) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if policy == nil {
+		policy = PassThrough
+	}
+	i.policy = policy
+}
+
+// Partition splits the named hosts into groups that can only talk amongst
+// themselves. Hosts that aren't in any group can still reach everyone. Calling
+// Partition again replaces the previous partition.
+func (i *Injector) Partition(groups ...[]string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.groups = make(map[string]int)
+	for id, group := range groups {
+		for _, host := range group {
+			i.groups[host] = id
+		}
+	}
+}
+
+// Heal removes any partition
+func (i *Injector) Heal() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.groups = nil
+}
+
+// Wrap returns a CommunicationHandler that sends through comm on behalf of the
+// host named source, subject to the injector's faults.
+func (i *Injector) Wrap(source string, comm threephase.CommunicationHandler) threephase.CommunicationHandler {
+	return &faultyHandler{injector: i, source: source, comm: comm}
+}
+
+func (i *Injector) partitioned(source, destination string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	sourceGroup, sourceFound := i.groups[source]
+	destinationGroup, destinationFound := i.groups[destination]
+
+	return sourceFound && destinationFound && sourceGroup != destinationGroup
+}
+
+func (i *Injector) decide(call Call) Decision {
+	i.mutex.Lock()
+	policy := i.policy
+	i.mutex.Unlock()
+
+	return policy.Decide(call)
+}
+
+// hold blocks until another call to destination is delivered or window
+// passes, whichever comes first.
+func (i *Injector) hold(destination string, window time.Duration) {
+	release := make(chan struct{})
+
+	i.mutex.Lock()
+	i.held[destination] = append(i.held[destination], release)
+	i.mutex.Unlock()
+
+	select {
+	case <-release:
+	case <-time.After(window):
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+
+		waiting := i.held[destination]
+		for index, ch := range waiting {
+			if ch == release {
+				i.held[destination] = append(waiting[:index], waiting[index+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// delivered releases any calls being held back for destination
+func (i *Injector) delivered(destination string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for _, release := range i.held[destination] {
+		close(release)
+	}
+	delete(i.held, destination)
+}
+
+// invoke runs send according to the injector's partitions and policy
+func (i *Injector) invoke(call Call, send func() (bool, error)) (ok bool, err error) {
+	if i.partitioned(call.Source, call.Destination) {
+		return false, PartitionedError
+	}
+
+	decision := i.decide(call)
+
+	switch decision.Action {
+	case Drop:
+		return false, DroppedError
+
+	case Delay:
+		time.Sleep(decision.Delay)
+
+	case Reorder:
+		i.hold(call.Destination, decision.Delay)
+		return send()
+
+	case Duplicate:
+		ok, err = send()
+		i.delivered(call.Destination)
+		send()
+		return ok, err
+	}
+
+	ok, err = send()
+	i.delivered(call.Destination)
+	return ok, err
+}
+
+type faultyHandler struct {
+	injector *Injector
+	source   string
+	comm     threephase.CommunicationHandler
+}
+
+func (f *faultyHandler) call(kind threephase.MessageKind, payload []byte, destination string, send func() (bool, error)) (bool, error) {
+	call := Call{Source: f.source, Destination: destination, Kind: kind, Payload: payload}
+	return f.injector.invoke(call, send)
+}
+
+func (f *faultyHandler) InitializeTransaction(tx []byte, destination string) (ok bool, err error) {
+	return f.call(threephase.MessageInit, tx, destination, func() (bool, error) {
+		return f.comm.InitializeTransaction(tx, destination)
+	})
+}
+
+func (f *faultyHandler) Abort(transactionID []byte, destination string) (ok bool, err error) {
+	return f.call(threephase.MessageAbort, transactionID, destination, func() (bool, error) {
+		return f.comm.Abort(transactionID, destination)
+	})
+}
+
+func (f *faultyHandler) DoCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return f.call(threephase.MessageCommit, transactionID, destination, func() (bool, error) {
+		return f.comm.DoCommit(transactionID, destination)
+	})
+}
+
+func (f *faultyHandler) PreCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return f.call(threephase.MessagePreCommit, transactionID, destination, func() (bool, error) {
+		return f.comm.PreCommit(transactionID, destination)
+	})
+}
+
+func (f *faultyHandler) CheckCommit(transactionID []byte, destination string) (didcommit bool, err error) {
+	return f.call(threephase.MessageCheck, transactionID, destination, func() (bool, error) {
+		return f.comm.CheckCommit(transactionID, destination)
+	})
+}
+
+func (f *faultyHandler) ReadData(request []byte, destination string) (result []byte, err error) {
+	_, err = f.call(threephase.MessageRead, request, destination, func() (bool, error) {
+		var readErr error
+		result, readErr = f.comm.ReadData(request, destination)
+		return readErr == nil, readErr
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Codecs passes negotiation through the policy like any other call, so
+// wrapping doesn't force JSON
+func (f *faultyHandler) Codecs(destination string) (names []string, err error) {
+	negotiator, ok := f.comm.(threephase.CodecNegotiator)
+	if !ok {
+		return nil, NoCodecsError
+	}
+
+	_, err = f.call(threephase.MessageCodecs, nil, destination, func() (bool, error) {
+		var codecsErr error
+		names, codecsErr = negotiator.Codecs(destination)
+		return codecsErr == nil, codecsErr
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
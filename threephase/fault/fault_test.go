@@ -0,0 +1,286 @@
+package fault
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+// recordingComm says yes to everything and remembers the calls it was given
+type recordingComm struct {
+	mutex sync.Mutex
+	calls []string
+}
+
+func (r *recordingComm) record(what string, destination string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.calls = append(r.calls, what+"@"+destination)
+	return true, nil
+}
+
+func (r *recordingComm) Calls() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.calls...)
+}
+
+func (r *recordingComm) InitializeTransaction(tx []byte, destination string) (bool, error) {
+	return r.record("init "+string(tx), destination)
+}
+
+func (r *recordingComm) Abort(tx []byte, destination string) (bool, error) {
+	return r.record("abort "+string(tx), destination)
+}
+
+func (r *recordingComm) DoCommit(tx []byte, destination string) (bool, error) {
+	return r.record("commit "+string(tx), destination)
+}
+
+func (r *recordingComm) PreCommit(tx []byte, destination string) (bool, error) {
+	return r.record("precommit "+string(tx), destination)
+}
+
+func (r *recordingComm) CheckCommit(tx []byte, destination string) (bool, error) {
+	return r.record("check "+string(tx), destination)
+}
+
+func (r *recordingComm) ReadData(request []byte, destination string) ([]byte, error) {
+	r.record("read "+string(request), destination)
+	return request, nil
+}
+
+func TestPassThrough(t *testing.T) {
+	inner := &recordingComm{}
+	comm := NewInjector(nil).Wrap("a", inner)
+
+	if ok, err := comm.PreCommit([]byte("tx"), "b"); !ok || err != nil {
+		t.Errorf("Pass through call failed, ok: %t err: %s", ok, err)
+	}
+
+	if result, err := comm.ReadData([]byte("query"), "b"); string(result) != "query" || err != nil {
+		t.Errorf("Pass through read failed, result: %s err: %s", result, err)
+	}
+
+	if len(inner.Calls()) != 2 {
+		t.Errorf("Expected both calls to be delivered, got %v", inner.Calls())
+	}
+}
+
+// negotiatingComm is a recordingComm that also reports its codecs
+type negotiatingComm struct {
+	recordingComm
+}
+
+func (n *negotiatingComm) Codecs(destination string) ([]string, error) {
+	n.record("codecs", destination)
+	return threephase.CodecNames(threephase.DefaultCodecs), nil
+}
+
+func TestCodecsGoThroughPolicy(t *testing.T) {
+	inner := &negotiatingComm{}
+	rules := NewRules(1, Rule{
+		Destination: "b",
+		Kinds:       []threephase.MessageKind{threephase.MessageCodecs},
+		Decision:    Decision{Action: Drop},
+	})
+	comm := NewInjector(rules).Wrap("a", inner).(threephase.CodecNegotiator)
+
+	if names, err := comm.Codecs("c"); err != nil || !reflect.DeepEqual(names, threephase.CodecNames(threephase.DefaultCodecs)) {
+		t.Errorf("Expected the codecs to be passed through, got %v err: %v", names, err)
+	}
+
+	if names, err := comm.Codecs("b"); names != nil || err != DroppedError {
+		t.Errorf("Expected codecs to b to be dropped, got %v err: %v", names, err)
+	}
+
+	if calls := inner.Calls(); !reflect.DeepEqual(calls, []string{"codecs@c"}) {
+		t.Errorf("Expected only the undropped call to be delivered, got %v", calls)
+	}
+
+	plain := NewInjector(nil).Wrap("a", &recordingComm{}).(threephase.CodecNegotiator)
+	if _, err := plain.Codecs("b"); err != NoCodecsError {
+		t.Errorf("Expected %v from a handler that can't negotiate, got %v", NoCodecsError, err)
+	}
+}
+
+func TestDropByKindAndDestination(t *testing.T) {
+	inner := &recordingComm{}
+	rules := NewRules(1, Rule{
+		Destination: "b",
+		Kinds:       []threephase.MessageKind{threephase.MessageCommit},
+		Decision:    Decision{Action: Drop},
+	})
+	comm := NewInjector(rules).Wrap("a", inner)
+
+	if ok, err := comm.DoCommit([]byte("tx"), "b"); ok || err != DroppedError {
+		t.Errorf("Expected commit to b to be dropped, ok: %t err: %s", ok, err)
+	}
+
+	if ok, err := comm.DoCommit([]byte("tx"), "c"); !ok || err != nil {
+		t.Error("Commit to another destination was affected")
+	}
+
+	if ok, err := comm.PreCommit([]byte("tx"), "b"); !ok || err != nil {
+		t.Error("Another message kind to b was affected")
+	}
+
+	if calls := inner.Calls(); len(calls) != 2 {
+		t.Errorf("Expected the dropped call not to be delivered, got %v", calls)
+	}
+}
+
+func TestProbabilisticRulesAreRepeatable(t *testing.T) {
+	run := func() []bool {
+		rules := NewRules(7, Rule{Probability: 0.5, Decision: Decision{Action: Drop}})
+		comm := NewInjector(rules).Wrap("a", &recordingComm{})
+
+		var results []bool
+		for i := 0; i < 20; i++ {
+			ok, _ := comm.Abort([]byte("tx"), "b")
+			results = append(results, ok)
+		}
+		return results
+	}
+
+	first, second := run(), run()
+	dropped := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatal("The same seed dropped different calls")
+		}
+		if !first[i] {
+			dropped++
+		}
+	}
+
+	if dropped == 0 || dropped == len(first) {
+		t.Errorf("Expected some but not all calls to be dropped, dropped %d", dropped)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	rules := NewRules(1, Rule{Decision: Decision{Action: Delay, Delay: 20 * time.Millisecond}})
+	comm := NewInjector(rules).Wrap("a", &recordingComm{})
+
+	start := time.Now()
+	if ok, _ := comm.CheckCommit([]byte("tx"), "b"); !ok {
+		t.Error("Delayed call wasn't delivered")
+	}
+
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("Call wasn't delayed")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	inner := &recordingComm{}
+	rules := NewRules(1, Rule{Decision: Decision{Action: Duplicate}})
+	comm := NewInjector(rules).Wrap("a", inner)
+
+	comm.InitializeTransaction([]byte("tx"), "b")
+
+	if calls := inner.Calls(); len(calls) != 2 || calls[0] != calls[1] {
+		t.Errorf("Expected the call to be delivered twice, got %v", calls)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	inner := &recordingComm{}
+	rules := NewRules(1, Rule{
+		Kinds:    []threephase.MessageKind{threephase.MessagePreCommit},
+		Decision: Decision{Action: Reorder, Delay: time.Second},
+	})
+	injector := NewInjector(rules)
+	comm := injector.Wrap("a", inner)
+
+	done := make(chan bool)
+	go func() {
+		comm.PreCommit([]byte("first"), "b")
+		close(done)
+	}()
+
+	// give the held call time to park before the one overtaking it
+	for {
+		injector.mutex.Lock()
+		waiting := len(injector.held["b"])
+		injector.mutex.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	comm.DoCommit([]byte("second"), "b")
+	<-done
+
+	calls := inner.Calls()
+	if len(calls) != 2 || calls[0] != "commit second@b" || calls[1] != "precommit first@b" {
+		t.Errorf("Expected the held call to arrive second, got %v", calls)
+	}
+}
+
+func TestReorderWindowExpires(t *testing.T) {
+	rules := NewRules(1, Rule{Decision: Decision{Action: Reorder, Delay: 10 * time.Millisecond}})
+	comm := NewInjector(rules).Wrap("a", &recordingComm{})
+
+	if ok, _ := comm.PreCommit([]byte("tx"), "b"); !ok {
+		t.Error("A held call wasn't delivered once its window passed")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	inner := &recordingComm{}
+	injector := NewInjector(nil)
+	a := injector.Wrap("a", inner)
+	c := injector.Wrap("c", inner)
+
+	injector.Partition([]string{"a", "b"}, []string{"c"})
+
+	if _, err := a.PreCommit([]byte("tx"), "b"); err != nil {
+		t.Error("Hosts in the same group couldn't talk")
+	}
+
+	if _, err := a.PreCommit([]byte("tx"), "c"); err != PartitionedError {
+		t.Error("Hosts in different groups could talk")
+	}
+
+	if _, err := c.PreCommit([]byte("tx"), "a"); err != PartitionedError {
+		t.Error("The partition only worked in one direction")
+	}
+
+	if _, err := c.PreCommit([]byte("tx"), "d"); err != nil {
+		t.Error("A host outside every group was unreachable")
+	}
+
+	injector.Heal()
+
+	if _, err := a.PreCommit([]byte("tx"), "c"); err != nil {
+		t.Error("Healing didn't remove the partition")
+	}
+}
+
+func TestWithThreePhase(t *testing.T) {
+	injector := NewInjector(NewRules(1, Rule{
+		Destination: "b",
+		Kinds:       []threephase.MessageKind{threephase.MessagePreCommit},
+		Decision:    Decision{Action: Drop},
+	}))
+	inner := &recordingComm{}
+	tpc := threephase.NewThreePhaseCommit(injector.Wrap("a", inner), storage.NewInMemoryStorage(), nil)
+	defer tpc.Close()
+
+	if tpc.CommitTx("tx", []byte("data"), []string{"b", "c"}) {
+		t.Error("Committed a transaction whose precommit was dropped")
+	}
+
+	expected := []string{"abort tx@b", "abort tx@c"}
+	calls := inner.Calls()
+	if len(calls) < 2 || !reflect.DeepEqual(calls[len(calls)-2:], expected) {
+		t.Errorf("Expected the coordinator to abort, got %v", calls)
+	}
+}
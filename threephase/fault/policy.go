@@ -0,0 +1,142 @@
+package fault
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+// Action is what the Injector does with a single call
+type Action int
+
+const (
+	// Deliver passes the call straight through
+	Deliver Action = iota
+	// Drop fails the call without it reaching the destination
+	Drop
+	// Delay waits for Decision.Delay before delivering the call
+	Delay
+	// Duplicate delivers the call twice, the caller sees the first reply
+	Duplicate
+	// Reorder holds the call until the next call to the same destination
+	// has been delivered, or until Decision.Delay passes
+	Reorder
+)
+
+// Call describes a single CommunicationHandler call passing through an
+// Injector.
+type Call struct {
+	Source      string
+	Destination string
+	Kind        threephase.MessageKind
+	Payload     []byte
+}
+
+// Decision is a Policy's verdict on a call
+type Decision struct {
+	Action Action
+	Delay  time.Duration
+}
+
+// Policy decides the fate of each call, it must be safe to use from multiple
+// goroutines.
+type Policy interface {
+	Decide(call Call) Decision
+}
+
+// PolicyFunc lets an ordinary function act as a Policy
+type PolicyFunc func(call Call) Decision
+
+func (f PolicyFunc) Decide(call Call) Decision {
+	return f(call)
+}
+
+// PassThrough delivers every call
+var PassThrough Policy = PolicyFunc(func(call Call) Decision {
+	return Decision{Action: Deliver}
+})
+
+// Rule applies a Decision to the calls it matches. Empty Source or
+// Destination fields match any host and empty Kinds match every message.
+type Rule struct {
+	Source      string
+	Destination string
+	Kinds       []threephase.MessageKind
+
+	// Probability is the chance the rule applies to a matching call, zero is
+	// treated as always.
+	Probability float64
+
+	Decision
+}
+
+func (r Rule) matches(call Call) bool {
+	if r.Source != "" && r.Source != call.Source {
+		return false
+	}
+
+	if r.Destination != "" && r.Destination != call.Destination {
+		return false
+	}
+
+	if len(r.Kinds) == 0 {
+		return true
+	}
+
+	for _, kind := range r.Kinds {
+		if kind == call.Kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rules is a Policy made of an ordered list of rules, the first rule that
+// matches and fires decides the call. Calls no rule applies to are delivered.
+type Rules struct {
+	mutex  sync.Mutex
+	rules  []Rule
+	random *rand.Rand
+}
+
+// NewRules creates a rule based Policy, seed drives the probabilistic rules
+// so a run can be repeated.
+func NewRules(seed int64, rules ...Rule) *Rules {
+	return &Rules{rules: rules, random: rand.New(rand.NewSource(seed))}
+}
+
+// Add appends a rule, it has lower priority than every existing one
+func (r *Rules) Add(rule Rule) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rules = append(r.rules, rule)
+}
+
+// Clear removes every rule
+func (r *Rules) Clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rules = nil
+}
+
+func (r *Rules) Decide(call Call) Decision {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, rule := range r.rules {
+		if !rule.matches(call) {
+			continue
+		}
+
+		if rule.Probability > 0 && r.random.Float64() >= rule.Probability {
+			continue
+		}
+
+		return rule.Decision
+	}
+
+	return Decision{Action: Deliver}
+}
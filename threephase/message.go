@@ -0,0 +1,47 @@
+package threephase
+
+import "strconv"
+
+// MessageKind identifies which of the CommunicationHandler calls a message
+// between nodes belongs to.
+type MessageKind int
+
+const (
+	MessageInit MessageKind = iota
+	MessagePreCommit
+	MessageCommit
+	MessageAbort
+	MessageCheck
+	MessageRead
+	// MessageCodecs asks a node which codecs it supports, the reply's payload
+	// is their names separated by commas
+	MessageCodecs
+)
+
+var messageKindNames = map[MessageKind]string{
+	MessageInit:      "init",
+	MessagePreCommit: "precommit",
+	MessageCommit:    "commit",
+	MessageAbort:     "abort",
+	MessageCheck:     "check",
+	MessageRead:      "read",
+	MessageCodecs:    "codecs",
+}
+
+func (k MessageKind) String() string {
+	name, found := messageKindNames[k]
+	if !found {
+		return "message(" + strconv.Itoa(int(k)) + ")"
+	}
+	return name
+}
+
+// ParseMessageKind returns the kind with the given name, as returned by String
+func ParseMessageKind(name string) (kind MessageKind, found bool) {
+	for kind, kindName := range messageKindNames {
+		if kindName == name {
+			return kind, true
+		}
+	}
+	return 0, false
+}
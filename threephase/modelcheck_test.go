@@ -0,0 +1,659 @@
+package threephase
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/storage"
+)
+
+// This file is a stateless model checker for the participant state machine.
+// It runs real coordinators and participants, but every message the
+// coordinators send and every timer the participants set becomes an event the
+// checker chooses the order of. It explores every ordering of those events,
+// plus crashes at every point, and checks that no transaction is committed on
+// one node and aborted on another.
+//
+// Crashes are crash-stop: a crashed node never receives another message or
+// runs another timer, but decisions it made before crashing still count.
+// Replies can also be lost, the destination acts on the message and carries
+// on but the coordinator only sees an error.
+// Timers at or beyond the cleanup delay are assumed to never fire during a
+// run, otherwise every state would eventually forget its transactions.
+
+var (
+	mcCrashedError   = errors.New("model checker: node is crashed")
+	mcLostReplyError = errors.New("model checker: the reply was lost")
+)
+
+type mcConfig struct {
+	nodes        int
+	transactions int
+	crashes      int
+	lostReplies  int
+}
+
+type mcTimer struct {
+	label string
+	task  func()
+}
+
+// mcClock records timers instead of running them, the checker fires them in
+// whatever order it's exploring.
+type mcClock struct {
+	label   string
+	timers  []*mcTimer
+	stopped bool
+}
+
+func (c *mcClock) Now() time.Time {
+	return time.Unix(0, 0)
+}
+
+func (c *mcClock) AfterFunc(delay time.Duration, task func()) {
+	if c.stopped || delay >= PhaseTimeout*100 {
+		return
+	}
+
+	if c.label == "" {
+		panic("model checker: a timer was set by an event that doesn't expect one")
+	}
+
+	c.timers = append(c.timers, &mcTimer{label: c.label, task: task})
+}
+
+func (c *mcClock) Stop() error {
+	c.stopped = true
+	c.timers = nil
+	return nil
+}
+
+type mcReply struct {
+	ok  bool
+	err error
+}
+
+type mcMessage struct {
+	kind    MessageKind
+	from    int
+	to      int
+	payload []byte
+	reply   chan mcReply
+}
+
+type mcNode struct {
+	name    string
+	tpc     *threePhaseInternal
+	clock   *mcClock
+	crashed bool
+}
+
+// mcCoordinator runs CommitTx on its own goroutine and hands each message it
+// sends to the checker.
+type mcCoordinator struct {
+	node     int
+	tx       string
+	out      chan *mcMessage
+	done     chan bool
+	pending  *mcMessage
+	finished bool
+	result   bool
+	crashed  bool
+	failures int
+}
+
+type mcCluster struct {
+	config       mcConfig
+	nodes        []*mcNode
+	coordinators []*mcCoordinator
+	trace        []string
+	// firing is set while a timer runs
+	firing bool
+	// lost counts the replies that have been lost
+	lost int
+}
+
+// mcComm is the CommunicationHandler for a single node
+type mcComm struct {
+	cluster *mcCluster
+	from    int
+}
+
+func (m *mcComm) send(kind MessageKind, payload []byte, destination string) (bool, error) {
+	message := &mcMessage{
+		kind:    kind,
+		from:    m.from,
+		to:      m.cluster.index(destination),
+		payload: payload,
+		reply:   make(chan mcReply),
+	}
+
+	m.cluster.coordinatorFor(m.from).out <- message
+	reply := <-message.reply
+	return reply.ok, reply.err
+}
+
+func (m *mcComm) InitializeTransaction(tx []byte, destination string) (bool, error) {
+	return m.send(MessageInit, tx, destination)
+}
+
+// Abort is also sent by the termination protocol, those are answered straight
+// away like CheckCommit.
+func (m *mcComm) Abort(transactionID []byte, destination string) (bool, error) {
+	if m.cluster.firing {
+		node := m.cluster.nodes[m.cluster.index(destination)]
+		if node.crashed {
+			return false, mcCrashedError
+		}
+		return node.tpc.Abort(string(transactionID)), nil
+	}
+	return m.send(MessageAbort, transactionID, destination)
+}
+
+func (m *mcComm) DoCommit(transactionID []byte, destination string) (bool, error) {
+	return m.send(MessageCommit, transactionID, destination)
+}
+
+func (m *mcComm) PreCommit(transactionID []byte, destination string) (bool, error) {
+	return m.send(MessagePreCommit, transactionID, destination)
+}
+
+// CheckCommit is only used by the termination protocol which runs inside a
+// timer, so it's answered straight away.
+func (m *mcComm) CheckCommit(transactionID []byte, destination string) (bool, error) {
+	node := m.cluster.nodes[m.cluster.index(destination)]
+	if node.crashed {
+		return false, mcCrashedError
+	}
+	return node.tpc.CheckCommit(string(transactionID)), nil
+}
+
+func (m *mcComm) ReadData(request []byte, destination string) ([]byte, error) {
+	return nil, errors.New("model checker: reads aren't modelled")
+}
+
+func newMCCluster(config mcConfig) *mcCluster {
+	c := &mcCluster{config: config}
+
+	var names []string
+	for i := 0; i < config.nodes; i++ {
+		names = append(names, fmt.Sprintf("node%d", i+1))
+	}
+
+	for i, name := range names {
+		clock := &mcClock{}
+		tpc := newThreePhaseInternal(&mcComm{c, i}, storage.NewInMemoryStorage(), nil, clock)
+		c.nodes = append(c.nodes, &mcNode{name: name, tpc: tpc, clock: clock})
+	}
+
+	for i := 0; i < config.transactions; i++ {
+		co := &mcCoordinator{
+			node: i % config.nodes,
+			tx:   fmt.Sprintf("tx%d", i+1),
+			out:  make(chan *mcMessage),
+			done: make(chan bool),
+		}
+		c.coordinators = append(c.coordinators, co)
+
+		go func(co *mcCoordinator) {
+			co.result = c.nodes[co.node].tpc.CommitTx(co.tx, []byte(co.tx), names)
+			close(co.done)
+		}(co)
+
+		c.settle(co)
+	}
+
+	return c
+}
+
+func (c *mcCluster) index(name string) int {
+	for i, node := range c.nodes {
+		if node.name == name {
+			return i
+		}
+	}
+	panic("model checker: unknown node " + name)
+}
+
+func (c *mcCluster) coordinatorFor(node int) *mcCoordinator {
+	for _, co := range c.coordinators {
+		if co.node == node && !co.finished {
+			return co
+		}
+	}
+	panic("model checker: no coordinator running on node")
+}
+
+func (c *mcCluster) describe(m *mcMessage) string {
+	target := string(m.payload)
+	if m.kind == MessageInit {
+		target = c.coordinatorFor(m.from).tx
+	}
+	return fmt.Sprintf("%s %s %s->%s", m.kind, target, c.nodes[m.from].name, c.nodes[m.to].name)
+}
+
+// settle lets a coordinator run until it sends a message the checker has a
+// choice about, or finishes. Messages from or to crashed nodes fail straight
+// away since there's nothing to choose.
+func (c *mcCluster) settle(co *mcCoordinator) {
+	co.pending = nil
+
+	for {
+		select {
+		case m := <-co.out:
+			if c.nodes[m.from].crashed || c.nodes[m.to].crashed {
+				co.failures++
+				m.reply <- mcReply{false, mcCrashedError}
+				continue
+			}
+			co.pending = m
+			return
+
+		case <-co.done:
+			co.finished = true
+			return
+		}
+	}
+}
+
+type mcOutcome int
+
+const (
+	mcReplied mcOutcome = iota
+	// mcCrashAfter crashes the destination before it can reply
+	mcCrashAfter
+	// mcLoseReply loses the reply but leaves the destination running
+	mcLoseReply
+)
+
+// deliver hands the pending message of co to its destination, outcome says
+// what happens to the reply.
+func (c *mcCluster) deliver(co *mcCoordinator, outcome mcOutcome) {
+	m := co.pending
+	node := c.nodes[m.to]
+
+	switch m.kind {
+	case MessageInit:
+		node.clock.label = "termination " + co.tx
+	case MessagePreCommit:
+		node.clock.label = "autocommit " + co.tx
+	default:
+		node.clock.label = ""
+	}
+
+	var ok bool
+	switch m.kind {
+	case MessageInit:
+		ok = node.tpc.InitializeTransaction(m.payload)
+	case MessagePreCommit:
+		ok = node.tpc.PreCommit(string(m.payload))
+	case MessageCommit:
+		ok = node.tpc.DoCommit(string(m.payload))
+	case MessageAbort:
+		ok = node.tpc.Abort(string(m.payload))
+	}
+
+	switch outcome {
+	case mcCrashAfter:
+		co.failures++
+		co.pending = nil
+		m.reply <- mcReply{false, mcCrashedError}
+		c.crash(m.to)
+	case mcLoseReply:
+		co.failures++
+		c.lost++
+		m.reply <- mcReply{false, mcLostReplyError}
+	default:
+		if !ok {
+			co.failures++
+		}
+		m.reply <- mcReply{ok, nil}
+	}
+
+	c.settle(co)
+}
+
+func (c *mcCluster) crash(index int) {
+	node := c.nodes[index]
+	node.crashed = true
+	node.clock.timers = nil
+
+	for _, co := range c.coordinators {
+		if co.node == index && !co.finished && !co.crashed {
+			co.crashed = true
+		}
+	}
+
+	// messages already waiting to or from the crashed node can only fail now
+	for _, co := range c.coordinators {
+		if co.pending != nil && (co.pending.to == index || co.pending.from == index) {
+			co.failures++
+			co.pending.reply <- mcReply{false, mcCrashedError}
+			c.settle(co)
+		}
+	}
+}
+
+// drain fails every remaining message from a coordinator so its goroutine
+// can finish.
+func (c *mcCluster) drain(co *mcCoordinator) {
+	for !co.finished {
+		if co.pending != nil {
+			co.pending.reply <- mcReply{false, mcCrashedError}
+		}
+		c.settle(co)
+	}
+}
+
+func (c *mcCluster) close() {
+	for _, co := range c.coordinators {
+		if !co.finished {
+			c.drain(co)
+		}
+	}
+}
+
+func (c *mcCluster) crashesLeft() int {
+	left := c.config.crashes
+	for _, node := range c.nodes {
+		if node.crashed {
+			left--
+		}
+	}
+	return left
+}
+
+// enabled lists the events that could happen next, in a fixed order.
+//
+// Events belonging to different transactions touch separate state, so the
+// order they run in relative to each other doesn't matter. Only the events of
+// the first transaction that has any are returned, along with crashes which
+// affect every transaction. That's a persistent set, and because the
+// invariants are stable (a node never changes its mind once it has committed
+// or aborted) exploring just those still finds every violation.
+func (c *mcCluster) enabled() []string {
+	var crashes []string
+	byTransaction := make(map[string][]string)
+
+	for _, co := range c.coordinators {
+		if co.pending == nil {
+			continue
+		}
+		byTransaction[co.tx] = append(byTransaction[co.tx], "deliver "+c.describe(co.pending))
+		if c.crashesLeft() > 0 {
+			byTransaction[co.tx] = append(byTransaction[co.tx], "deliver "+c.describe(co.pending)+" then crash")
+		}
+		if c.lost < c.config.lostReplies {
+			byTransaction[co.tx] = append(byTransaction[co.tx], "deliver "+c.describe(co.pending)+" and lose the reply")
+		}
+	}
+
+	for _, node := range c.nodes {
+		if node.crashed {
+			continue
+		}
+
+		for _, timer := range node.clock.timers {
+			tx := timer.label[strings.LastIndex(timer.label, " ")+1:]
+			byTransaction[tx] = append(byTransaction[tx], "fire "+timer.label+" on "+node.name)
+		}
+
+		if c.crashesLeft() > 0 {
+			crashes = append(crashes, "crash "+node.name)
+		}
+	}
+
+	var events []string
+	for _, co := range c.coordinators {
+		if len(byTransaction[co.tx]) > 0 {
+			events = byTransaction[co.tx]
+			break
+		}
+	}
+	events = append(events, crashes...)
+
+	sort.Strings(events)
+	return events
+}
+
+// apply runs the event with the given description
+func (c *mcCluster) apply(event string) {
+	c.trace = append(c.trace, event)
+
+	for _, co := range c.coordinators {
+		if co.pending == nil {
+			continue
+		}
+		description := "deliver " + c.describe(co.pending)
+		if event == description {
+			c.deliver(co, mcReplied)
+			return
+		}
+		if event == description+" then crash" {
+			c.deliver(co, mcCrashAfter)
+			return
+		}
+		if event == description+" and lose the reply" {
+			c.deliver(co, mcLoseReply)
+			return
+		}
+	}
+
+	for i, node := range c.nodes {
+		if event == "crash "+node.name {
+			c.crash(i)
+			return
+		}
+
+		for index, timer := range node.clock.timers {
+			if event == "fire "+timer.label+" on "+node.name {
+				node.clock.timers = append(node.clock.timers[:index], node.clock.timers[index+1:]...)
+				node.clock.label = ""
+				if strings.HasPrefix(timer.label, "termination ") {
+					node.clock.label = timer.label
+				}
+				c.firing = true
+				timer.task()
+				c.firing = false
+				return
+			}
+		}
+	}
+
+	panic("model checker: event isn't enabled: " + event)
+}
+
+func (c *mcCluster) phase(node *mcNode, tx string) string {
+	status, found := node.tpc.getTransactionStatus(tx)
+	if !found {
+		return "-"
+	}
+
+	return status.String()
+}
+
+// violation checks the atomic commit invariants, terminal is true once no
+// more events are possible.
+func (c *mcCluster) violation(terminal bool) string {
+	for _, co := range c.coordinators {
+		var committed, aborted []string
+		for _, node := range c.nodes {
+			switch c.phase(node, co.tx) {
+			case "committed":
+				committed = append(committed, node.name)
+			case "aborted":
+				aborted = append(aborted, node.name)
+			}
+		}
+
+		if len(committed) > 0 && len(aborted) > 0 {
+			return fmt.Sprintf("%s is committed on %v but aborted on %v", co.tx, committed, aborted)
+		}
+
+		if co.finished && !co.crashed && co.result && len(aborted) > 0 {
+			return fmt.Sprintf("%s was reported committed but is aborted on %v", co.tx, aborted)
+		}
+
+		if terminal && co.finished && !co.crashed && co.result {
+			for _, node := range c.nodes {
+				if !node.crashed && c.phase(node, co.tx) != "committed" {
+					return fmt.Sprintf("%s was reported committed but %s never committed it", co.tx, node.name)
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// signature identifies the state of the cluster, two runs with the same
+// signature behave the same from then on. A coordinator's future only depends
+// on the message it's waiting on and how many of its calls have failed, so
+// that's all that's kept of it.
+func (c *mcCluster) signature() string {
+	var parts []string
+
+	for _, node := range c.nodes {
+		var timers []string
+		for _, timer := range node.clock.timers {
+			timers = append(timers, timer.label)
+		}
+		sort.Strings(timers)
+
+		var phases []string
+		for _, co := range c.coordinators {
+			phases = append(phases, c.phase(node, co.tx))
+		}
+
+		parts = append(parts, fmt.Sprintf("%s crashed=%t phases=%v timers=%v",
+			node.name, node.crashed, phases, timers))
+	}
+
+	parts = append(parts, fmt.Sprintf("lost=%d", c.lost))
+
+	for _, co := range c.coordinators {
+		pending := ""
+		if co.pending != nil {
+			pending = c.describe(co.pending)
+		}
+		parts = append(parts, fmt.Sprintf("%s finished=%t result=%t crashed=%t pending=%q failures=%d",
+			co.tx, co.finished, co.result, co.crashed, pending, co.failures))
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+// counterexample renders the events that led to a violation
+func (c *mcCluster) counterexample(violation string) string {
+	output := "invariant violated: " + violation + "\n"
+
+	for i, event := range c.trace {
+		output += fmt.Sprintf("  %3d. %s\n", i+1, event)
+	}
+
+	output += "final state:\n"
+	for _, node := range c.nodes {
+		output += "  " + node.name
+		if node.crashed {
+			output += " (crashed)"
+		}
+		for _, co := range c.coordinators {
+			output += fmt.Sprintf(" %s=%s", co.tx, c.phase(node, co.tx))
+		}
+		output += "\n"
+	}
+
+	return output
+}
+
+type modelChecker struct {
+	config  mcConfig
+	visited map[string]bool
+	states  int
+}
+
+// check explores every reachable state, returning a counterexample for the
+// first violation it finds.
+func (m *modelChecker) check() string {
+	m.visited = make(map[string]bool)
+	return m.explore(nil)
+}
+
+func (m *modelChecker) explore(prefix []string) string {
+	c := newMCCluster(m.config)
+	defer c.close()
+
+	for _, event := range prefix {
+		c.apply(event)
+	}
+
+	signature := c.signature()
+	if m.visited[signature] {
+		return ""
+	}
+	m.visited[signature] = true
+	m.states++
+
+	events := c.enabled()
+	if violation := c.violation(len(events) == 0); violation != "" {
+		return c.counterexample(violation)
+	}
+
+	for _, event := range events {
+		next := append(append([]string{}, prefix...), event)
+		if counterexample := m.explore(next); counterexample != "" {
+			return counterexample
+		}
+	}
+
+	return ""
+}
+
+func runModelChecker(t *testing.T, config mcConfig) {
+	// participants log every step, which makes the output unreadable
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	checker := modelChecker{config: config}
+	if counterexample := checker.check(); counterexample != "" {
+		t.Fatalf("%d nodes, %d transactions, %d crashes, %d lost replies after %d states\n%s",
+			config.nodes, config.transactions, config.crashes, config.lostReplies, checker.states, counterexample)
+	}
+
+	t.Logf("explored %d states", checker.states)
+}
+
+func TestModelCheckOneTransaction(t *testing.T) {
+	runModelChecker(t, mcConfig{nodes: 3, transactions: 1, crashes: 0})
+}
+
+func TestModelCheckOneTransactionOneCrash(t *testing.T) {
+	runModelChecker(t, mcConfig{nodes: 3, transactions: 1, crashes: 1})
+}
+
+func TestModelCheckTwoTransactions(t *testing.T) {
+	runModelChecker(t, mcConfig{nodes: 3, transactions: 2, crashes: 0})
+}
+
+func TestModelCheckOneTransactionTwoCrashes(t *testing.T) {
+	runModelChecker(t, mcConfig{nodes: 3, transactions: 1, crashes: 2})
+}
+
+func TestModelCheckTwoTransactionsOneCrash(t *testing.T) {
+	runModelChecker(t, mcConfig{nodes: 3, transactions: 2, crashes: 1})
+}
+
+func TestModelCheckOneTransactionLostReply(t *testing.T) {
+	runModelChecker(t, mcConfig{nodes: 3, transactions: 1, lostReplies: 1})
+}
+
+func TestModelCheckOneTransactionLostReplyOneCrash(t *testing.T) {
+	runModelChecker(t, mcConfig{nodes: 3, transactions: 1, crashes: 1, lostReplies: 1})
+}
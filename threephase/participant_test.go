@@ -13,7 +13,7 @@ var (
 	transactionId = "transactionid"
 	transaction   = ThreePhaseTransaction{
 		Peers:         testHosts,
-		Data:          "data",
+		Data:          []byte("data"),
 		TransactionID: transactionId,
 	}
 
@@ -48,6 +48,53 @@ func TestInitTransaction(t *testing.T) {
 	}
 }
 
+func TestInitTransactionOperations(t *testing.T) {
+	fakeComm := newFakeComm(testHosts)
+	db := storage.NewInMemoryStorage()
+	tpc := NewThreePhaseCommit(&fakeComm, db, &fakeComm)
+	defer tpc.Close()
+
+	var data = []struct {
+		id       string
+		op       storage.Operation
+		key      []byte
+		expected bool
+	}{
+		{"update-missing", storage.OpUpdate, []byte("key"), false},
+		{"delete-missing", storage.OpDelete, []byte("key"), false},
+		{"create", storage.OpCreate, []byte("key"), true},
+		{"update-no-key", storage.OpUpdate, nil, false},
+		{"update", storage.OpUpdate, []byte("key"), true},
+		{"create-existing", storage.OpCreate, []byte("key"), false},
+		{"delete-no-key", storage.OpDelete, nil, false},
+		{"delete", storage.OpDelete, []byte("key"), true},
+	}
+
+	for _, tc := range data {
+		tx := ThreePhaseTransaction{
+			Peers:         testHosts,
+			Data:          []byte("data"),
+			TransactionID: tc.id,
+			Operation:     tc.op,
+			Key:           tc.key,
+		}
+
+		ok := tpc.InitializeTransaction(mustMarshal(tx))
+		if ok != tc.expected {
+			t.Errorf("%s: expected init to return %t got %t", tc.id, tc.expected, ok)
+		}
+
+		if ok {
+			tpc.PreCommit(tc.id)
+			tpc.DoCommit(tc.id)
+		}
+	}
+
+	if _, ok := db.Read([]byte("key")); ok {
+		t.Error("the key should have been deleted")
+	}
+}
+
 func TestGetPeersTransaction(t *testing.T) {
 	fakeComm := newFakeComm(testHosts)
 	db := storage.NewInMemoryStorage()
@@ -111,6 +158,88 @@ func TestAbortTransactionSuccess(t *testing.T) {
 	}
 }
 
+func TestAbortPreparedTransaction(t *testing.T) {
+	fakeComm := newFakeComm(testHosts)
+	db := storage.NewInMemoryStorage()
+	tpc := NewThreePhaseCommit(&fakeComm, db, &fakeComm)
+
+	if !tpc.InitializeTransaction(encodedTransaction) || !tpc.PreCommit(transactionId) {
+		t.Fatal("Could not get a transaction to the prepared state")
+	}
+
+	// a peer may already have committed, so a prepared node can't abort
+	if tpc.Abort(transactionId) {
+		t.Error("Aborted a prepared transaction")
+	}
+
+	if !tpc.DoCommit(transactionId) {
+		t.Error("Could not commit the transaction after refusing to abort")
+	}
+}
+
+func TestTerminateUncertainTransaction(t *testing.T) {
+	var data = []struct {
+		name          string
+		preparedPeers []string
+		abortedPeers  []string
+		expected      Phase
+	}{
+		{"first peer aborts", nil, testHosts[:1], PhaseAborted},
+		{"first peer won't abort", nil, nil, PhaseUncertain},
+		{"a peer is prepared", testHosts[1:2], testHosts, PhaseCommitted},
+	}
+
+	for _, tc := range data {
+		fakeComm := newFakeComm(testHosts)
+		fakeComm.CheckCommitI = func(tx []byte, dest string) (bool, error) {
+			return contains(tc.preparedPeers, dest), nil
+		}
+		fakeComm.AbortI = func(tx []byte, dest string) (bool, error) {
+			return contains(tc.abortedPeers, dest), nil
+		}
+		db := storage.NewInMemoryStorage()
+		tpc := newThreePhaseInternal(&fakeComm, db, &fakeComm, NewRealClock())
+
+		tx := ThreePhaseTransaction{
+			Peers:         testHosts,
+			Data:          []byte("data"),
+			TransactionID: "uncertain",
+			Operation:     storage.OpCreate,
+			Key:           []byte("key"),
+		}
+		if !tpc.InitializeTransaction(mustMarshal(tx)) {
+			t.Fatalf("%s: could not initialize the transaction", tc.name)
+		}
+
+		tpc.terminationProtocol(tx.TransactionID)
+
+		if status, _ := tpc.getTransactionStatus(tx.TransactionID); status != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, status)
+		}
+
+		// the key stays locked until the transaction is resolved
+		tx.TransactionID = "next"
+		if tc.expected == PhaseCommitted {
+			tx.Operation = storage.OpUpdate
+		}
+		unlocked := tc.expected != PhaseUncertain
+		if ok := tpc.InitializeTransaction(mustMarshal(tx)); ok != unlocked {
+			t.Errorf("%s: expected a later transaction on the key to be allowed: %t got %t", tc.name, unlocked, ok)
+		}
+
+		tpc.Close()
+	}
+}
+
+func contains(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
 func TestPrecommitTransaction(t *testing.T) {
 	fakeComm := newFakeComm(testHosts)
 	db := storage.NewInMemoryStorage()
@@ -144,7 +273,7 @@ func TestPrecommitTransaction(t *testing.T) {
 func TestAutoCommit(t *testing.T) {
 	fakeComm := newFakeComm(testHosts)
 	db := storage.NewInMemoryStorage()
-	tpc := newThreePhaseInternal(&fakeComm, db, &fakeComm)
+	tpc := newThreePhaseInternal(&fakeComm, db, &fakeComm, NewRealClock())
 
 	if tpc.autoCommit("foo") {
 		t.Error("autocommitted a non-existant transaction")
@@ -199,3 +328,76 @@ func TestInitTransaction(t *testing.T) {
 		t.Error("Initialized an existing transaction")
 	}
 }**/
+
+// labeledNodes is a NodeSet that knows this node's labels and can be limited
+// to a placement
+type labeledNodes struct {
+	*fakeCommunicationHandler
+	labels Labels
+	placed Placement
+}
+
+func (n *labeledNodes) SelfLabels() Labels {
+	return n.labels
+}
+
+func (n *labeledNodes) PlacedSet(placement Placement) NodeSet {
+	placed := *n
+	placed.placed = placement
+	return &placed
+}
+
+func TestInitTransactionPlacement(t *testing.T) {
+	eu := Placement{{Label: "region", Values: []string{"eu"}}}
+
+	var data = []struct {
+		name      string
+		labels    Labels
+		placement Placement
+		expected  bool
+	}{
+		{"no placement", nil, nil, true},
+		{"allowed", Labels{"region": "eu"}, eu, true},
+		{"not allowed", Labels{"region": "us"}, eu, false},
+		{"unlabeled", nil, eu, false},
+	}
+
+	for _, tc := range data {
+		fakeComm := newFakeComm(testHosts)
+		nodes := &labeledNodes{fakeCommunicationHandler: &fakeComm, labels: tc.labels}
+		tpc := NewThreePhaseCommit(&fakeComm, storage.NewInMemoryStorage(), nodes)
+
+		tx := transaction
+		tx.Placement = tc.placement
+		if ok := tpc.InitializeTransaction(mustMarshal(tx)); ok != tc.expected {
+			t.Errorf("%s: expected %t got %t", tc.name, tc.expected, ok)
+		}
+		tpc.Close()
+	}
+}
+
+func TestWithPlacement(t *testing.T) {
+	eu := Placement{{Label: "region", Values: []string{"eu"}}}
+
+	var sent ThreePhaseTransaction
+	fakeComm := newFakeComm(testHosts)
+	fakeComm.InitializeTransactionI = func(tx []byte, dest string) (bool, error) {
+		return true, DecodeTransaction(tx, &sent)
+	}
+
+	tpc := NewThreePhaseCommit(&fakeComm, storage.NewInMemoryStorage(), &labeledNodes{fakeCommunicationHandler: &fakeComm})
+	defer tpc.Close()
+
+	placed := tpc.WithPlacement(eu)
+	if nodes := placed.(*placedCommit).ch.(*labeledNodes); !reflect.DeepEqual(nodes.placed, eu) {
+		t.Errorf("expected the sets to be limited to %v got %v", eu, nodes.placed)
+	}
+
+	if !placed.Update([]byte("key"), []byte("value")) {
+		t.Fatal("the placed update didn't commit")
+	}
+
+	if !reflect.DeepEqual(sent.Placement, eu) {
+		t.Errorf("expected the transaction to carry %v got %v", eu, sent.Placement)
+	}
+}
@@ -0,0 +1,85 @@
+package threephase
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Phase is the state a participant is in for a single transaction
+type Phase int
+
+const (
+	PhaseUncertain Phase = iota
+	PhasePrepared
+	PhaseCommitted
+	PhaseAborted
+)
+
+var phaseNames = map[Phase]string{
+	PhaseUncertain: "uncertain",
+	PhasePrepared:  "prepared",
+	PhaseCommitted: "committed",
+	PhaseAborted:   "aborted",
+}
+
+func (p Phase) String() string {
+	name, found := phaseNames[p]
+	if !found {
+		return "phase(" + strconv.Itoa(int(p)) + ")"
+	}
+	return name
+}
+
+// phaseTransitions lists every phase a participant may move to from each
+// phase. Once a participant is prepared another may already have committed, so
+// the only way out is to commit too.
+var phaseTransitions = map[Phase][]Phase{
+	PhaseUncertain: {PhasePrepared, PhaseAborted},
+	PhasePrepared:  {PhaseCommitted},
+	PhaseCommitted: {},
+	PhaseAborted:   {},
+}
+
+// IllegalTransitionError is returned when a participant is asked to move to a
+// phase it can't reach from its current one.
+type IllegalTransitionError struct {
+	From Phase
+	To   Phase
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("illegal phase transition from %s to %s", e.From, e.To)
+}
+
+// PhaseMachine tracks the phase of a single transaction and enforces the
+// transition table. The zero value starts in PhaseUncertain. It isn't safe for
+// concurrent use, callers hold their own locks.
+type PhaseMachine struct {
+	phase Phase
+}
+
+// Phase returns the current phase
+func (m *PhaseMachine) Phase() Phase {
+	return m.phase
+}
+
+// Can reports whether moving to phase to is legal from the current phase
+func (m *PhaseMachine) Can(to Phase) bool {
+	for _, allowed := range phaseTransitions[m.phase] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves to phase to, or returns an IllegalTransitionError and
+// stays put if that isn't allowed.
+func (m *PhaseMachine) Transition(to Phase) error {
+	if !m.Can(to) {
+		return &IllegalTransitionError{From: m.phase, To: to}
+	}
+
+	m.phase = to
+	return nil
+}
@@ -0,0 +1,65 @@
+package threephase
+
+import "testing"
+
+func TestPhaseTransitions(t *testing.T) {
+	var data = []struct {
+		From  Phase
+		To    Phase
+		Legal bool
+	}{
+		{PhaseUncertain, PhasePrepared, true},
+		{PhaseUncertain, PhaseAborted, true},
+		{PhaseUncertain, PhaseCommitted, false},
+		{PhaseUncertain, PhaseUncertain, false},
+		{PhasePrepared, PhaseCommitted, true},
+		{PhasePrepared, PhaseAborted, false},
+		{PhasePrepared, PhaseUncertain, false},
+		{PhaseCommitted, PhaseAborted, false},
+		{PhaseCommitted, PhasePrepared, false},
+		{PhaseAborted, PhaseCommitted, false},
+		{PhaseAborted, PhasePrepared, false},
+	}
+
+	for _, tmp := range data {
+		machine := PhaseMachine{phase: tmp.From}
+		err := machine.Transition(tmp.To)
+
+		if tmp.Legal && err != nil {
+			t.Errorf("Expected %s -> %s to be legal, got %s", tmp.From, tmp.To, err)
+		}
+
+		if !tmp.Legal {
+			if _, ok := err.(*IllegalTransitionError); !ok {
+				t.Errorf("Expected %s -> %s to be illegal, got %v", tmp.From, tmp.To, err)
+			}
+
+			if machine.Phase() != tmp.From {
+				t.Errorf("An illegal transition changed the phase to %s", machine.Phase())
+			}
+		}
+	}
+}
+
+func TestPhaseMachineStartsUncertain(t *testing.T) {
+	var machine PhaseMachine
+
+	if machine.Phase() != PhaseUncertain {
+		t.Errorf("Expected a new machine to be uncertain, got %s", machine.Phase())
+	}
+}
+
+func TestPhaseString(t *testing.T) {
+	if PhasePrepared.String() != "prepared" {
+		t.Errorf("Got bad name for prepared: %s", PhasePrepared)
+	}
+
+	if Phase(42).String() != "phase(42)" {
+		t.Errorf("Got bad name for an unknown phase: %s", Phase(42))
+	}
+
+	err := &IllegalTransitionError{From: PhasePrepared, To: PhaseAborted}
+	if err.Error() != "illegal phase transition from prepared to aborted" {
+		t.Errorf("Got bad error message: %s", err)
+	}
+}
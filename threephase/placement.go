@@ -0,0 +1,111 @@
+package threephase
+
+import "github.com/josephlewis42/historia/storage"
+
+// Labels describe where a node is, e.g. {"region": "eu-west", "rack": "r12"}
+type Labels map[string]string
+
+// Constraint limits the values a label can have. A node without the label
+// never satisfies a constraint on it, so an unlabeled node can't slip past a
+// rule like "not in the US".
+type Constraint struct {
+	Label  string
+	Values []string
+	// Exclude turns the constraint into "not one of Values"
+	Exclude bool
+}
+
+func (this Constraint) allows(labels Labels) bool {
+	value, found := labels[this.Label]
+	if !found {
+		return false
+	}
+
+	for _, allowed := range this.Values {
+		if allowed == value {
+			return !this.Exclude
+		}
+	}
+	return this.Exclude
+}
+
+// Placement is a set of constraints a node has to satisfy all of. It's sent
+// with the transaction so participants can refuse data that isn't allowed to
+// be stored on them.
+type Placement []Constraint
+
+// Allows reports whether a node with the given labels satisfies placement
+func (this Placement) Allows(labels Labels) bool {
+	for _, constraint := range this {
+		if !constraint.allows(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// PlacedNodeSet is implemented by NodeSets that can limit their sets to nodes
+// satisfying a placement.
+type PlacedNodeSet interface {
+	PlacedSet(placement Placement) NodeSet
+}
+
+// LocalLabels is implemented by NodeSets that know where this node is, without
+// it a node refuses every transaction with a placement.
+type LocalLabels interface {
+	SelfLabels() Labels
+}
+
+// placedCommit is a ThreePhaseCommit whose transactions carry a placement and
+// only go to nodes satisfying it, see WithPlacement.
+type placedCommit struct {
+	*threePhaseInternal
+	placement Placement
+	ch        NodeSet
+}
+
+func (this *threePhaseInternal) WithPlacement(placement Placement) ThreePhaseCommit {
+	placed := &placedCommit{threePhaseInternal: this, placement: append(Placement{}, placement...), ch: this.ch}
+	if nodes, ok := this.ch.(PlacedNodeSet); ok {
+		placed.ch = nodes.PlacedSet(placement)
+	}
+	return placed
+}
+
+func (this *placedCommit) Create(key, value []byte) (success bool) {
+	return this.timedTransaction(storage.OpCreate, key, value, this.ch.GetCreateSet, this.placement)
+}
+
+func (this *placedCommit) Read(request []byte) (results []byte, success bool) {
+	return this.read(request, this.ch.GetReadSet)
+}
+
+func (this *placedCommit) Update(key, value []byte) (success bool) {
+	return this.timedTransaction(storage.OpUpdate, key, value, this.ch.GetUpdateSet, this.placement)
+}
+
+func (this *placedCommit) Delete(key []byte) (success bool) {
+	return this.timedTransaction(storage.OpDelete, key, nil, this.ch.GetDeleteSet, this.placement)
+}
+
+func (this *placedCommit) CommitTx(transactionid string, data []byte, nodes []string) (success bool) {
+	return this.commitPlaced(transactionid, storage.OpCreate, nil, data, nodes, this.placement)
+}
+
+func (this *placedCommit) CommitOperation(transactionid string, op storage.Operation, key, data []byte, nodes []string) (success bool) {
+	return this.commitPlaced(transactionid, op, key, data, nodes, this.placement)
+}
+
+func (this *placedCommit) WithPlacement(placement Placement) ThreePhaseCommit {
+	return this.threePhaseInternal.WithPlacement(append(append(Placement{}, this.placement...), placement...))
+}
+
+// placedHere reports whether this node satisfies placement
+func (this *threePhaseInternal) placedHere(placement Placement) bool {
+	if len(placement) == 0 {
+		return true
+	}
+
+	local, ok := this.ch.(LocalLabels)
+	return ok && placement.Allows(local.SelfLabels())
+}
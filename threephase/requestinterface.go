@@ -10,9 +10,22 @@ type CommunicationHandler interface {
 	ReadData(request []byte, destination string) (result []byte, err error)
 }
 
+// CodecNegotiator is implemented by CommunicationHandlers that can ask a node
+// which transaction codecs it supports, see ThreePhaseCommit.SupportedCodecs.
+// Without it transactions are always sent as JSON.
+type CodecNegotiator interface {
+	Codecs(destination string) ([]string, error)
+}
+
 type NodeSet interface {
 	GetCreateSet() ([]string, error)
 	GetReadSet() ([]string, error)
 	GetUpdateSet() ([]string, error)
 	GetDeleteSet() ([]string, error)
 }
+
+// LocalNode is implemented by NodeSets that know which node is this one, so
+// it can be answered for locally rather than over the network.
+type LocalNode interface {
+	Self() string
+}
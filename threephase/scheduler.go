@@ -0,0 +1,160 @@
+package threephase
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	AlreadyClosedError = errors.New("The scheduler is already closed, you cannot close it again")
+)
+
+// scheduler is the real time Clock, it runs delayed tasks in deadline order
+// from a single goroutine so each pending timeout costs a heap entry rather
+// than a sleeping goroutine.
+type scheduler struct {
+	mutex        sync.Mutex
+	tasks        taskHeap
+	sequence     uint64
+	wakeup       chan struct{}
+	closeChannel chan struct{}
+}
+
+type scheduledTask struct {
+	deadline time.Time
+	sequence uint64
+	run      func()
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		wakeup:       make(chan struct{}, 1),
+		closeChannel: make(chan struct{}),
+	}
+
+	go s.loop()
+	return s
+}
+
+func (s *scheduler) Now() time.Time {
+	return time.Now()
+}
+
+// AfterFunc schedules task to run once delay has passed. Tasks scheduled
+// after the scheduler has been stopped are dropped.
+func (s *scheduler) AfterFunc(delay time.Duration, task func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closeChannel == nil {
+		return
+	}
+
+	s.sequence++
+	heap.Push(&s.tasks, &scheduledTask{
+		deadline: time.Now().Add(delay),
+		sequence: s.sequence,
+		run:      task,
+	})
+
+	// poke the loop in case the new task is due before the one it's waiting on
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// pending returns the number of tasks waiting to run
+func (s *scheduler) pending() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.tasks)
+}
+
+// Stop halts the scheduler, pending tasks are discarded without being run.
+func (s *scheduler) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closeChannel == nil {
+		return AlreadyClosedError
+	}
+
+	close(s.closeChannel)
+	s.closeChannel = nil
+	s.tasks = nil
+
+	return nil
+}
+
+func (s *scheduler) loop() {
+	s.mutex.Lock()
+	closeChannel := s.closeChannel
+	s.mutex.Unlock()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mutex.Lock()
+		now := time.Now()
+
+		var due []func()
+		for len(s.tasks) > 0 && !s.tasks[0].deadline.After(now) {
+			due = append(due, heap.Pop(&s.tasks).(*scheduledTask).run)
+		}
+
+		var wait <-chan time.Time
+		if len(s.tasks) > 0 {
+			timer.Reset(s.tasks[0].deadline.Sub(now))
+			wait = timer.C
+		}
+		s.mutex.Unlock()
+
+		// tasks may block on the network so they get their own short-lived
+		// goroutine rather than stalling every other timeout
+		for _, task := range due {
+			go task()
+		}
+
+		select {
+		case <-wait:
+		case <-s.wakeup:
+		case <-closeChannel:
+			return
+		}
+
+		timer.Stop()
+	}
+}
+
+// taskHeap is a min-heap of tasks ordered by deadline, ties are broken by the
+// order the tasks were scheduled in.
+type taskHeap []*scheduledTask
+
+func (h taskHeap) Len() int { return len(h) }
+
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].deadline.Equal(h[j].deadline) {
+		return h[i].sequence < h[j].sequence
+	}
+	return h[i].deadline.Before(h[j].deadline)
+}
+
+func (h taskHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *taskHeap) Push(x interface{}) {
+	*h = append(*h, x.(*scheduledTask))
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
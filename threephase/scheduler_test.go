@@ -0,0 +1,87 @@
+package threephase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/storage"
+)
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler()
+	defer s.Stop()
+
+	results := make(chan int, 3)
+	s.AfterFunc(30*time.Millisecond, func() { results <- 3 })
+	s.AfterFunc(10*time.Millisecond, func() { results <- 1 })
+	s.AfterFunc(20*time.Millisecond, func() { results <- 2 })
+
+	for expected := 1; expected <= 3; expected++ {
+		select {
+		case actual := <-results:
+			if actual != expected {
+				t.Errorf("Tasks ran out of order, expected %d got %d\n", expected, actual)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for scheduled task")
+		}
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := newScheduler()
+
+	ran := make(chan bool, 1)
+	s.AfterFunc(20*time.Millisecond, func() { ran <- true })
+
+	if s.Stop() != nil {
+		t.Fatal("Could not close the scheduler")
+	}
+
+	if s.Stop() != AlreadyClosedError {
+		t.Error("Closed the scheduler twice")
+	}
+
+	// tasks added after closing are dropped rather than queued
+	s.AfterFunc(0, func() { ran <- true })
+	if s.pending() != 0 {
+		t.Error("Scheduled a task on a closed scheduler")
+	}
+
+	select {
+	case <-ran:
+		t.Error("A task ran after the scheduler was closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTransactionTimersAreScheduled(t *testing.T) {
+	fakeComm := newFakeComm(testHosts)
+	db := storage.NewInMemoryStorage()
+	tpc := newThreePhaseInternal(&fakeComm, db, &fakeComm, NewRealClock())
+	defer tpc.Close()
+
+	if !tpc.InitializeTransaction(encodedTransaction) {
+		t.Fatal("Could not initialize the transaction")
+	}
+
+	if tpc.clock.(*scheduler).pending() != 1 {
+		t.Errorf("Expected the termination protocol to be scheduled, got %d tasks", tpc.clock.(*scheduler).pending())
+	}
+
+	if !tpc.PreCommit(transactionId) {
+		t.Fatal("Could not precommit the transaction")
+	}
+
+	if tpc.clock.(*scheduler).pending() != 2 {
+		t.Errorf("Expected the auto commit to be scheduled, got %d tasks", tpc.clock.(*scheduler).pending())
+	}
+
+	if tpc.Close() != nil {
+		t.Error("Could not close the three phase commit")
+	}
+
+	if tpc.clock.(*scheduler).pending() != 0 {
+		t.Error("Closing didn't discard the pending timers")
+	}
+}
@@ -0,0 +1,88 @@
+package sim
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+)
+
+var (
+	// Epoch is the wall clock time virtual time zero maps to, it's fixed so
+	// transaction IDs come out the same on every run of a seed.
+	Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	ClockStoppedError = errors.New("The virtual clock is already stopped")
+)
+
+// event is something that happens at a point in virtual time
+type event struct {
+	at       time.Duration
+	sequence uint64
+	node     int // -1 for events that don't belong to a node
+	run      func()
+}
+
+type eventHeap []*event
+
+func (h eventHeap) Len() int { return len(h) }
+
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].at == h[j].at {
+		return h[i].sequence < h[j].sequence
+	}
+	return h[i].at < h[j].at
+}
+
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x interface{}) {
+	*h = append(*h, x.(*event))
+}
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// nodeClock is the threephase.Clock handed to a single node, all nodes share
+// the simulation's virtual time but each can be stopped on its own.
+type nodeClock struct {
+	sim     *Simulation
+	node    int
+	stopped bool
+}
+
+func (c *nodeClock) Now() time.Time {
+	return Epoch.Add(c.sim.now)
+}
+
+func (c *nodeClock) AfterFunc(delay time.Duration, task func()) {
+	if c.stopped {
+		return
+	}
+
+	c.sim.schedule(c.sim.now+delay, c.node, task)
+}
+
+func (c *nodeClock) Stop() error {
+	if c.stopped {
+		return ClockStoppedError
+	}
+
+	c.stopped = true
+
+	remaining := eventHeap{}
+	for _, ev := range c.sim.events {
+		if ev.node != c.node {
+			remaining = append(remaining, ev)
+		}
+	}
+	heap.Init(&remaining)
+	c.sim.events = remaining
+
+	return nil
+}
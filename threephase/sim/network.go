@@ -0,0 +1,179 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/josephlewis42/historia/storage"
+)
+
+var (
+	UnknownHostError = errors.New("The destination isn't part of the simulation")
+	CrashedHostError = errors.New("The destination is crashed")
+	LostMessageError = errors.New("The message was lost")
+)
+
+// network is the CommunicationHandler for a single node, every call is
+// delivered synchronously to the destination node on the simulation goroutine.
+type network struct {
+	sim  *Simulation
+	from int
+}
+
+func (n *network) InitializeTransaction(tx []byte, destination string) (ok bool, err error) {
+	return n.sim.call(n.from, destination, "init", func(node *Node) bool {
+		return node.TPC.InitializeTransaction(tx)
+	})
+}
+
+func (n *network) Abort(transactionID []byte, destination string) (ok bool, err error) {
+	return n.sim.call(n.from, destination, "abort "+string(transactionID), func(node *Node) bool {
+		return node.TPC.Abort(string(transactionID))
+	})
+}
+
+func (n *network) DoCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return n.sim.call(n.from, destination, "commit "+string(transactionID), func(node *Node) bool {
+		return node.TPC.DoCommit(string(transactionID))
+	})
+}
+
+func (n *network) PreCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return n.sim.call(n.from, destination, "precommit "+string(transactionID), func(node *Node) bool {
+		return node.TPC.PreCommit(string(transactionID))
+	})
+}
+
+func (n *network) CheckCommit(transactionID []byte, destination string) (didcommit bool, err error) {
+	return n.sim.call(n.from, destination, "check "+string(transactionID), func(node *Node) bool {
+		return node.TPC.CheckCommit(string(transactionID))
+	})
+}
+
+func (n *network) ReadData(request []byte, destination string) (result []byte, err error) {
+	return nil, errors.New("Reading data is not simulated")
+}
+
+// call delivers a single request/reply pair, advancing virtual time by the
+// latency of each direction. Lost or undeliverable messages cost the caller a
+// full CallTimeout, like a real client waiting on a dead socket.
+func (s *Simulation) call(from int, destination string, what string, deliver func(node *Node) bool) (ok bool, err error) {
+	source := s.Nodes[from].Name
+	to, found := s.byName[destination]
+	if !found {
+		return false, UnknownHostError
+	}
+
+	start := s.now
+	s.now += s.latency(to)
+
+	if to.crashed {
+		s.tracef("%s -> %s %s: %s", source, destination, what, CrashedHostError)
+		s.now = start + s.config.CallTimeout
+		return false, CrashedHostError
+	}
+
+	if s.lose() {
+		s.tracef("%s -> %s %s: request lost", source, destination, what)
+		s.now = start + s.config.CallTimeout
+		return false, LostMessageError
+	}
+
+	ok = deliver(to)
+
+	if s.lose() {
+		s.tracef("%s -> %s %s: %t, reply lost", source, destination, what, ok)
+		s.now = start + s.config.CallTimeout
+		return false, LostMessageError
+	}
+
+	s.now += s.latency(to)
+	s.tracef("%s -> %s %s: %t", source, destination, what, ok)
+	return ok, nil
+}
+
+// liveness is a perfect failure detector, it reports every node that isn't
+// crashed as alive.
+type liveness struct {
+	sim *Simulation
+}
+
+func (l *liveness) GetAliveHosts() []string {
+	var alive []string
+	for _, node := range l.sim.Nodes {
+		if !node.crashed {
+			alive = append(alive, node.Name)
+		}
+	}
+
+	return alive
+}
+
+// nodeSet picks a seeded random majority of the alive nodes for every
+// request.
+type nodeSet struct {
+	sim *Simulation
+}
+
+func (n *nodeSet) GetCreateSet() ([]string, error) {
+	return n.majority()
+}
+
+func (n *nodeSet) GetReadSet() ([]string, error) {
+	return n.majority()
+}
+
+func (n *nodeSet) GetUpdateSet() ([]string, error) {
+	return n.majority()
+}
+
+func (n *nodeSet) GetDeleteSet() ([]string, error) {
+	return n.majority()
+}
+
+func (n *nodeSet) majority() ([]string, error) {
+	alive := (&liveness{n.sim}).GetAliveHosts()
+	needed := len(n.sim.Nodes)/2 + 1
+
+	if len(alive) < needed {
+		return nil, fmt.Errorf("only %d of %d nodes are alive", len(alive), needed)
+	}
+
+	n.sim.random.Shuffle(len(alive), func(i, j int) {
+		alive[i], alive[j] = alive[j], alive[i]
+	})
+
+	return alive[:needed], nil
+}
+
+// recordingStorage remembers which transactions were committed and aborted so
+// the outcome can be checked once the run is over.
+type recordingStorage struct {
+	storage.Storage
+	committed map[string]bool
+	aborted   map[string]bool
+}
+
+func newRecordingStorage() *recordingStorage {
+	return &recordingStorage{
+		Storage:   storage.NewInMemoryStorage(),
+		committed: make(map[string]bool),
+		aborted:   make(map[string]bool),
+	}
+}
+
+func (r *recordingStorage) Commit(transactionID []byte) error {
+	err := r.Storage.Commit(transactionID)
+	if err == nil {
+		r.committed[string(transactionID)] = true
+	}
+	return err
+}
+
+func (r *recordingStorage) Abort(transactionID []byte) bool {
+	ok := r.Storage.Abort(transactionID)
+	if ok {
+		r.aborted[string(transactionID)] = true
+	}
+	return ok
+}
@@ -0,0 +1,300 @@
+// Package sim runs a whole threephase cluster on a single goroutine against a
+// virtual clock and network. Every random choice comes from the seed in the
+// Config, so a failing run can be replayed exactly by running its seed again.
+package sim
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+// Config describes the cluster and the faults to inject into it
+type Config struct {
+	Seed  int64
+	Nodes int
+
+	// Transactions is the number of Create requests submitted to random
+	// nodes during the first half of the run
+	Transactions int
+
+	// Duration is how much virtual time the simulation runs for
+	Duration time.Duration
+
+	// each message takes a random latency in [MinLatency, MaxLatency]
+	MinLatency time.Duration
+	MaxLatency time.Duration
+
+	// CallTimeout is how long a caller waits on a lost message
+	CallTimeout time.Duration
+
+	// LossRate is the chance any single request or reply is dropped
+	LossRate float64
+
+	// Crashes is the number of random node crashes, each lasting Downtime
+	Crashes  int
+	Downtime time.Duration
+}
+
+// DefaultConfig is a small, fault free cluster
+func DefaultConfig(seed int64) Config {
+	return Config{
+		Seed:         seed,
+		Nodes:        3,
+		Transactions: 10,
+		Duration:     time.Minute,
+		MinLatency:   time.Millisecond,
+		MaxLatency:   10 * time.Millisecond,
+		CallTimeout:  threephase.PhaseTimeout,
+		Downtime:     5 * time.Second,
+	}
+}
+
+// Node is a single member of the simulated cluster
+type Node struct {
+	Name string
+	TPC  threephase.ThreePhaseCommit
+
+	db       *recordingStorage
+	clock    *nodeClock
+	crashed  bool
+	delay    time.Duration
+	deferred []*event
+}
+
+// Simulation is a cluster of nodes sharing a virtual clock and network
+type Simulation struct {
+	Nodes []*Node
+
+	config   Config
+	random   *rand.Rand
+	now      time.Duration
+	sequence uint64
+	events   eventHeap
+	byName   map[string]*Node
+	trace    []string
+}
+
+// New builds the cluster described by config and schedules its workload and
+// random faults. Nothing runs until Run is called.
+func New(config Config) *Simulation {
+	s := &Simulation{
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+		byName: make(map[string]*Node),
+	}
+
+	for i := 0; i < config.Nodes; i++ {
+		node := &Node{
+			Name:  fmt.Sprintf("node%d", i+1),
+			db:    newRecordingStorage(),
+			clock: &nodeClock{sim: s, node: i},
+		}
+		node.TPC = threephase.NewThreePhaseCommitWithClock(&network{s, i}, node.db, &nodeSet{s}, node.clock)
+
+		s.Nodes = append(s.Nodes, node)
+		s.byName[node.Name] = node
+	}
+
+	for i := 0; i < config.Transactions && config.Nodes > 0; i++ {
+		at := s.randomDuration(0, config.Duration/2)
+		s.Submit(at, s.random.Intn(config.Nodes), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	for i := 0; i < config.Crashes && config.Nodes > 0; i++ {
+		at := s.randomDuration(0, config.Duration/2)
+		node := s.random.Intn(config.Nodes)
+		s.CrashAt(at, node)
+		s.RecoverAt(at+config.Downtime, node)
+	}
+
+	return s
+}
+
+// At runs task at the given virtual time
+func (s *Simulation) At(at time.Duration, task func()) {
+	s.schedule(at, -1, task)
+}
+
+// Submit asks node to create value at the given virtual time
+func (s *Simulation) Submit(at time.Duration, node int, value []byte) {
+	s.schedule(at, node, func() {
+		ok := s.Nodes[node].TPC.Create(nil, value)
+		s.tracef("%s create %q: %t", s.Nodes[node].Name, value, ok)
+	})
+}
+
+// CrashAt stops node at the given virtual time, see Crash.
+func (s *Simulation) CrashAt(at time.Duration, node int) {
+	s.At(at, func() { s.Crash(node) })
+}
+
+// RecoverAt restarts node at the given virtual time, see Recover.
+func (s *Simulation) RecoverAt(at time.Duration, node int) {
+	s.At(at, func() { s.Recover(node) })
+}
+
+// Crash stops node from receiving messages or running its timers. Its state
+// is kept as though it were on stable storage.
+func (s *Simulation) Crash(node int) {
+	s.Nodes[node].crashed = true
+	s.tracef("%s crashed", s.Nodes[node].Name)
+}
+
+// Recover restarts a crashed node, timers that came due while it was down run
+// straight away.
+func (s *Simulation) Recover(node int) {
+	n := s.Nodes[node]
+	if !n.crashed {
+		return
+	}
+
+	n.crashed = false
+	s.tracef("%s recovered", n.Name)
+
+	for _, ev := range n.deferred {
+		s.schedule(s.now, node, ev.run)
+	}
+	n.deferred = nil
+}
+
+// SetDelay adds extra latency to every message sent to node
+func (s *Simulation) SetDelay(node int, extra time.Duration) {
+	s.Nodes[node].delay = extra
+	s.tracef("%s delay set to %s", s.Nodes[node].Name, extra)
+}
+
+// Run processes events in virtual time order until Duration has passed or
+// nothing is left to do, then checks the outcome.
+func (s *Simulation) Run() Result {
+	for s.events.Len() > 0 {
+		ev := heap.Pop(&s.events).(*event)
+		if ev.at > s.config.Duration {
+			break
+		}
+
+		// calls advance the clock past events that were due, those run late
+		// rather than moving time backwards
+		if ev.at > s.now {
+			s.now = ev.at
+		}
+
+		if ev.node >= 0 && s.Nodes[ev.node].crashed {
+			s.Nodes[ev.node].deferred = append(s.Nodes[ev.node].deferred, ev)
+			continue
+		}
+
+		ev.run()
+	}
+
+	return s.check()
+}
+
+func (s *Simulation) schedule(at time.Duration, node int, task func()) {
+	s.sequence++
+	heap.Push(&s.events, &event{at: at, sequence: s.sequence, node: node, run: task})
+}
+
+func (s *Simulation) latency(to *Node) time.Duration {
+	return s.randomDuration(s.config.MinLatency, s.config.MaxLatency) + to.delay
+}
+
+func (s *Simulation) lose() bool {
+	return s.config.LossRate > 0 && s.random.Float64() < s.config.LossRate
+}
+
+func (s *Simulation) randomDuration(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(s.random.Int63n(int64(max-min)))
+}
+
+func (s *Simulation) tracef(format string, args ...interface{}) {
+	s.trace = append(s.trace, fmt.Sprintf("[%12s] ", s.now)+fmt.Sprintf(format, args...))
+}
+
+// check looks for transactions that were committed on some nodes and aborted
+// on others.
+func (s *Simulation) check() Result {
+	result := Result{Seed: s.config.Seed, Trace: s.trace}
+
+	committed := make(map[string][]string)
+	aborted := make(map[string][]string)
+	for _, node := range s.Nodes {
+		for tx := range node.db.committed {
+			committed[tx] = append(committed[tx], node.Name)
+		}
+		for tx := range node.db.aborted {
+			aborted[tx] = append(aborted[tx], node.Name)
+		}
+	}
+
+	for tx, nodes := range committed {
+		result.Committed++
+		if len(aborted[tx]) > 0 {
+			sort.Strings(nodes)
+			sort.Strings(aborted[tx])
+			result.Violations = append(result.Violations,
+				fmt.Sprintf("transaction %s committed on %v but aborted on %v", tx, nodes, aborted[tx]))
+		}
+	}
+
+	for tx := range aborted {
+		if _, found := committed[tx]; !found {
+			result.Aborted++
+		}
+	}
+
+	sort.Strings(result.Violations)
+	return result
+}
+
+// Result is the outcome of a single simulation run
+type Result struct {
+	Seed       int64
+	Committed  int
+	Aborted    int
+	Violations []string
+	Trace      []string
+}
+
+func (r Result) Failed() bool {
+	return len(r.Violations) > 0
+}
+
+func (r Result) String() string {
+	output := fmt.Sprintf("seed %d: %d committed, %d aborted, %d violations\n",
+		r.Seed, r.Committed, r.Aborted, len(r.Violations))
+
+	for _, violation := range r.Violations {
+		output += "  " + violation + "\n"
+	}
+
+	if r.Failed() {
+		output += strings.Join(r.Trace, "\n") + "\n"
+	}
+
+	return output
+}
+
+// Explore runs config with runs consecutive seeds starting at config.Seed and
+// returns the first run that failed. Re-running Result.Seed reproduces it.
+func Explore(config Config, runs int) (result Result, failed bool) {
+	base := config.Seed
+	for i := 0; i < runs; i++ {
+		config.Seed = base + int64(i)
+
+		result = New(config).Run()
+		if result.Failed() {
+			return result, true
+		}
+	}
+
+	return result, false
+}
@@ -0,0 +1,115 @@
+package sim
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the participants log every step, which drowns out the test output
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestFaultFree(t *testing.T) {
+	result := New(DefaultConfig(1)).Run()
+
+	if result.Failed() {
+		t.Fatal(result)
+	}
+
+	if result.Committed != 10 || result.Aborted != 0 {
+		t.Errorf("Expected every transaction to commit, got %s", result)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	config := DefaultConfig(42)
+	config.LossRate = 0.05
+	config.Crashes = 2
+
+	first := New(config).Run()
+	second := New(config).Run()
+
+	if len(first.Trace) == 0 {
+		t.Fatal("The simulation didn't record a trace")
+	}
+
+	if first.Failed() {
+		t.Fatal(first)
+	}
+
+	if !reflect.DeepEqual(first, second) {
+		t.Error("Running the same seed twice gave different results")
+	}
+}
+
+func TestCrashedNodeDoesNotCommit(t *testing.T) {
+	config := DefaultConfig(3)
+	config.Transactions = 0
+
+	s := New(config)
+	s.Crash(2)
+	s.Submit(time.Second, 0, []byte("value"))
+	result := s.Run()
+
+	if result.Failed() {
+		t.Fatal(result)
+	}
+
+	if len(s.Nodes[2].db.committed) != 0 {
+		t.Error("A crashed node took part in a transaction")
+	}
+
+	if result.Committed != 1 {
+		t.Errorf("Expected the majority to commit without the crashed node, got %s", result)
+	}
+}
+
+func TestRecoverRunsDeferredTimers(t *testing.T) {
+	config := DefaultConfig(4)
+	config.Transactions = 0
+
+	s := New(config)
+	ran := false
+	s.schedule(time.Second, 1, func() { ran = true })
+	s.CrashAt(0, 1)
+	s.RecoverAt(2*time.Second, 1)
+	s.Run()
+
+	if !ran {
+		t.Error("A timer that came due while the node was crashed never ran")
+	}
+}
+
+func TestExploreWithCrashes(t *testing.T) {
+	config := DefaultConfig(100)
+	config.Crashes = 2
+
+	if result, failed := Explore(config, 20); failed {
+		t.Fatalf("atomicity violated, replay with seed %d\n%s", result.Seed, result)
+	}
+}
+
+func TestExploreWithLoss(t *testing.T) {
+	config := DefaultConfig(200)
+	config.LossRate = 0.05
+
+	if result, failed := Explore(config, 200); failed {
+		t.Fatalf("atomicity violated, replay with seed %d\n%s", result.Seed, result)
+	}
+}
+
+func TestExploreWithLossAndCrashes(t *testing.T) {
+	config := DefaultConfig(400)
+	config.LossRate = 0.05
+	config.Crashes = 2
+
+	if result, failed := Explore(config, 100); failed {
+		t.Fatalf("atomicity violated, replay with seed %d\n%s", result.Seed, result)
+	}
+}
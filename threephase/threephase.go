@@ -1,7 +1,6 @@
 package threephase
 
 import (
-	"encoding/json"
 	"log"
 	"strconv"
 	"sync"
@@ -10,24 +9,22 @@ import (
 	"github.com/josephlewis42/historia/storage"
 )
 
-type Phase int
-
-const (
-	PhaseUncertain = 0
-	PhasePrepared  = 1
-	PhaseCommitted = 2
-	PhaseAborted   = 3
-)
-
 var (
 	PhaseTimeout = time.Second * 1
 )
 
 type ThreePhaseTransaction struct {
 	Peers         []string
-	Data          string
+	Data          []byte
 	TransactionID string
-	status        Phase
+	// Operation says whether Data creates, updates or deletes Key. A nil Key
+	// means the transaction ID is used as the key.
+	Operation storage.Operation
+	Key       []byte
+	// Placement limits the nodes that may take part, each checks it against
+	// its own labels
+	Placement Placement
+	phase     PhaseMachine
 }
 
 type threePhaseInternal struct {
@@ -36,26 +33,45 @@ type threePhaseInternal struct {
 	ch               NodeSet
 	transactions     map[string]*ThreePhaseTransaction
 	transactionslock sync.RWMutex
+	clock            Clock
+
+	codecs     []Codec
+	peerCodecs map[string][]string
+	codecLock  sync.Mutex
+}
+
+// Close stops the timers for recovery and cleanup of transactions, it's
+// mostly useful for shutting down instances created in tests.
+func (this *threePhaseInternal) Close() error {
+	return this.clock.Stop()
 }
 
-func (this *threePhaseInternal) Create(request []byte) (success bool) {
-	return this.timedTransaction(request, this.ch.GetCreateSet)
+func (this *threePhaseInternal) Create(key, value []byte) (success bool) {
+	return this.timedTransaction(storage.OpCreate, key, value, this.ch.GetCreateSet, nil)
 }
 
-func (this *threePhaseInternal) timedTransaction(request []byte, peerGetter func() ([]string, error)) (success bool) {
-	transactionID := strconv.Itoa(int(time.Now().UnixNano()))
+func (this *threePhaseInternal) timedTransaction(op storage.Operation, key, value []byte, peerGetter func() ([]string, error), placement Placement) (success bool) {
+	transactionID := this.NewTransactionID()
 	nodes, err := peerGetter()
 	if err != nil {
 		return false
 	}
 
-	return this.CommitTx(transactionID, request, nodes)
+	return this.commitPlaced(transactionID, op, key, value, nodes, placement)
+}
+
+func (this *threePhaseInternal) NewTransactionID() string {
+	return strconv.Itoa(int(this.clock.Now().UnixNano()))
 }
 
 func (this *threePhaseInternal) Read(request []byte) (results []byte, success bool) {
+	return this.read(request, this.ch.GetReadSet)
+}
+
+func (this *threePhaseInternal) read(request []byte, peerGetter func() ([]string, error)) (results []byte, success bool) {
 	//transactionID := string(time.Now().UnixNano())
 	//nodes, err := this.ch.GetReadSet()
-	nodes, err := this.ch.GetReadSet()
+	nodes, err := peerGetter()
 	if err != nil {
 		return nil, false
 	}
@@ -76,31 +92,53 @@ func (this *threePhaseInternal) Read(request []byte) (results []byte, success bo
 	return this.db.Merge(request, temporary)
 }
 
-func (this *threePhaseInternal) Update(request []byte) (success bool) {
-	return this.timedTransaction(request, this.ch.GetUpdateSet)
+func (this *threePhaseInternal) Update(key, value []byte) (success bool) {
+	return this.timedTransaction(storage.OpUpdate, key, value, this.ch.GetUpdateSet, nil)
 }
 
-func (this *threePhaseInternal) Delete(request []byte) (success bool) {
-	return this.timedTransaction(request, this.ch.GetDeleteSet)
+func (this *threePhaseInternal) Delete(key []byte) (success bool) {
+	return this.timedTransaction(storage.OpDelete, key, nil, this.ch.GetDeleteSet, nil)
 }
 
+// CommitTx creates data under the transaction ID on the given nodes
 func (this *threePhaseInternal) CommitTx(transactionid string, data []byte, nodes []string) (success bool) {
-	if data == nil || nodes == nil {
+	return this.CommitOperation(transactionid, storage.OpCreate, nil, data, nodes)
+}
+
+// CommitOperation applies op to key on the given nodes, a nil key uses the
+// transaction ID.
+func (this *threePhaseInternal) CommitOperation(transactionid string, op storage.Operation, key, data []byte, nodes []string) (success bool) {
+	return this.commitPlaced(transactionid, op, key, data, nodes, nil)
+}
+
+func (this *threePhaseInternal) commitPlaced(transactionid string, op storage.Operation, key, data []byte, nodes []string, placement Placement) (success bool) {
+	if (data == nil && op != storage.OpDelete) || nodes == nil {
 		log.Printf("invalid operands for comit")
 		return false
 	}
 
-	log.Printf("Starting transaction %s\n", transactionid)
+	// only creates may use the transaction ID as the key, anything else
+	// would touch whatever happened to be stored under it
+	if key == nil && op != storage.OpCreate {
+		log.Printf("CommitTx: %s transaction %s needs a key\n", op, transactionid)
+		return false
+	}
+
+	log.Printf("Starting %s transaction %s\n", op, transactionid)
 	transaction := ThreePhaseTransaction{
 		Peers:         nodes,
-		Data:          string(data),
+		Data:          data,
 		TransactionID: transactionid,
+		Operation:     op,
+		Key:           key,
+		Placement:     placement,
 	}
 
-	data, err := json.Marshal(transaction)
+	codec := this.negotiateCodec(nodes)
+	data, err := codec.Encode(&transaction)
 
 	if err != nil {
-		log.Printf("CommitTx: error, could not marshal json %s\n", err)
+		log.Printf("CommitTx: error, could not encode transaction with %s %s\n", codec.Name(), err)
 		return false
 	}
 
@@ -108,24 +146,115 @@ func (this *threePhaseInternal) CommitTx(transactionid string, data []byte, node
 	// initial
 	if !allOkay(this.comm.InitializeTransaction, data, nodes) {
 		log.Printf("Timed out waiting for init for transaction %s\n", transactionid)
-		allOkay(this.comm.Abort, []byte(transactionid), nodes)
+		okayCheck(this.comm.Abort, []byte(transactionid), nodes)
 		return false
 	}
 
 	// precommit
 	log.Printf("Starting precommit for transaction %s\n", transactionid)
-	if !allOkay(this.comm.PreCommit, []byte(transactionid), nodes) {
+	prepared, ambiguous := numPrepared(this.comm.PreCommit, []byte(transactionid), nodes)
+	if prepared == 0 && ambiguous {
+		// the first node may have prepared and lost its reply, it's only safe
+		// to abort once it accepts an abort
+		ok, err := this.comm.Abort([]byte(transactionid), nodes[0])
+		if err != nil {
+			log.Printf("Couldn't tell if %s precommitted transaction %s, leaving it to the termination protocol\n", nodes[0], transactionid)
+			return false
+		}
+
+		if !ok {
+			log.Printf("%s refused to abort transaction %s so it's prepared\n", nodes[0], transactionid)
+			prepared = 1
+		}
+	}
+
+	if prepared == 0 {
 		log.Printf("Timed out waiting for precommit for transaction %s\n", transactionid)
 
-		allOkay(this.comm.Abort, []byte(transactionid), nodes)
+		okayCheck(this.comm.Abort, []byte(transactionid), nodes)
 		return false
 	}
 
+	// once a node is prepared it will commit on its own if it doesn't hear
+	// from us, so aborting now could split the cohort. Push on instead.
+	if prepared < len(nodes) {
+		log.Printf("Only %d of %d nodes precommitted transaction %s, committing anyway\n", prepared, len(nodes), transactionid)
+		okayCheck(this.comm.PreCommit, []byte(transactionid), nodes[prepared:])
+	}
+
 	// commit
 	log.Printf("Starting commit for transaction %s\n", transactionid)
 	return allOkay(this.comm.DoCommit, []byte(transactionid), nodes)
 }
 
+// SetCodecs sets the codecs this node prefers to send transactions with, in
+// order. Incoming transactions are decoded whatever codec they use.
+func (this *threePhaseInternal) SetCodecs(preferred ...Codec) {
+	this.codecLock.Lock()
+	defer this.codecLock.Unlock()
+
+	this.codecs = preferred
+	this.peerCodecs = make(map[string][]string)
+}
+
+// SupportedCodecs returns the names of the codecs this node prefers
+func (this *threePhaseInternal) SupportedCodecs() []string {
+	this.codecLock.Lock()
+	defer this.codecLock.Unlock()
+
+	return CodecNames(this.codecs)
+}
+
+// negotiateCodec picks a codec every node understands. If the communication
+// handler can't ask the nodes then JSON is used since every node speaks it.
+// The lock is only held to use the cache, never while asking other nodes,
+// since they may be asking us at the same time.
+func (this *threePhaseInternal) negotiateCodec(nodes []string) Codec {
+	negotiator, ok := this.comm.(CodecNegotiator)
+	if !ok {
+		return JSONCodec
+	}
+
+	self := ""
+	if local, ok := this.ch.(LocalNode); ok {
+		self = local.Self()
+	}
+
+	this.codecLock.Lock()
+	preferred := this.codecs
+	this.codecLock.Unlock()
+
+	remotes := [][]string{}
+	for _, node := range nodes {
+		if node == self {
+			remotes = append(remotes, CodecNames(preferred))
+			continue
+		}
+
+		this.codecLock.Lock()
+		names, found := this.peerCodecs[node]
+		this.codecLock.Unlock()
+
+		if !found {
+			var err error
+			names, err = negotiator.Codecs(node)
+			if err != nil {
+				// remember the failure so the next transaction doesn't wait
+				// on the node again, it's asked again after SetCodecs
+				log.Printf("negotiateCodec: couldn't get codecs from %s, using json: %s\n", node, err)
+				names = []string{JSONCodec.Name()}
+			}
+
+			this.codecLock.Lock()
+			this.peerCodecs[node] = names
+			this.codecLock.Unlock()
+		}
+		remotes = append(remotes, names)
+	}
+
+	return NegotiateCodec(preferred, remotes...)
+}
+
 func allOkay(callback func(request []byte, destination string) (ok bool, err error), data []byte, nodes []string) bool {
 	for _, node := range nodes {
 		ok, err := callback(data, node)
@@ -143,6 +272,21 @@ func allOkay(callback func(request []byte, destination string) (ok bool, err err
 	return true
 }
 
+// numPrepared sends callback to each node in turn until one fails, returning
+// the number that succeeded. ambiguous is set if the failure was an error
+// rather than a refusal, so the node may have prepared anyway.
+func numPrepared(callback func(request []byte, destination string) (ok bool, err error), data []byte, nodes []string) (prepared int, ambiguous bool) {
+	for index, node := range nodes {
+		ok, err := callback(data, node)
+		if err != nil || !ok {
+			log.Printf("Threephase::numPrepared, node %s failed: ok: %t err: %v", node, ok, err)
+			return index, err != nil
+		}
+	}
+
+	return len(nodes), false
+}
+
 func okayCheck(callback func(request []byte, destination string) (ok bool, err error), data []byte, nodes []string) (numOkay, numNotOkay, numErr int) {
 
 	for _, node := range nodes {
@@ -165,10 +309,10 @@ func okayCheck(callback func(request []byte, destination string) (ok bool, err e
 func (this *threePhaseInternal) InitializeTransaction(encodedTransaction []byte) (ok bool) {
 	var tx ThreePhaseTransaction
 
-	err := json.Unmarshal(encodedTransaction, &tx)
+	err := DecodeTransaction(encodedTransaction, &tx)
 
 	if err != nil {
-		log.Printf("InitializeTransaction: error decoding json %s, %s\n", err, string(encodedTransaction))
+		log.Printf("InitializeTransaction: error decoding transaction %s\n", err)
 		return false
 	}
 
@@ -177,8 +321,6 @@ func (this *threePhaseInternal) InitializeTransaction(encodedTransaction []byte)
 	this.transactionslock.Lock()
 	defer this.transactionslock.Unlock()
 
-	tx.status = PhaseUncertain
-
 	// make sure the transaction hasn't already started
 	_, found := this.transactions[transactionid]
 	if found {
@@ -186,15 +328,29 @@ func (this *threePhaseInternal) InitializeTransaction(encodedTransaction []byte)
 		return false
 	}
 
+	if !this.placedHere(tx.Placement) {
+		log.Printf("InitializeTransaction: transaction %s isn't allowed on this node by its placement\n", transactionid)
+		return false
+	}
+
+	key := tx.Key
+	if key == nil && tx.Operation != storage.OpCreate {
+		log.Printf("InitializeTransaction: %s transaction %s has no key\n", tx.Operation, transactionid)
+		return false
+	}
+	if key == nil {
+		key = []byte(transactionid)
+	}
+
 	// Make sure the database wants to accept the transaction
-	ok = this.db.Prepare([]byte(transactionid), []byte(tx.Data))
-	if !ok {
-		log.Printf("InitializeTransaction, database would not precommit")
+	err = this.db.PrepareOperation([]byte(transactionid), tx.Operation, key, tx.Data)
+	if err != nil {
+		log.Printf("InitializeTransaction, database would not precommit %s on %s: %s\n", tx.Operation, string(key), err)
 		return false
 	}
 
 	this.transactions[transactionid] = &tx
-	go this.terminationProtocol(transactionid)
+	this.scheduleTermination(transactionid)
 	// TODO check if anyone got precommit
 
 	return true
@@ -211,16 +367,21 @@ func (this *threePhaseInternal) Abort(transactionID string) (ok bool) {
 		return false
 	}
 
-	if item.status == PhaseCommitted {
-		log.Printf("Abort: transaction %s was already comitted\n", transactionID)
+	// aborting twice is fine, the termination protocol relies on it to
+	// learn a peer has aborted
+	if item.phase.Phase() == PhaseAborted {
+		return true
+	}
+
+	if err := item.phase.Transition(PhaseAborted); err != nil {
+		log.Printf("Abort: transaction %s can't be aborted: %s\n", transactionID, err)
 		return false
 	}
 
 	// abort the data
 	this.db.Abort([]byte(transactionID))
-	item.status = PhaseAborted
 
-	go this.autoCleanup(transactionID)
+	this.scheduleCleanup(transactionID)
 	return true
 }
 
@@ -235,22 +396,26 @@ func (this *threePhaseInternal) DoCommit(transactionID string) (ok bool) {
 		return false
 	}
 
-	if item.status != PhasePrepared {
-		log.Printf("Commit: transaction %s isn't in the prepared phase, its phase is %d\n", transactionID, item.status)
+	if err := item.phase.Transition(PhaseCommitted); err != nil {
+		log.Printf("Commit: transaction %s can't be committed: %s\n", transactionID, err)
 		return false
 	}
 
 	// commit the data
 	this.db.Commit([]byte(transactionID))
-	item.status = PhaseCommitted
 
-	go this.autoCleanup(transactionID)
+	this.scheduleCleanup(transactionID)
 	return true
 }
 
-// autoCleanup automatically removes a transaction after a given amount of time so the map doesn't grow too large
+// scheduleCleanup removes a transaction after a given amount of time so the map doesn't grow too large
+func (this *threePhaseInternal) scheduleCleanup(transactionID string) {
+	this.clock.AfterFunc(PhaseTimeout*100, func() {
+		this.autoCleanup(transactionID)
+	})
+}
+
 func (this *threePhaseInternal) autoCleanup(transactionID string) {
-	time.Sleep(PhaseTimeout * 100)
 	this.transactionslock.Lock()
 	defer this.transactionslock.Unlock()
 
@@ -270,22 +435,20 @@ func (this *threePhaseInternal) PreCommit(transactionID string) (ok bool) {
 		return false
 	}
 
-	if item.status != PhaseUncertain {
-		log.Printf("item in wrong status for precommit %s, got %d\n", transactionID, item.status)
+	if err := item.phase.Transition(PhasePrepared); err != nil {
+		log.Printf("PreCommit: transaction %s can't be precommitted: %s\n", transactionID, err)
 		return false
 	}
 
-	item.status = PhasePrepared
-	this.transactions[transactionID] = item
-
 	// auto-commit after a certain amount of time
-	go this.autoCommit(transactionID)
+	this.clock.AfterFunc(PhaseTimeout*2, func() {
+		this.autoCommit(transactionID)
+	})
 
 	return true
 }
 
 func (this *threePhaseInternal) autoCommit(transactionID string) bool {
-	time.Sleep(PhaseTimeout * 2)
 	status, _ := this.getTransactionStatus(transactionID)
 	if status != PhasePrepared {
 		return false
@@ -307,7 +470,7 @@ func (this *threePhaseInternal) getTransactionStatus(transactionID string) (phas
 		return PhaseUncertain, false
 	}
 
-	return item.status, true
+	return item.phase.Phase(), true
 }
 
 func (this *threePhaseInternal) CheckCommit(transactionID string) (didcommit bool) {
@@ -328,32 +491,78 @@ func (this *threePhaseInternal) getPeers(transactionID string) []string {
 
 }
 
+// terminateUncertain resolves a transaction we never got a precommit for,
+// e.g. because the coordinator crashed, so its keys don't stay locked. If a
+// peer is prepared the coordinator decided to commit, so we do too.
+// Otherwise we abort, but only once the first peer has aborted: coordinators
+// precommit the peers in order and give up if the first refuses, so nobody can
+// commit after that.
+func (this *threePhaseInternal) terminateUncertain(transactionID string, peers []string) {
+	numOkay, _, _ := okayCheck(this.comm.CheckCommit, []byte(transactionID), peers)
+	if numOkay > 0 {
+		log.Printf("Termination Protocol: a peer is prepared for %s, committing\n", transactionID)
+		this.commitUncertain(transactionID)
+		return
+	}
+
+	ok, err := this.comm.Abort([]byte(transactionID), peers[0])
+	if err != nil || !ok {
+		log.Printf("Termination Protocol: couldn't abort %s on %s, trying again later: %v\n", transactionID, peers[0], err)
+		this.scheduleTermination(transactionID)
+		return
+	}
+
+	log.Printf("Termination Protocol: transaction %s was never precommitted, aborting\n", transactionID)
+	this.Abort(transactionID)
+}
+
+// commitUncertain commits a transaction we never got a precommit for
+func (this *threePhaseInternal) commitUncertain(transactionID string) {
+	this.transactionslock.Lock()
+	item, found := this.transactions[transactionID]
+	if found && item.phase.Phase() == PhaseUncertain {
+		item.phase.Transition(PhasePrepared)
+	}
+	this.transactionslock.Unlock()
+
+	this.DoCommit(transactionID)
+}
+
+// scheduleTermination queues the next round of the termination protocol
+func (this *threePhaseInternal) scheduleTermination(transactionID string) {
+	this.clock.AfterFunc(PhaseTimeout*2, func() {
+		this.terminationProtocol(transactionID)
+	})
+}
+
+// terminationProtocol runs a single round of the termination protocol and
+// schedules another if the transaction still hasn't been decided.
 func (this *threePhaseInternal) terminationProtocol(transactionID string) {
-	for {
-		time.Sleep(PhaseTimeout * 2)
-		status, _ := this.getTransactionStatus(transactionID)
-		peers := this.getPeers(transactionID)
+	status, found := this.getTransactionStatus(transactionID)
+	peers := this.getPeers(transactionID)
 
-		if status != PhasePrepared || peers == nil {
-			return
-		}
+	if found && status == PhaseUncertain && peers != nil {
+		this.terminateUncertain(transactionID, peers)
+		return
+	}
 
-		numOkay, numNotOkay, numErr := okayCheck(this.comm.CheckCommit, []byte(transactionID), peers)
+	if status != PhasePrepared || peers == nil {
+		return
+	}
 
-		if numOkay > 0 {
-			log.Printf("Termination Protocol one host was okay\n")
-			this.DoCommit(transactionID)
-			return
-		}
+	numOkay, numNotOkay, numErr := okayCheck(this.comm.CheckCommit, []byte(transactionID), peers)
 
-		if numErr > 1 {
-			log.Printf("Termination Protocol Error, > 1 host down: ok: %d !ok: %d err: %d\n", numOkay, numNotOkay, numErr)
-		}
+	if numOkay > 0 {
+		log.Printf("Termination Protocol one host was okay\n")
+		this.DoCommit(transactionID)
+		return
+	}
 
-		if numNotOkay == len(peers)-1 {
-			log.Printf("Termination Protocol no hosts were okay\n")
-			this.Abort(transactionID)
-			return
-		}
+	if numErr > 1 {
+		log.Printf("Termination Protocol Error, > 1 host down: ok: %d !ok: %d err: %d\n", numOkay, numNotOkay, numErr)
 	}
+
+	// a prepared transaction can't be aborted since a peer may have
+	// committed it already, so keep asking until someone confirms
+	this.scheduleTermination(transactionID)
 }
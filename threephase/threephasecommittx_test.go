@@ -3,6 +3,7 @@ package threephase
 import (
 	"errors"
 	"log"
+	"reflect"
 	"testing"
 	"time"
 
@@ -99,6 +100,28 @@ func txTestHelper(t *testing.T, fakeComm fakeCommunicationHandler, hosts []strin
 	<-finished
 }
 
+func TestCommitOperationNeedsKey(t *testing.T) {
+	var data = []struct {
+		op       storage.Operation
+		expected bool
+	}{
+		{storage.OpCreate, true},
+		{storage.OpUpdate, false},
+		{storage.OpDelete, false},
+	}
+
+	for _, tc := range data {
+		fakeComm := newFakeComm(testHosts)
+		db := storage.NewInMemoryStorage()
+		tpc := NewThreePhaseCommit(&fakeComm, db, &fakeComm)
+
+		if ok := tpc.CommitOperation("tx", tc.op, nil, []byte("data"), testHosts); ok != tc.expected {
+			t.Errorf("%s with a nil key: expected %t got %t", tc.op, tc.expected, ok)
+		}
+		tpc.Close()
+	}
+}
+
 func TestCommitTxInitError(t *testing.T) {
 	abortc := make(chan string)
 	fakeComm := newFakeComm(testHosts)
@@ -128,7 +151,7 @@ func TestCommitTxInitTimeout(t *testing.T) {
 }
 
 func TestCommitTxPrecommitTimeout(t *testing.T) {
-	abortc := make(chan string)
+	abortc := make(chan string, len(testHosts)+1)
 	fakeComm := newFakeComm(testHosts)
 
 	fakeComm.PreCommitI = newHandlerCallback(nil, []string{"host1"}, nil)
@@ -138,7 +161,71 @@ func TestCommitTxPrecommitTimeout(t *testing.T) {
 		fakeComm,
 		testHosts,
 		false, // expected result
-		map[string]chan string{"abort": abortc})
+		map[string]chan string{})
+
+	// host1 might have prepared, so it's asked to abort before anyone else
+	close(abortc)
+	aborted := []string{}
+	for host := range abortc {
+		aborted = append(aborted, host)
+	}
+	if !reflect.DeepEqual(aborted, []string{"host1", "host1", "host2"}) {
+		t.Errorf("expected host1 to abort first, got %v", aborted)
+	}
+}
+
+func TestCommitTxPrecommitLostReply(t *testing.T) {
+	commitc := make(chan string)
+	fakeComm := newFakeComm(testHosts)
+
+	// host1 prepared but its reply was lost, so it refuses the abort and
+	// the transaction has to go ahead
+	fakeComm.PreCommitI = newHandlerCallback(nil, []string{"host1"}, nil)
+	fakeComm.AbortI = newHandlerCallback([]string{"host1"}, nil, nil)
+	fakeComm.DoCommitI = newHandlerCallback(nil, nil, commitc)
+
+	txTestHelper(t,
+		fakeComm,
+		testHosts,
+		true, // expected result
+		map[string]chan string{"commit": commitc})
+}
+
+func TestCommitTxPrecommitUnknown(t *testing.T) {
+	fakeComm := newFakeComm(testHosts)
+
+	// nobody can tell if host1 prepared, the others are left for the
+	// termination protocol rather than aborted
+	fakeComm.PreCommitI = newHandlerCallback(nil, []string{"host1"}, nil)
+	fakeComm.AbortI = func(tx []byte, dest string) (bool, error) {
+		if dest != "host1" {
+			t.Errorf("%s was aborted although host1 may have prepared", dest)
+		}
+		return false, errors.New("host1 fake timed out")
+	}
+
+	txTestHelper(t,
+		fakeComm,
+		testHosts,
+		false, // expected result
+		map[string]chan string{})
+}
+
+func TestCommitTxPartialPrecommit(t *testing.T) {
+	commitc := make(chan string)
+	fakeComm := newFakeComm(testHosts)
+
+	// host1 may commit on its own once it's prepared, so the coordinator
+	// has to carry on rather than abort
+	fakeComm.PreCommitI = newHandlerCallback(nil, []string{"host2"}, nil)
+	fakeComm.AbortI = newHandlerCallback(nil, nil, nil)
+	fakeComm.DoCommitI = newHandlerCallback(nil, nil, commitc)
+
+	txTestHelper(t,
+		fakeComm,
+		testHosts,
+		true, // expected result
+		map[string]chan string{"commit": commitc})
 }
 
 func TestCommitTxCommitTimeout(t *testing.T) {
@@ -3,12 +3,24 @@ package threephase
 import "github.com/josephlewis42/historia/storage"
 
 type ThreePhaseCommit interface {
-	Create(request []byte) (success bool)
+	// Create stores value under a key that must not exist yet, a nil key
+	// stores it under the new transaction's ID.
+	Create(key, value []byte) (success bool)
 	Read(request []byte) (results []byte, success bool)
-	Update(request []byte) (success bool)
-	Delete(request []byte) (success bool)
+	// Update replaces the value of an existing key
+	Update(key, value []byte) (success bool)
+	// Delete removes an existing key
+	Delete(key []byte) (success bool)
 
 	CommitTx(transactionid string, data []byte, nodes []string) (success bool)
+	// CommitOperation is CommitTx for any operation and key
+	CommitOperation(transactionid string, op storage.Operation, key, data []byte, nodes []string) (success bool)
+	// NewTransactionID makes an ID for CommitTx and CommitOperation from the
+	// clock, the same way Create, Update and Delete do
+	NewTransactionID() string
+	// WithPlacement returns a view whose transactions only go to nodes
+	// satisfying placement, which the participants check for themselves
+	WithPlacement(placement Placement) ThreePhaseCommit
 
 	// these methods are called by an external handler
 	InitializeTransaction(transaction []byte) (ok bool)
@@ -16,17 +28,34 @@ type ThreePhaseCommit interface {
 	DoCommit(transactionID string) (ok bool)
 	PreCommit(transactionID string) (ok bool)
 	CheckCommit(transactionID string) (didcommit bool)
+
+	// SetCodecs sets the codecs used to send transactions in order of
+	// preference, SupportedCodecs reports them to other nodes.
+	SetCodecs(preferred ...Codec)
+	SupportedCodecs() []string
+
+	// Close stops the background timers used for recovery and cleanup
+	Close() error
 }
 
 func NewThreePhaseCommit(comm CommunicationHandler, db storage.Storage, ch NodeSet) ThreePhaseCommit {
-	return newThreePhaseInternal(comm, db, ch)
+	return newThreePhaseInternal(comm, db, ch, NewRealClock())
+}
+
+// NewThreePhaseCommitWithClock creates a ThreePhaseCommit that reads the time
+// and schedules its timeouts using the given clock rather than the real one.
+func NewThreePhaseCommitWithClock(comm CommunicationHandler, db storage.Storage, ch NodeSet, clock Clock) ThreePhaseCommit {
+	return newThreePhaseInternal(comm, db, ch, clock)
 }
 
-func newThreePhaseInternal(comm CommunicationHandler, db storage.Storage, ch NodeSet) *threePhaseInternal {
+func newThreePhaseInternal(comm CommunicationHandler, db storage.Storage, ch NodeSet, clock Clock) *threePhaseInternal {
 	return &threePhaseInternal{
 		comm:         comm,
 		db:           db,
 		ch:           ch,
 		transactions: make(map[string]*ThreePhaseTransaction),
+		clock:        clock,
+		codecs:       DefaultCodecs,
+		peerCodecs:   make(map[string][]string),
 	}
 }
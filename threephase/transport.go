@@ -0,0 +1,151 @@
+package threephase
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	UnsupportedMessageError = errors.New("The message kind isn't supported by this transport")
+)
+
+// Message is a single request from one node to another, Payload holds the
+// encoded transaction for MessageInit and the transaction ID for the other
+// protocol messages.
+type Message struct {
+	Kind    MessageKind
+	Payload []byte
+}
+
+// Reply is the answer to a Message, OK is the result of the protocol calls
+// and Payload carries anything else, like the result of a read.
+type Reply struct {
+	OK      bool
+	Payload []byte
+}
+
+// Transport sends every kind of message through a single method, so new kinds
+// of message don't require changes to the interface. Transports return
+// UnsupportedMessageError for kinds they don't know.
+type Transport interface {
+	Send(ctx context.Context, destination string, message Message) (Reply, error)
+}
+
+// TransportFunc lets an ordinary function act as a Transport
+type TransportFunc func(ctx context.Context, destination string, message Message) (Reply, error)
+
+func (f TransportFunc) Send(ctx context.Context, destination string, message Message) (Reply, error) {
+	return f(ctx, destination, message)
+}
+
+// NewHandlerTransport adapts a CommunicationHandler to a Transport. The
+// handler's calls can't be cancelled so the context is only checked before
+// sending.
+func NewHandlerTransport(comm CommunicationHandler) Transport {
+	return TransportFunc(func(ctx context.Context, destination string, message Message) (Reply, error) {
+		if err := ctx.Err(); err != nil {
+			return Reply{}, err
+		}
+
+		var ok bool
+		var err error
+
+		switch message.Kind {
+		case MessageInit:
+			ok, err = comm.InitializeTransaction(message.Payload, destination)
+		case MessagePreCommit:
+			ok, err = comm.PreCommit(message.Payload, destination)
+		case MessageCommit:
+			ok, err = comm.DoCommit(message.Payload, destination)
+		case MessageAbort:
+			ok, err = comm.Abort(message.Payload, destination)
+		case MessageCheck:
+			ok, err = comm.CheckCommit(message.Payload, destination)
+		case MessageRead:
+			result, err := comm.ReadData(message.Payload, destination)
+			return Reply{OK: err == nil, Payload: result}, err
+		case MessageCodecs:
+			negotiator, found := comm.(CodecNegotiator)
+			if !found {
+				return Reply{}, UnsupportedMessageError
+			}
+			names, err := negotiator.Codecs(destination)
+			return Reply{OK: err == nil, Payload: []byte(strings.Join(names, ","))}, err
+		default:
+			return Reply{}, UnsupportedMessageError
+		}
+
+		return Reply{OK: ok}, err
+	})
+}
+
+type transportHandler struct {
+	transport Transport
+}
+
+// NewTransportHandler adapts a Transport to a CommunicationHandler so it can be
+// given to NewThreePhaseCommit. It's also a CodecNegotiator.
+func NewTransportHandler(transport Transport) CommunicationHandler {
+	return &transportHandler{transport: transport}
+}
+
+func (this *transportHandler) send(kind MessageKind, payload []byte, destination string) (ok bool, err error) {
+	reply, err := this.transport.Send(context.Background(), destination, Message{Kind: kind, Payload: payload})
+	return reply.OK, err
+}
+
+func (this *transportHandler) InitializeTransaction(tx []byte, destination string) (ok bool, err error) {
+	return this.send(MessageInit, tx, destination)
+}
+
+func (this *transportHandler) Abort(transactionID []byte, destination string) (ok bool, err error) {
+	return this.send(MessageAbort, transactionID, destination)
+}
+
+func (this *transportHandler) DoCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return this.send(MessageCommit, transactionID, destination)
+}
+
+func (this *transportHandler) PreCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return this.send(MessagePreCommit, transactionID, destination)
+}
+
+func (this *transportHandler) CheckCommit(transactionID []byte, destination string) (didcommit bool, err error) {
+	return this.send(MessageCheck, transactionID, destination)
+}
+
+func (this *transportHandler) ReadData(request []byte, destination string) (result []byte, err error) {
+	reply, err := this.transport.Send(context.Background(), destination, Message{Kind: MessageRead, Payload: request})
+	return reply.Payload, err
+}
+
+func (this *transportHandler) Codecs(destination string) ([]string, error) {
+	reply, err := this.transport.Send(context.Background(), destination, Message{Kind: MessageCodecs})
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(reply.Payload), ","), nil
+}
+
+// HandleMessage delivers a protocol message to the participant methods of tpc,
+// it's the receiving end for transports. Reads aren't handled since they need
+// the node's storage.
+func HandleMessage(tpc ThreePhaseCommit, message Message) (Reply, error) {
+	switch message.Kind {
+	case MessageInit:
+		return Reply{OK: tpc.InitializeTransaction(message.Payload)}, nil
+	case MessagePreCommit:
+		return Reply{OK: tpc.PreCommit(string(message.Payload))}, nil
+	case MessageCommit:
+		return Reply{OK: tpc.DoCommit(string(message.Payload))}, nil
+	case MessageAbort:
+		return Reply{OK: tpc.Abort(string(message.Payload))}, nil
+	case MessageCheck:
+		return Reply{OK: tpc.CheckCommit(string(message.Payload))}, nil
+	case MessageCodecs:
+		return Reply{OK: true, Payload: []byte(strings.Join(tpc.SupportedCodecs(), ","))}, nil
+	}
+
+	return Reply{}, UnsupportedMessageError
+}
@@ -0,0 +1,86 @@
+package threephase
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/josephlewis42/historia/storage"
+)
+
+func TestHandlerTransport(t *testing.T) {
+	fakeComm := newFakeComm(testHosts)
+	fakeComm.AbortI = newHandlerCallback([]string{"b"}, []string{"c"}, nil)
+	transport := NewHandlerTransport(&fakeComm)
+
+	var data = []struct {
+		kind        MessageKind
+		destination string
+		ok          bool
+		err         bool
+	}{
+		{MessageInit, "a", true, false},
+		{MessageAbort, "a", true, false},
+		{MessageAbort, "b", false, false},
+		{MessageAbort, "c", false, true},
+		{MessageRead, "a", true, false},
+		{MessageCodecs, "a", false, true},
+		{MessageKind(99), "a", false, true},
+	}
+
+	for _, tc := range data {
+		reply, err := transport.Send(context.Background(), tc.destination, Message{Kind: tc.kind, Payload: []byte("1")})
+		if reply.OK != tc.ok || (err != nil) != tc.err {
+			t.Errorf("%s to %s: expected ok %t err %t got %+v %v", tc.kind, tc.destination, tc.ok, tc.err, reply, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := transport.Send(ctx, "a", Message{Kind: MessageInit}); err != context.Canceled {
+		t.Errorf("expected a cancelled context to stop the send, got %v", err)
+	}
+}
+
+func TestTransportHandler(t *testing.T) {
+	db := storage.NewInMemoryStorage()
+	participant := NewThreePhaseCommit(nil, db, nil)
+	defer participant.Close()
+
+	sent := []MessageKind{}
+	transport := TransportFunc(func(ctx context.Context, destination string, message Message) (Reply, error) {
+		sent = append(sent, message.Kind)
+		return HandleMessage(participant, message)
+	})
+
+	fakeComm := newFakeComm(testHosts)
+	coordinator := NewThreePhaseCommit(NewTransportHandler(transport), storage.NewInMemoryStorage(), &fakeComm)
+	defer coordinator.Close()
+
+	if !coordinator.CommitTx("1", []byte("data"), []string{"a"}) {
+		t.Fatal("the transaction didn't commit through the transport")
+	}
+
+	expected := []MessageKind{MessageCodecs, MessageInit, MessagePreCommit, MessageCommit}
+	if len(sent) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, sent)
+	}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Errorf("expected %v got %v", expected, sent)
+		}
+	}
+
+	if value, ok := db.Read([]byte("1")); !ok || string(value) != "data" {
+		t.Errorf("the participant didn't store the value, got %q %t", value, ok)
+	}
+
+	if _, err := HandleMessage(participant, Message{Kind: MessageRead}); err != UnsupportedMessageError {
+		t.Errorf("expected reads to be unsupported, got %v", err)
+	}
+
+	codecs, err := NewTransportHandler(transport).(CodecNegotiator).Codecs("a")
+	if err != nil || !reflect.DeepEqual(codecs, participant.SupportedCodecs()) {
+		t.Errorf("expected the participant's codecs, got %v %v", codecs, err)
+	}
+}
@@ -0,0 +1,214 @@
+// Package chantransport connects nodes running in the same process through Go
+// channels. A Network is both the transport between the nodes and the
+// cohort.LivenessChecker reporting which of them are running, so a whole
+// cluster can run in a test or demo without sockets. Nodes can be stopped
+// and started again to simulate failures.
+package chantransport
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	UnknownNodeError   = errors.New("No node is registered under that name")
+	NodeExistsError    = errors.New("A node is already registered under that name")
+	NodeStoppedError   = errors.New("The node is stopped")
+	NetworkClosedError = errors.New("The network has been closed")
+	NodeRunningError   = errors.New("The node is already running")
+)
+
+// Network routes messages between the nodes registered with it
+type Network struct {
+	lock   sync.RWMutex
+	nodes  map[string]*endpoint
+	closed bool
+}
+
+// endpoint is a registered node, a goroutine answers requests on its channel
+// one at a time.
+type endpoint struct {
+	tpc      threephase.ThreePhaseCommit
+	db       storage.Storage
+	requests chan request
+	done     chan struct{}
+	running  bool
+}
+
+type request struct {
+	message threephase.Message
+	reply   chan response
+}
+
+type response struct {
+	reply threephase.Reply
+	err   error
+}
+
+func NewNetwork() *Network {
+	return &Network{nodes: make(map[string]*endpoint)}
+}
+
+// Register adds a running node under name whose participant methods are
+// answered by tpc and reads by db.
+func (this *Network) Register(name string, tpc threephase.ThreePhaseCommit, db storage.Storage) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return NetworkClosedError
+	}
+
+	if _, found := this.nodes[name]; found {
+		return NodeExistsError
+	}
+
+	node := &endpoint{tpc: tpc, db: db, requests: make(chan request), done: make(chan struct{}), running: true}
+	this.nodes[name] = node
+	go node.serve()
+	return nil
+}
+
+func (this *endpoint) serve() {
+	for {
+		var req request
+		select {
+		case req = <-this.requests:
+		case <-this.done:
+			return
+		}
+
+		var result response
+
+		switch req.message.Kind {
+		case threephase.MessageRead:
+			value, ok := this.db.Read(req.message.Payload)
+			result.reply = threephase.Reply{OK: ok, Payload: value}
+			if !ok {
+				result.err = storage.KeyNotFoundError
+			}
+		default:
+			result.reply, result.err = threephase.HandleMessage(this.tpc, req.message)
+		}
+
+		req.reply <- result
+	}
+}
+
+// Stop makes name unreachable, it can neither send nor receive until Start
+func (this *Network) Stop(name string) error {
+	return this.setRunning(name, false)
+}
+
+// Start brings a stopped node back
+func (this *Network) Start(name string) error {
+	return this.setRunning(name, true)
+}
+
+func (this *Network) setRunning(name string, running bool) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	node, found := this.nodes[name]
+	if !found {
+		return UnknownNodeError
+	}
+
+	if running && node.running {
+		return NodeRunningError
+	}
+
+	if !running && !node.running {
+		return NodeStoppedError
+	}
+
+	node.running = running
+	return nil
+}
+
+// GetAliveHosts returns the names of the running nodes in order
+func (this *Network) GetAliveHosts() []string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	alive := []string{}
+	for name, node := range this.nodes {
+		if node.running {
+			alive = append(alive, name)
+		}
+	}
+
+	sort.Strings(alive)
+	return alive
+}
+
+// Transport returns the Transport the node source uses to send messages
+func (this *Network) Transport(source string) threephase.Transport {
+	return threephase.TransportFunc(func(ctx context.Context, destination string, message threephase.Message) (threephase.Reply, error) {
+		return this.send(ctx, source, destination, message)
+	})
+}
+
+// Handler returns the CommunicationHandler to give the node source's
+// ThreePhaseCommit, it can be created before the node is registered.
+func (this *Network) Handler(source string) threephase.CommunicationHandler {
+	return threephase.NewTransportHandler(this.Transport(source))
+}
+
+func (this *Network) send(ctx context.Context, source, destination string, message threephase.Message) (threephase.Reply, error) {
+	this.lock.RLock()
+	closed := this.closed
+	from, fromFound := this.nodes[source]
+	to, toFound := this.nodes[destination]
+	sourceUp := !fromFound || from.running
+	destinationUp := toFound && to.running
+	this.lock.RUnlock()
+
+	switch {
+	case closed:
+		return threephase.Reply{}, NetworkClosedError
+	case !toFound:
+		return threephase.Reply{}, UnknownNodeError
+	case !sourceUp || !destinationUp:
+		return threephase.Reply{}, NodeStoppedError
+	}
+
+	req := request{message: message, reply: make(chan response, 1)}
+
+	select {
+	case to.requests <- req:
+	case <-to.done:
+		return threephase.Reply{}, NetworkClosedError
+	case <-ctx.Done():
+		return threephase.Reply{}, ctx.Err()
+	}
+
+	select {
+	case result := <-req.reply:
+		return result.reply, result.err
+	case <-ctx.Done():
+		return threephase.Reply{}, ctx.Err()
+	}
+}
+
+// Close stops every node's goroutine, the nodes' ThreePhaseCommits aren't
+// closed.
+func (this *Network) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return NetworkClosedError
+	}
+	this.closed = true
+
+	for _, node := range this.nodes {
+		close(node.done)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package chantransport
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/josephlewis42/historia/cohort"
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+type testCluster struct {
+	network *Network
+	names   []string
+	tpcs    []threephase.ThreePhaseCommit
+	dbs     []storage.Storage
+}
+
+// newTestCluster registers n nodes that each pick a majority of the running
+// nodes for every write
+func newTestCluster(t *testing.T, n int) *testCluster {
+	cluster := &testCluster{network: NewNetwork()}
+	for i := 0; i < n; i++ {
+		cluster.names = append(cluster.names, "node"+strconv.Itoa(i))
+	}
+
+	for i, name := range cluster.names {
+		db := storage.NewInMemoryStorage()
+		chrt := cohort.NewCohort(i, cluster.names, cohort.NewReadMajorityWriteMajority(n), cluster.network)
+		tpc := threephase.NewThreePhaseCommit(cluster.network.Handler(name), db, &chrt)
+
+		if err := cluster.network.Register(name, tpc, db); err != nil {
+			t.Fatal(err)
+		}
+
+		cluster.tpcs = append(cluster.tpcs, tpc)
+		cluster.dbs = append(cluster.dbs, db)
+	}
+
+	t.Cleanup(func() {
+		cluster.network.Close()
+		for _, tpc := range cluster.tpcs {
+			tpc.Close()
+		}
+	})
+
+	return cluster
+}
+
+func TestFiveNodeCluster(t *testing.T) {
+	cluster := newTestCluster(t, 5)
+
+	if !cluster.tpcs[0].Create([]byte("key"), []byte("value")) {
+		t.Fatal("couldn't create with every node running")
+	}
+
+	stored := 0
+	for _, db := range cluster.dbs {
+		if value, ok := db.Read([]byte("key")); ok && string(value) == "value" {
+			stored++
+		}
+	}
+	if stored != 3 {
+		t.Errorf("expected the value on a majority of 3 nodes, it was on %d", stored)
+	}
+
+	cluster.network.Stop("node3")
+	cluster.network.Stop("node4")
+
+	if !cluster.tpcs[0].Create([]byte("second"), []byte("value")) {
+		t.Error("couldn't create with a majority running")
+	}
+
+	cluster.network.Stop("node2")
+
+	if cluster.tpcs[0].Create([]byte("third"), []byte("value")) {
+		t.Error("created without a majority running")
+	}
+
+	cluster.network.Start("node2")
+
+	if !cluster.tpcs[0].Create([]byte("third"), []byte("value")) {
+		t.Error("couldn't create after a node came back")
+	}
+}
+
+func TestStoppedNodes(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	network := cluster.network
+	read := threephase.Message{Kind: threephase.MessageCheck, Payload: []byte("1")}
+
+	if !reflect.DeepEqual(network.GetAliveHosts(), []string{"node0", "node1", "node2"}) {
+		t.Errorf("expected every node alive, got %v", network.GetAliveHosts())
+	}
+
+	network.Stop("node1")
+
+	if !reflect.DeepEqual(network.GetAliveHosts(), []string{"node0", "node2"}) {
+		t.Errorf("expected node1 to be missing, got %v", network.GetAliveHosts())
+	}
+
+	var data = []struct {
+		source      string
+		destination string
+		expected    error
+	}{
+		{"node0", "node2", nil},
+		{"node0", "node1", NodeStoppedError},
+		{"node1", "node0", NodeStoppedError},
+		{"node0", "missing", UnknownNodeError},
+		{"outsider", "node0", nil},
+	}
+
+	for _, tc := range data {
+		_, err := network.Transport(tc.source).Send(context.Background(), tc.destination, read)
+		if err != tc.expected {
+			t.Errorf("%s to %s: expected %v got %v", tc.source, tc.destination, tc.expected, err)
+		}
+	}
+
+	if network.Start("node0") != NodeRunningError {
+		t.Error("started a node that was already running")
+	}
+
+	if network.Stop("node1") != NodeStoppedError {
+		t.Error("stopped a node that was already stopped")
+	}
+
+	if network.Stop("missing") != UnknownNodeError {
+		t.Error("stopped a node that doesn't exist")
+	}
+
+	if network.Register("node0", nil, nil) != NodeExistsError {
+		t.Error("registered the same name twice")
+	}
+}
+
+func TestReadData(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	cluster.tpcs[0].CommitTx("1", []byte("value"), cluster.names)
+
+	value, err := cluster.network.Handler("client").ReadData([]byte("1"), "node0")
+	if err != nil || string(value) != "value" {
+		t.Errorf("expected to read value, got %q %v", value, err)
+	}
+
+	if _, err := cluster.network.Handler("client").ReadData([]byte("2"), "node0"); err != storage.KeyNotFoundError {
+		t.Errorf("expected KeyNotFoundError got %v", err)
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	cluster.tpcs[0].SetCodecs(threephase.BinaryCodec)
+
+	negotiator, ok := cluster.network.Handler("client").(threephase.CodecNegotiator)
+	if !ok {
+		t.Fatal("the handler can't negotiate codecs")
+	}
+
+	codecs, err := negotiator.Codecs("node0")
+	if err != nil || !reflect.DeepEqual(codecs, []string{threephase.BinaryCodec.Name()}) {
+		t.Errorf("expected node0's codecs, got %v %v", codecs, err)
+	}
+}
+
+func TestNetworkClose(t *testing.T) {
+	network := NewNetwork()
+	network.Register("a", nil, nil)
+	network.Close()
+
+	if _, err := network.Transport("b").Send(context.Background(), "a", threephase.Message{}); err != NetworkClosedError {
+		t.Errorf("expected NetworkClosedError got %v", err)
+	}
+
+	if network.Register("b", nil, nil) != NetworkClosedError {
+		t.Error("registered a node on a closed network")
+	}
+}
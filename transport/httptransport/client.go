@@ -0,0 +1,177 @@
+// Package httptransport carries the three phase commit protocol over HTTP. A
+// Client implements threephase.CommunicationHandler and the Handler returned
+// by NewHandler answers it on the participant side. Routes are all under
+// /3pc/:
+//
+//	POST /3pc/init              the encoded transaction is the body
+//	GET  /3pc/precommit/{id}
+//	GET  /3pc/commit/{id}
+//	GET  /3pc/abort/{id}
+//	GET  /3pc/check/{id}
+//	GET  /3pc/read/{key}        the value is the body, 404 if it's missing
+//	GET  /3pc/codecs            a comma separated list of codec names
+//
+// Calls answer 200 for success and 400 for failure.
+package httptransport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	UnexpectedStatusError = errors.New("The peer replied with an unexpected status")
+)
+
+// Config controls how a Client connects, the zero value uses DefaultConfig's
+// values.
+type Config struct {
+	// Timeout bounds each call including reading the reply
+	Timeout time.Duration
+
+	// MaxIdleConnsPerHost is how many idle connections are kept to each peer
+	MaxIdleConnsPerHost int
+
+	// TLSConfig switches the client to https if it's set
+	TLSConfig *tls.Config
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Timeout:             time.Second * 2,
+		MaxIdleConnsPerHost: 4,
+	}
+}
+
+// Client is a threephase.CommunicationHandler and CodecNegotiator that talks to
+// peers serving the Handler.
+type Client struct {
+	client *http.Client
+	scheme string
+}
+
+func NewClient(config Config) *Client {
+	defaults := DefaultConfig()
+	if config.Timeout == 0 {
+		config.Timeout = defaults.Timeout
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = defaults.MaxIdleConnsPerHost
+	}
+
+	scheme := "http"
+	if config.TLSConfig != nil {
+		scheme = "https"
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Second * 90,
+		TLSClientConfig:     config.TLSConfig,
+	}
+
+	return &Client{
+		client: &http.Client{Transport: transport, Timeout: config.Timeout},
+		scheme: scheme,
+	}
+}
+
+// do makes a request and reads the whole reply so the connection can be
+// reused, the body is always closed.
+func (this *Client) do(method, destination, path string, body []byte) (status int, reply []byte, err error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, this.scheme+"://"+destination+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	reply, err = ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, reply, err
+}
+
+func (this *Client) okCall(method, destination, path string, body []byte) (ok bool, err error) {
+	status, _, err := this.do(method, destination, path, body)
+	if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusBadRequest:
+		return false, nil
+	}
+	return false, UnexpectedStatusError
+}
+
+func idPath(kind threephase.MessageKind, id []byte) string {
+	return "/3pc/" + kind.String() + "/" + url.PathEscape(string(id))
+}
+
+func (this *Client) InitializeTransaction(tx []byte, destination string) (ok bool, err error) {
+	return this.okCall("POST", destination, "/3pc/init", tx)
+}
+
+func (this *Client) Abort(transactionID []byte, destination string) (ok bool, err error) {
+	return this.okCall("GET", destination, idPath(threephase.MessageAbort, transactionID), nil)
+}
+
+func (this *Client) DoCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return this.okCall("GET", destination, idPath(threephase.MessageCommit, transactionID), nil)
+}
+
+func (this *Client) PreCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return this.okCall("GET", destination, idPath(threephase.MessagePreCommit, transactionID), nil)
+}
+
+func (this *Client) CheckCommit(transactionID []byte, destination string) (didcommit bool, err error) {
+	return this.okCall("GET", destination, idPath(threephase.MessageCheck, transactionID), nil)
+}
+
+func (this *Client) ReadData(request []byte, destination string) (result []byte, err error) {
+	status, reply, err := this.do("GET", destination, idPath(threephase.MessageRead, request), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return reply, nil
+	case http.StatusNotFound:
+		return nil, storage.KeyNotFoundError
+	}
+	return nil, UnexpectedStatusError
+}
+
+func (this *Client) Codecs(destination string) ([]string, error) {
+	status, reply, err := this.do("GET", destination, "/3pc/"+threephase.MessageCodecs.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, UnexpectedStatusError
+	}
+	return strings.Split(string(reply), ","), nil
+}
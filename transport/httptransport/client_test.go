@@ -0,0 +1,102 @@
+package httptransport
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+type staticNodes []string
+
+func (s staticNodes) GetCreateSet() ([]string, error) { return s, nil }
+func (s staticNodes) GetReadSet() ([]string, error)   { return s, nil }
+func (s staticNodes) GetUpdateSet() ([]string, error) { return s, nil }
+func (s staticNodes) GetDeleteSet() ([]string, error) { return s, nil }
+
+// startNode serves a participant and returns its host:port
+func startNode(t *testing.T) (string, storage.Storage) {
+	db := storage.NewInMemoryStorage()
+	tpc := threephase.NewThreePhaseCommit(NewClient(Config{}), db, staticNodes{})
+	server := httptest.NewServer(NewHandler(tpc, db))
+
+	t.Cleanup(func() {
+		server.Close()
+		tpc.Close()
+	})
+
+	return strings.TrimPrefix(server.URL, "http://"), db
+}
+
+func TestClientCommit(t *testing.T) {
+	hosts := staticNodes{}
+	dbs := []storage.Storage{}
+	for i := 0; i < 3; i++ {
+		host, db := startNode(t)
+		hosts = append(hosts, host)
+		dbs = append(dbs, db)
+	}
+
+	client := NewClient(Config{})
+	coordinator := threephase.NewThreePhaseCommit(client, storage.NewInMemoryStorage(), hosts)
+	defer coordinator.Close()
+
+	if !coordinator.Create([]byte("a key/with slashes"), []byte{0, 0xff}) {
+		t.Fatal("the transaction didn't commit")
+	}
+
+	for _, host := range hosts {
+		value, err := client.ReadData([]byte("a key/with slashes"), host)
+		if err != nil || string(value) != string([]byte{0, 0xff}) {
+			t.Errorf("%s: expected the value back, got %v %v", host, value, err)
+		}
+	}
+
+	if _, err := client.ReadData([]byte("missing"), hosts[0]); err != storage.KeyNotFoundError {
+		t.Errorf("expected KeyNotFoundError got %v", err)
+	}
+
+	if ok, err := client.DoCommit([]byte("missing"), hosts[0]); ok || err != nil {
+		t.Errorf("expected a failed commit without an error, got %t %v", ok, err)
+	}
+
+	codecs, err := client.Codecs(hosts[0])
+	if err != nil || len(codecs) != len(threephase.DefaultCodecs) {
+		t.Errorf("expected the default codecs, got %v %v", codecs, err)
+	}
+}
+
+func TestClientUnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	client := NewClient(Config{})
+	if _, err := client.PreCommit([]byte("1"), host); err != UnexpectedStatusError {
+		t.Errorf("expected UnexpectedStatusError got %v", err)
+	}
+
+	if _, err := client.ReadData([]byte("1"), host); err != UnexpectedStatusError {
+		t.Errorf("expected UnexpectedStatusError got %v", err)
+	}
+}
+
+func TestClientUnreachable(t *testing.T) {
+	client := NewClient(Config{})
+	if ok, err := client.InitializeTransaction([]byte("{}"), "127.0.0.1:1"); ok || err == nil {
+		t.Errorf("expected an error calling a closed port, got %t %v", ok, err)
+	}
+}
@@ -0,0 +1,68 @@
+package httptransport
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+// healthTransactionID is looked up to exercise the engine, it's never used
+// for a real transaction.
+const healthTransactionID = "historia/health"
+
+type healthHandler struct {
+	tpc     threephase.ThreePhaseCommit
+	timeout time.Duration
+
+	lock    sync.Mutex
+	pending chan bool
+}
+
+// NewHealthHandler answers 200 if tpc responds to a transaction lookup within
+// timeout and 503 if it doesn't, so a node whose engine is stuck is reported
+// unhealthy even though it still accepts connections.
+func NewHealthHandler(tpc threephase.ThreePhaseCommit, timeout time.Duration) http.Handler {
+	return &healthHandler{tpc: tpc, timeout: timeout}
+}
+
+func (this *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if this.responsive() {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("The transaction engine isn't responding"))
+}
+
+// responsive checks the engine answers in time. A lookup that's still stuck
+// from an earlier check is waited on rather than starting another one so
+// stuck goroutines don't pile up.
+func (this *healthHandler) responsive() bool {
+	this.lock.Lock()
+	if this.pending == nil {
+		done := make(chan bool)
+		this.pending = done
+
+		go func() {
+			this.tpc.CheckCommit(healthTransactionID)
+
+			this.lock.Lock()
+			this.pending = nil
+			this.lock.Unlock()
+			close(done)
+		}()
+	}
+	pending := this.pending
+	this.lock.Unlock()
+
+	select {
+	case <-pending:
+		return true
+	case <-time.After(this.timeout):
+		return false
+	}
+}
@@ -0,0 +1,59 @@
+package httptransport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+// wedgedCommit blocks every CheckCommit until it's released
+type wedgedCommit struct {
+	threephase.ThreePhaseCommit
+	release chan bool
+}
+
+func (this *wedgedCommit) CheckCommit(transactionID string) bool {
+	<-this.release
+	return false
+}
+
+func TestHealthHandler(t *testing.T) {
+	tpc := threephase.NewThreePhaseCommit(NewClient(Config{}), storage.NewInMemoryStorage(), staticNodes{})
+	defer tpc.Close()
+	wedged := &wedgedCommit{ThreePhaseCommit: tpc, release: make(chan bool)}
+
+	healthy := NewHealthHandler(tpc, time.Second)
+	stuck := NewHealthHandler(wedged, 10*time.Millisecond)
+
+	var data = []struct {
+		name     string
+		handler  http.Handler
+		expected int
+	}{
+		{"responsive", healthy, http.StatusOK},
+		{"stuck", stuck, http.StatusServiceUnavailable},
+		{"still stuck", stuck, http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range data {
+		recorder := httptest.NewRecorder()
+		tc.handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+
+		if recorder.Code != tc.expected {
+			t.Errorf("%s: expected %d got %d", tc.name, tc.expected, recorder.Code)
+		}
+	}
+
+	close(wedged.release)
+	time.Sleep(10 * time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	stuck.ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("the engine recovered but the check returned %d", recorder.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package httptransport
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	// MaxTransactionSize is the largest init body that will be read
+	MaxTransactionSize int64 = 16 * 1024 * 1024
+)
+
+type handler struct {
+	tpc threephase.ThreePhaseCommit
+	db  storage.Storage
+}
+
+// NewHandler serves the /3pc/ routes by calling the participant methods of
+// tpc, reads are answered from db.
+func NewHandler(tpc threephase.ThreePhaseCommit, db storage.Storage) http.Handler {
+	return &handler{tpc: tpc, db: db}
+}
+
+func (this *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/3pc/")
+	parts := strings.SplitN(path, "/", 2)
+
+	kind, found := threephase.ParseMessageKind(parts[0])
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if kind == threephase.MessageCodecs {
+		if r.Method != "GET" || len(parts) != 1 {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reply, _ := threephase.HandleMessage(this.tpc, threephase.Message{Kind: kind})
+		w.Write(reply.Payload)
+		return
+	}
+
+	message := threephase.Message{Kind: kind}
+
+	if kind == threephase.MessageInit {
+		if r.Method != "POST" || len(parts) != 1 {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxTransactionSize))
+		if err != nil {
+			log.Printf("httptransport: error reading transaction from %s: %s\n", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		message.Payload = body
+	} else {
+		if r.Method != "GET" || len(parts) != 2 {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := url.PathUnescape(parts[1])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		message.Payload = []byte(id)
+	}
+
+	if kind == threephase.MessageRead {
+		this.read(w, message.Payload)
+		return
+	}
+
+	reply, err := threephase.HandleMessage(this.tpc, message)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if reply.OK {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Success"))
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Failure"))
+	}
+}
+
+func (this *handler) read(w http.ResponseWriter, key []byte) {
+	value, ok := this.db.Read(key)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(value)
+}
@@ -0,0 +1,82 @@
+package httptransport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+func TestHandlerRoutes(t *testing.T) {
+	db := storage.NewInMemoryStorage()
+	tpc := threephase.NewThreePhaseCommit(NewClient(Config{}), db, staticNodes{})
+	defer tpc.Close()
+	handler := NewHandler(tpc, db)
+
+	var data = []struct {
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{"POST", "/3pc/init", `{"TransactionID":"1","Data":"ZGF0YQ=="}`, http.StatusOK},
+		{"POST", "/3pc/init", `not a transaction`, http.StatusBadRequest},
+		{"GET", "/3pc/init", "", http.StatusMethodNotAllowed},
+		{"GET", "/3pc/precommit/1", "", http.StatusOK},
+		{"POST", "/3pc/commit/1", "", http.StatusMethodNotAllowed},
+		{"GET", "/3pc/commit", "", http.StatusMethodNotAllowed},
+		{"GET", "/3pc/commit/1", "", http.StatusOK},
+		{"GET", "/3pc/check/1", "", http.StatusOK},
+		{"GET", "/3pc/abort/1", "", http.StatusBadRequest},
+		{"GET", "/3pc/read/1", "", http.StatusOK},
+		{"GET", "/3pc/read/2", "", http.StatusNotFound},
+		{"GET", "/3pc/codecs", "", http.StatusOK},
+		{"GET", "/3pc/unknown/1", "", http.StatusNotFound},
+	}
+
+	for _, tc := range data {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tc.expected {
+			t.Errorf("%s %s: expected %d got %d", tc.method, tc.path, tc.expected, w.Code)
+		}
+	}
+}
+
+// run with -race, reads are served while transactions commit
+func TestHandlerReadsWhileCommitting(t *testing.T) {
+	db := storage.NewInMemoryStorage()
+	tpc := threephase.NewThreePhaseCommit(NewClient(Config{}), db, staticNodes{})
+	defer tpc.Close()
+	handler := NewHandler(tpc, db)
+
+	serve := func(method, path, body string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, strings.NewReader(body)))
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			id := strconv.Itoa(i)
+			serve("POST", "/3pc/init", `{"TransactionID":"`+id+`","Data":"ZGF0YQ=="}`)
+			serve("GET", "/3pc/precommit/"+id, "")
+			serve("GET", "/3pc/commit/"+id, "")
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		serve("GET", "/3pc/read/"+strconv.Itoa(i), "")
+	}
+	<-done
+
+	if _, ok := db.Read([]byte("99")); !ok {
+		t.Error("the transactions weren't committed")
+	}
+}
@@ -0,0 +1,151 @@
+// Package mtls builds TLS configurations for traffic between historia nodes
+// where both sides present certificates signed by a shared certificate
+// authority. Certificates are loaded from files and can be reloaded without
+// restarting, connections made after a reload use the new files.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var (
+	NoCertificatesError = errors.New("The CA file didn't contain any certificates")
+	NoPeerCertError     = errors.New("The peer didn't present a certificate")
+)
+
+// Config names the PEM files a node uses
+type Config struct {
+	// CertFile and KeyFile are this node's certificate and private key, it
+	// presents them both as a server and as a client.
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the certificate authorities peers must be signed by
+	CAFile string
+}
+
+// Reloader holds the currently loaded certificates for a Config
+type Reloader struct {
+	config Config
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// NewReloader loads the files named in config
+func NewReloader(config Config) (*Reloader, error) {
+	reloader := &Reloader{config: config}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the files again, if any of them can't be loaded the previous
+// certificates are kept.
+func (this *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(this.config.CertFile, this.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	caPEM, err := ioutil.ReadFile(this.config.CAFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return NoCertificatesError
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.cert = &cert
+	this.pool = pool
+	log.Printf("mtls: loaded certificate %s\n", this.config.CertFile)
+	return nil
+}
+
+func (this *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.cert, this.pool
+}
+
+// ServerTLSConfig is for listeners. Client certificates are verified if
+// they're presented, but not required so ordinary clients can still connect;
+// wrap peer only handlers in RequirePeer.
+func (this *Reloader) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := this.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+			}, nil
+		},
+	}
+}
+
+// ClientTLSConfig is for connecting to peers, it presents this node's
+// certificate and checks the server's against the current CA.
+func (this *Reloader) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := this.current()
+			return cert, nil
+		},
+		// the standard verification can only use a fixed pool, so it's
+		// skipped and done in VerifyConnection against the current one
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, pool := this.current()
+			return verifyChain(state, pool)
+		},
+	}
+}
+
+func verifyChain(state tls.ConnectionState, pool *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return NoPeerCertError
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         pool,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// RequirePeer only lets requests through that came with a verified client
+// certificate, others get 403 Forbidden.
+func RequirePeer(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			log.Printf("mtls: refusing %s from %s without a client certificate\n", r.URL, r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,200 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// writeNode writes a certificate for a node signed by ca into dir and returns
+// the Config naming the files.
+func (ca *testCA) writeNode(t *testing.T, dir, name string) Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	config := Config{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+		CAFile:   filepath.Join(dir, name+"-ca.crt"),
+	}
+
+	ioutil.WriteFile(config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	ioutil.WriteFile(config.CAFile, ca.pem, 0600)
+	return config
+}
+
+func newPeerServer(t *testing.T, reloader *Reloader) *httptest.Server {
+	handler := RequirePeer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = reloader.ServerTLSConfig()
+	server.StartTLS()
+	return server
+}
+
+func get(reloader *Reloader, url string) (int, error) {
+	transport := &http.Transport{}
+	if reloader != nil {
+		transport.TLSClientConfig = reloader.ClientTLSConfig()
+	} else {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client := http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "cluster")
+	serverReloader, err := NewReloader(ca.writeNode(t, dir, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientReloader, err := NewReloader(ca.writeNode(t, dir, "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newPeerServer(t, serverReloader)
+	defer server.Close()
+
+	status, err := get(clientReloader, server.URL)
+	if err != nil || status != http.StatusOK {
+		t.Errorf("a peer with a valid certificate got %d %v", status, err)
+	}
+
+	status, err = get(nil, server.URL)
+	if err != nil || status != http.StatusForbidden {
+		t.Errorf("a client without a certificate got %d %v", status, err)
+	}
+
+	outsider, _ := NewReloader(newTestCA(t, "outsider").writeNode(t, dir, "outsider"))
+	if _, err := get(outsider, server.URL); err == nil {
+		t.Error("a peer signed by another CA was able to connect")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	oldCA := newTestCA(t, "old")
+	newCA := newTestCA(t, "new")
+
+	serverReloader, _ := NewReloader(oldCA.writeNode(t, dir, "server"))
+	clientReloader, _ := NewReloader(newCA.writeNode(t, dir, "client"))
+
+	server := newPeerServer(t, serverReloader)
+	defer server.Close()
+
+	if _, err := get(clientReloader, server.URL); err == nil {
+		t.Fatal("connected before the server trusted the new CA")
+	}
+
+	newCA.writeNode(t, dir, "server")
+	if err := serverReloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := get(clientReloader, server.URL)
+	if err != nil || status != http.StatusOK {
+		t.Errorf("after reloading got %d %v", status, err)
+	}
+}
+
+func TestReloadKeepsOldOnError(t *testing.T) {
+	dir := t.TempDir()
+	config := newTestCA(t, "cluster").writeNode(t, dir, "node")
+
+	reloader, err := NewReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(config.CAFile, []byte("garbage"), 0600)
+	if err := reloader.Reload(); err != NoCertificatesError {
+		t.Errorf("expected NoCertificatesError got %v", err)
+	}
+
+	if cert, pool := reloader.current(); cert == nil || pool == nil {
+		t.Error("a failed reload threw away the working certificates")
+	}
+}
@@ -0,0 +1,318 @@
+// Package tcptransport carries the three phase commit protocol over long
+// lived TCP connections. A Client keeps one connection to each peer and
+// multiplexes concurrent calls over it, a Server answers them by calling the
+// participant methods of a ThreePhaseCommit.
+package tcptransport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	CallTimeoutError    = errors.New("The call timed out waiting for a reply")
+	ConnectionLostError = errors.New("The connection was lost before a reply arrived")
+	BackoffError        = errors.New("The peer is unreachable, waiting before reconnecting")
+	ClientClosedError   = errors.New("The client has been closed")
+)
+
+// Config controls how a Client connects, the zero value uses DefaultConfig's
+// values.
+type Config struct {
+	DialTimeout time.Duration
+	CallTimeout time.Duration
+
+	// after a failed dial calls fail fast for MinBackoff, doubling each
+	// time the dial fails again up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// TLSConfig is used to dial peers if it's set
+	TLSConfig *tls.Config
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DialTimeout: time.Second,
+		CallTimeout: time.Second * 2,
+		MinBackoff:  time.Millisecond * 100,
+		MaxBackoff:  time.Second * 5,
+	}
+}
+
+// Client is a threephase.CommunicationHandler and CodecNegotiator that talks
+// to peers running a Server.
+type Client struct {
+	config Config
+	nextID uint64
+
+	lock   sync.Mutex
+	peers  map[string]*peer
+	closed bool
+}
+
+func NewClient(config Config) *Client {
+	defaults := DefaultConfig()
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaults.DialTimeout
+	}
+	if config.CallTimeout == 0 {
+		config.CallTimeout = defaults.CallTimeout
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaults.MinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaults.MaxBackoff
+	}
+
+	return &Client{config: config, peers: make(map[string]*peer)}
+}
+
+// peer is the connection to a single destination
+type peer struct {
+	address string
+
+	lock    sync.Mutex
+	conn    *connection
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// connection is a live socket and the calls waiting on replies from it
+type connection struct {
+	net.Conn
+	writeLock sync.Mutex
+	pending   map[uint64]chan frame
+}
+
+func (this *Client) getPeer(destination string) (*peer, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return nil, ClientClosedError
+	}
+
+	p, found := this.peers[destination]
+	if !found {
+		p = &peer{address: destination}
+		this.peers[destination] = p
+	}
+	return p, nil
+}
+
+// call sends a request to destination and waits for the matching reply
+func (this *Client) call(destination string, kind byte, payload []byte) (frame, error) {
+	p, err := this.getPeer(destination)
+	if err != nil {
+		return frame{}, err
+	}
+
+	id := atomic.AddUint64(&this.nextID, 1)
+	reply := make(chan frame, 1)
+
+	conn, err := p.register(this, id, reply)
+	if err != nil {
+		return frame{}, err
+	}
+
+	conn.writeLock.Lock()
+	conn.SetWriteDeadline(time.Now().Add(this.config.CallTimeout))
+	err = writeFrame(conn, frame{id: id, kind: kind, payload: payload})
+	conn.writeLock.Unlock()
+
+	if err != nil {
+		p.drop(conn)
+		return frame{}, err
+	}
+
+	timer := time.NewTimer(this.config.CallTimeout)
+	defer timer.Stop()
+
+	select {
+	case result, ok := <-reply:
+		if !ok {
+			return frame{}, ConnectionLostError
+		}
+		if result.status == statusError {
+			return frame{}, errors.New(string(result.payload))
+		}
+		return result, nil
+	case <-timer.C:
+		p.forget(conn, id)
+		return frame{}, CallTimeoutError
+	}
+}
+
+// register connects if needed and adds a call waiting on reply
+func (this *peer) register(client *Client, id uint64, reply chan frame) (*connection, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.conn == nil {
+		if err := this.connect(client.config); err != nil {
+			return nil, err
+		}
+	}
+
+	this.conn.pending[id] = reply
+	return this.conn, nil
+}
+
+// connect dials the peer, the caller holds the lock
+func (this *peer) connect(config Config) error {
+	if time.Now().Before(this.retryAt) {
+		return BackoffError
+	}
+
+	dialer := &net.Dialer{Timeout: config.DialTimeout}
+
+	var conn net.Conn
+	var err error
+	if config.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", this.address, config.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", this.address)
+	}
+
+	if err != nil {
+		this.backoff *= 2
+		if this.backoff < config.MinBackoff {
+			this.backoff = config.MinBackoff
+		}
+		if this.backoff > config.MaxBackoff {
+			this.backoff = config.MaxBackoff
+		}
+		this.retryAt = time.Now().Add(this.backoff)
+		return err
+	}
+
+	this.backoff = 0
+	this.retryAt = time.Time{}
+	this.conn = &connection{Conn: conn, pending: make(map[uint64]chan frame)}
+	go this.readLoop(this.conn)
+	return nil
+}
+
+// readLoop hands replies to their callers until the connection fails
+func (this *peer) readLoop(conn *connection) {
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readFrame(reader)
+		if err != nil {
+			this.drop(conn)
+			return
+		}
+
+		this.lock.Lock()
+		waiting, found := conn.pending[reply.id]
+		delete(conn.pending, reply.id)
+		this.lock.Unlock()
+
+		if found {
+			waiting <- reply
+		}
+	}
+}
+
+// drop closes a failed connection and wakes everyone waiting on it
+func (this *peer) drop(conn *connection) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.conn == conn {
+		this.conn = nil
+	}
+
+	for id, waiting := range conn.pending {
+		close(waiting)
+		delete(conn.pending, id)
+	}
+	conn.Close()
+}
+
+func (this *peer) forget(conn *connection, id uint64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(conn.pending, id)
+}
+
+// Close drops every connection, calls made afterwards fail
+func (this *Client) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return ClientClosedError
+	}
+	this.closed = true
+
+	for _, p := range this.peers {
+		p.lock.Lock()
+		conn := p.conn
+		p.lock.Unlock()
+
+		if conn != nil {
+			p.drop(conn)
+		}
+	}
+	return nil
+}
+
+func (this *Client) okCall(kind threephase.MessageKind, request []byte, destination string) (ok bool, err error) {
+	reply, err := this.call(destination, byte(kind), request)
+	if err != nil {
+		return false, err
+	}
+	return reply.status == statusTrue, nil
+}
+
+func (this *Client) InitializeTransaction(tx []byte, destination string) (ok bool, err error) {
+	return this.okCall(threephase.MessageInit, tx, destination)
+}
+
+func (this *Client) Abort(transactionID []byte, destination string) (ok bool, err error) {
+	return this.okCall(threephase.MessageAbort, transactionID, destination)
+}
+
+func (this *Client) DoCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return this.okCall(threephase.MessageCommit, transactionID, destination)
+}
+
+func (this *Client) PreCommit(transactionID []byte, destination string) (ok bool, err error) {
+	return this.okCall(threephase.MessagePreCommit, transactionID, destination)
+}
+
+func (this *Client) CheckCommit(transactionID []byte, destination string) (didcommit bool, err error) {
+	return this.okCall(threephase.MessageCheck, transactionID, destination)
+}
+
+func (this *Client) ReadData(request []byte, destination string) (result []byte, err error) {
+	reply, err := this.call(destination, byte(threephase.MessageRead), request)
+	if err != nil {
+		return nil, err
+	}
+
+	if reply.status != statusTrue {
+		return nil, storage.KeyNotFoundError
+	}
+	return reply.payload, nil
+}
+
+func (this *Client) Codecs(destination string) ([]string, error) {
+	reply, err := this.call(destination, byte(threephase.MessageCodecs), nil)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(reply.payload), ","), nil
+}
@@ -0,0 +1,193 @@
+package tcptransport
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+type staticNodes []string
+
+func (s staticNodes) GetCreateSet() ([]string, error) { return s, nil }
+func (s staticNodes) GetReadSet() ([]string, error)   { return s, nil }
+func (s staticNodes) GetUpdateSet() ([]string, error) { return s, nil }
+func (s staticNodes) GetDeleteSet() ([]string, error) { return s, nil }
+
+type testNode struct {
+	address string
+	db      storage.Storage
+	tpc     threephase.ThreePhaseCommit
+	server  *Server
+}
+
+// startCluster runs a server for each of n participants on localhost
+func startCluster(t *testing.T, n int) ([]*testNode, staticNodes) {
+	nodes := []*testNode{}
+	addresses := staticNodes{}
+
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node := &testNode{address: listener.Addr().String(), db: storage.NewInMemoryStorage()}
+		node.tpc = threephase.NewThreePhaseCommit(NewClient(Config{}), node.db, addresses)
+		node.server = NewServer(node.tpc, node.db)
+		go node.server.Serve(listener)
+
+		t.Cleanup(func() {
+			node.server.Close()
+			node.tpc.Close()
+		})
+
+		nodes = append(nodes, node)
+		addresses = append(addresses, node.address)
+	}
+
+	return nodes, addresses
+}
+
+func TestClientCommit(t *testing.T) {
+	nodes, addresses := startCluster(t, 3)
+
+	client := NewClient(Config{})
+	defer client.Close()
+
+	coordinator := threephase.NewThreePhaseCommit(client, storage.NewInMemoryStorage(), addresses)
+	defer coordinator.Close()
+
+	if !coordinator.CommitTx("1", []byte{0, 1, 0xff}, addresses) {
+		t.Fatal("the transaction didn't commit")
+	}
+
+	for _, node := range nodes {
+		value, err := client.ReadData([]byte("1"), node.address)
+		if err != nil || string(value) != string([]byte{0, 1, 0xff}) {
+			t.Errorf("%s: expected the value to be read back, got %v %v", node.address, value, err)
+		}
+	}
+
+	if _, err := client.ReadData([]byte("missing"), addresses[0]); err != storage.KeyNotFoundError {
+		t.Errorf("expected a missing key to be reported, got %v", err)
+	}
+
+	codecs, err := client.Codecs(addresses[0])
+	if err != nil || len(codecs) != len(threephase.DefaultCodecs) {
+		t.Errorf("expected the default codecs, got %v %v", codecs, err)
+	}
+}
+
+func TestClientConcurrentCalls(t *testing.T) {
+	nodes, _ := startCluster(t, 1)
+	node := nodes[0]
+
+	client := NewClient(Config{})
+	defer client.Close()
+
+	// only even keys exist, so each reply must match its own request
+	for i := 0; i < 100; i += 2 {
+		id := []byte(strconv.Itoa(i))
+		node.db.PrepareOperation(id, storage.OpCreate, id, id)
+		node.db.Commit(id)
+	}
+
+	var wg sync.WaitGroup
+	failures := make(chan string, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := strconv.Itoa(i)
+
+			value, err := client.ReadData([]byte(id), node.address)
+			if (i%2 == 0) != (err == nil) || (err == nil && string(value) != id) {
+				failures <- id
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(failures)
+
+	for id := range failures {
+		t.Errorf("call %s got the wrong reply", id)
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if len(client.peers) != 1 {
+		t.Errorf("expected a single peer connection, got %d", len(client.peers))
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+
+	db := storage.NewInMemoryStorage()
+	tpc := threephase.NewThreePhaseCommit(NewClient(Config{}), db, staticNodes{})
+	defer tpc.Close()
+
+	server := NewServer(tpc, db)
+	go server.Serve(listener)
+
+	client := NewClient(Config{MinBackoff: time.Millisecond * 50, MaxBackoff: time.Millisecond * 50, CallTimeout: time.Second})
+	defer client.Close()
+
+	if _, err := client.CheckCommit([]byte("1"), address); err != nil {
+		t.Fatalf("first call failed: %s", err)
+	}
+
+	server.Close()
+	time.Sleep(time.Millisecond * 20)
+
+	if _, err := client.CheckCommit([]byte("1"), address); err == nil {
+		t.Fatal("a call to a stopped server succeeded")
+	}
+
+	if _, err := client.CheckCommit([]byte("1"), address); err != BackoffError {
+		t.Errorf("expected to back off after a failed dial, got %v", err)
+	}
+
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("couldn't listen on %s again: %s", address, err)
+	}
+	server = NewServer(tpc, db)
+	go server.Serve(listener)
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 60)
+	if _, err := client.CheckCommit([]byte("1"), address); err != nil {
+		t.Errorf("didn't reconnect after the backoff: %s", err)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	client := NewClient(Config{})
+	client.Close()
+
+	if _, err := client.CheckCommit([]byte("1"), "127.0.0.1:1"); err != ClientClosedError {
+		t.Errorf("expected ClientClosedError got %v", err)
+	}
+
+	if client.Close() != ClientClosedError {
+		t.Error("closing twice should fail")
+	}
+}
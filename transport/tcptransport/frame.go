@@ -0,0 +1,79 @@
+package tcptransport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Frames on the wire are:
+//
+//	length uint32 | id uint64 | kind byte | status byte | payload
+//
+// where length counts everything after itself. Requests and their replies
+// share an id so many calls can be in flight on one connection at once.
+const (
+	headerSize = 8 + 1 + 1
+
+	statusFalse byte = 0
+	statusTrue  byte = 1
+	statusError byte = 2
+)
+
+var (
+	// MaxFrameSize is the largest frame that will be read, anything larger
+	// is assumed to be garbage and the connection is dropped.
+	MaxFrameSize = 16 * 1024 * 1024
+)
+
+var (
+	FrameTooLargeError = errors.New("The frame is larger than MaxFrameSize")
+	FrameTooSmallError = errors.New("The frame is too small to hold a header")
+)
+
+type frame struct {
+	id      uint64
+	kind    byte
+	status  byte
+	payload []byte
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	buf := make([]byte, 4+headerSize+len(f.payload))
+	binary.BigEndian.PutUint32(buf, uint32(headerSize+len(f.payload)))
+	binary.BigEndian.PutUint64(buf[4:], f.id)
+	buf[12] = f.kind
+	buf[13] = f.status
+	copy(buf[14:], f.payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return frame{}, err
+	}
+
+	size := int(binary.BigEndian.Uint32(length[:]))
+	if size > MaxFrameSize {
+		return frame{}, FrameTooLargeError
+	}
+
+	if size < headerSize {
+		return frame{}, FrameTooSmallError
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return frame{}, err
+	}
+
+	return frame{
+		id:      binary.BigEndian.Uint64(buf),
+		kind:    buf[8],
+		status:  buf[9],
+		payload: buf[headerSize:],
+	}, nil
+}
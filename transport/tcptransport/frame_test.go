@@ -0,0 +1,56 @@
+package tcptransport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var data = []frame{
+		{id: 1, kind: 0, status: statusTrue, payload: []byte{}},
+		{id: 1 << 40, kind: byte(threephase.MessageCodecs), status: statusError, payload: []byte("some error")},
+		{id: 7, kind: 3, status: statusFalse, payload: []byte{0, 0xff, 0}},
+	}
+
+	var buf bytes.Buffer
+	for _, f := range data {
+		if err := writeFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range data {
+		result, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("expected %+v got %+v", expected, result)
+		}
+	}
+}
+
+func TestReadFrameBad(t *testing.T) {
+	var data = []struct {
+		name     string
+		length   uint32
+		expected error
+	}{
+		{"too large", uint32(MaxFrameSize + 1), FrameTooLargeError},
+		{"too small", headerSize - 1, FrameTooSmallError},
+	}
+
+	for _, tc := range data {
+		buf := make([]byte, 4+headerSize)
+		binary.BigEndian.PutUint32(buf, tc.length)
+
+		if _, err := readFrame(bytes.NewReader(buf)); err != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, err)
+		}
+	}
+}
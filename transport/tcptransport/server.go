@@ -0,0 +1,162 @@
+package tcptransport
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/josephlewis42/historia/storage"
+	"github.com/josephlewis42/historia/threephase"
+)
+
+var (
+	ServerClosedError = errors.New("The server has been closed")
+)
+
+// Server answers calls from Clients using the participant methods of a
+// ThreePhaseCommit, reads are answered from db.
+type Server struct {
+	tpc threephase.ThreePhaseCommit
+	db  storage.Storage
+
+	lock      sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+func NewServer(tpc threephase.ThreePhaseCommit, db storage.Storage) *Server {
+	return &Server{
+		tpc:       tpc,
+		db:        db,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// ListenAndServe listens on the TCP address and serves it until Close
+func (this *Server) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return this.Serve(listener)
+}
+
+// Serve accepts connections from listener until Close, wrap the listener
+// with tls.NewListener to serve TLS.
+func (this *Server) Serve(listener net.Listener) error {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		listener.Close()
+		return ServerClosedError
+	}
+	this.listeners[listener] = true
+	this.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			this.lock.Lock()
+			closed := this.closed
+			delete(this.listeners, listener)
+			this.lock.Unlock()
+
+			if closed {
+				return ServerClosedError
+			}
+			return err
+		}
+
+		go this.handle(conn)
+	}
+}
+
+// Close stops every listener and drops every connection
+func (this *Server) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return ServerClosedError
+	}
+	this.closed = true
+
+	for listener := range this.listeners {
+		listener.Close()
+	}
+
+	for conn := range this.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (this *Server) handle(conn net.Conn) {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		conn.Close()
+		return
+	}
+	this.conns[conn] = true
+	this.lock.Unlock()
+
+	defer func() {
+		this.lock.Lock()
+		delete(this.conns, conn)
+		this.lock.Unlock()
+		conn.Close()
+	}()
+
+	var writeLock sync.Mutex
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+
+		// requests are answered concurrently, the ids let the client
+		// match the replies up
+		go func(request frame) {
+			reply := this.dispatch(request)
+
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			if err := writeFrame(conn, reply); err != nil {
+				log.Printf("tcptransport: couldn't reply to %s: %s\n", conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		}(request)
+	}
+}
+
+func (this *Server) dispatch(request frame) frame {
+	reply := frame{id: request.id, kind: request.kind, status: statusFalse}
+
+	var result threephase.Reply
+	var err error
+
+	switch request.kind {
+	case byte(threephase.MessageRead):
+		result.Payload, result.OK = this.db.Read(request.payload)
+	default:
+		result, err = threephase.HandleMessage(this.tpc, threephase.Message{Kind: threephase.MessageKind(request.kind), Payload: request.payload})
+	}
+
+	if err != nil {
+		reply.status = statusError
+		reply.payload = []byte(err.Error())
+		return reply
+	}
+
+	if result.OK {
+		reply.status = statusTrue
+	}
+	reply.payload = result.Payload
+	return reply
+}
@@ -0,0 +1,52 @@
+package tcptransport
+
+import (
+	"net"
+	"testing"
+
+	"github.com/josephlewis42/historia/threephase"
+)
+
+func TestServerUnknownKind(t *testing.T) {
+	server := NewServer(nil, nil)
+	reply := server.dispatch(frame{id: 3, kind: 0x7f})
+
+	if reply.id != 3 || reply.status != statusError || string(reply.payload) != threephase.UnsupportedMessageError.Error() {
+		t.Errorf("expected an error reply, got %+v", reply)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(nil, nil)
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != ServerClosedError {
+		t.Errorf("expected Serve to return ServerClosedError got %v", err)
+	}
+
+	if _, err := readFrame(conn); err == nil {
+		t.Error("the connection was still open after Close")
+	}
+
+	if server.Serve(listener) != ServerClosedError {
+		t.Error("a closed server started serving again")
+	}
+}